@@ -0,0 +1,328 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// openAPISpec describes the JSON API
+//
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// deviceInfoTTL is how long the device information is cached, as it only changes with a firmware upgrade
+const deviceInfoTTL = time.Hour
+
+// apiSection is the envelope of every API response: the time the data was retrieved, and the error of the last attempt when it failed
+type apiSection struct {
+	Status    string      `json:"status"`
+	Timestamp *time.Time  `json:"timestamp,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	ErrorTime *time.Time  `json:"error_timestamp,omitempty"`
+	Data      interface{} `json:"data"`
+}
+
+// apiInterface is the JSON representation of InterfaceData
+type apiInterface struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	Status   float64 `json:"status"`
+	Speed    float64 `json:"speed"`
+	RXBytes  float64 `json:"rx_bytes"`
+	TXBytes  float64 `json:"tx_bytes"`
+	RXFrames float64 `json:"rx_frames"`
+	TXFrames float64 `json:"tx_frames"`
+	RXDrops  float64 `json:"rx_drops"`
+	TXDrops  float64 `json:"tx_drops"`
+	RXErrors float64 `json:"rx_errors"`
+	TXErrors float64 `json:"tx_errors"`
+}
+
+// apiGPON is the JSON representation of GPONData
+type apiGPON struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Status      float64 `json:"status"`
+	RXPower     float64 `json:"rx_power"`
+	TXPower     float64 `json:"tx_power"`
+	Transitions float64 `json:"transitions"`
+}
+
+// apiWifiClient is the JSON representation of WifiClient, with the vendor of the client
+type apiWifiClient struct {
+	Interface         string  `json:"interface"`
+	MAC               string  `json:"mac"`
+	Vendor            string  `json:"vendor"`
+	Randomized        bool    `json:"randomized"`
+	AssociatedTime    float64 `json:"associated_time"`
+	TXFrames          float64 `json:"tx_frames"`
+	TXUnicastFrames   float64 `json:"tx_unicast_frames"`
+	TXErrors          float64 `json:"tx_errors"`
+	TXRetries         float64 `json:"tx_retries"`
+	TXRate            float64 `json:"tx_rate"`
+	TXRetryRate       float64 `json:"tx_retry_rate"`
+	RXUnicastFrames   float64 `json:"rx_unicast_frames"`
+	RXBroadcastFrames float64 `json:"rx_broadcast_frames"`
+	RXRate            float64 `json:"rx_rate"`
+	RSSI              float64 `json:"rssi"`
+	Noise             float64 `json:"noise"`
+	SNR               float64 `json:"snr"`
+	Quality           float64 `json:"quality"`
+}
+
+// apiDevice is the JSON representation of DeviceInfo
+type apiDevice struct {
+	Target          string `json:"target"`
+	Manufacturer    string `json:"manufacturer"`
+	Model           string `json:"model"`
+	SerialNumber    string `json:"serial_number"`
+	HardwareVersion string `json:"hardware_version"`
+	SoftwareVersion string `json:"software_version"`
+}
+
+// apiInterfaces converts the interfaces of a snapshot to their JSON representation
+func apiInterfaces(snapshot *Snapshot) []apiInterface {
+	interfaces := []apiInterface{}
+	for _, Interface := range snapshot.Interfaces {
+		interfaces = append(interfaces, apiInterface{
+			ID:       Interface.ID,
+			Name:     Interface.Name,
+			Status:   Interface.Status,
+			Speed:    Interface.IfSpeed,
+			RXBytes:  Interface.rxBytes,
+			TXBytes:  Interface.txBytes,
+			RXFrames: Interface.rxFrames,
+			TXFrames: Interface.txFrames,
+			RXDrops:  Interface.rxDrops,
+			TXDrops:  Interface.txDrops,
+			RXErrors: Interface.rxErrs,
+			TXErrors: Interface.txErrs,
+		})
+	}
+	return interfaces
+}
+
+// newAPIGPON converts the GPON link to its JSON representation
+func newAPIGPON(gpon GPONData) apiGPON {
+	return apiGPON{
+		ID:          gpon.ID,
+		Name:        gpon.Name,
+		Status:      gpon.Status,
+		RXPower:     gpon.RXPower,
+		TXPower:     gpon.TXPower,
+		Transitions: gpon.Transitions,
+	}
+}
+
+// apiWifiClients converts the wifi clients of a snapshot to their JSON representation, resolving their vendor
+func apiWifiClients(exporter *ZhoneExporter, snapshot *Snapshot) []apiWifiClient {
+	clients := []apiWifiClient{}
+	for _, client := range snapshot.WifiClients {
+		vendor, randomized := exporter.clientVendor(client.MAC)
+		clients = append(clients, apiWifiClient{
+			Interface:         client.Interface,
+			MAC:               client.MAC,
+			Vendor:            vendor,
+			Randomized:        randomized,
+			AssociatedTime:    client.AssociatedTime,
+			TXFrames:          client.txFrames,
+			TXUnicastFrames:   client.TXUnicastFrames,
+			TXErrors:          client.txErrs,
+			TXRetries:         client.TXRetries,
+			TXRate:            client.TXRate,
+			TXRetryRate:       client.TxRetryRate,
+			RXUnicastFrames:   client.RXUnicastFrames,
+			RXBroadcastFrames: client.RXBcastFrames,
+			RXRate:            client.RXRate,
+			RSSI:              client.RSSI,
+			Noise:             client.Noise,
+			SNR:               client.SNR,
+			Quality:           client.Quality,
+		})
+	}
+	return clients
+}
+
+// API serves the latest parsed state of the gateway as JSON below /api/v1/
+type API struct {
+	exporter *ZhoneExporter
+	// CacheTTL is how long a snapshot is served before the gateway is scraped again
+	CacheTTL time.Duration
+
+	mu          sync.Mutex
+	snapshot    *Snapshot
+	scrapeErr   error
+	scrapeErrAt time.Time
+	attempted   time.Time
+	device      *DeviceInfo
+	deviceAt    time.Time
+	deviceErr   error
+	deviceErrAt time.Time
+	// deviceAttempted is the time of the last device information fetch, successful or not
+	deviceAttempted time.Time
+	fetchDevice     func() (DeviceInfo, error)
+}
+
+// NewAPI builds the API for exporter, keeping the latest snapshot whoever scraped it
+func NewAPI(exporter *ZhoneExporter) *API {
+	a := &API{exporter: exporter, CacheTTL: 15 * time.Second}
+	if _, ok := exporter.Transport.(*WebTransport); ok {
+		a.fetchDevice = exporter.FetchDeviceInfo
+	}
+	exporter.Subscribe(func(snapshot *Snapshot) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.snapshot = snapshot
+		a.scrapeErr = nil
+	})
+	return a
+}
+
+// refresh scrapes the gateway when the latest snapshot is older than the cache TTL, keeping the previous snapshot on failure
+func (a *API) refresh() {
+	a.mu.Lock()
+	stale := (a.snapshot == nil || time.Since(a.snapshot.Time) > a.CacheTTL) && time.Since(a.attempted) > a.CacheTTL
+	if stale {
+		a.attempted = time.Now()
+	}
+	a.mu.Unlock()
+	if !stale {
+		return
+	}
+	// the subscription stores the snapshot on success
+	if _, err := a.exporter.Scrape(); err != nil {
+		a.mu.Lock()
+		a.scrapeErr = err
+		a.scrapeErrAt = time.Now()
+		a.mu.Unlock()
+	}
+}
+
+// section wraps data from the latest snapshot with its timestamp and error status: stale when the last attempt failed, error without any data
+func (a *API) section(data func(*Snapshot) interface{}) apiSection {
+	a.refresh()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	section := apiSection{Status: "ok"}
+	if a.snapshot != nil {
+		t := a.snapshot.Time
+		section.Timestamp = &t
+		section.Data = data(a.snapshot)
+	}
+	if a.scrapeErr != nil {
+		section.Status = "stale"
+		if a.snapshot == nil {
+			section.Status = "error"
+		}
+		section.Error = a.scrapeErr.Error()
+		t := a.scrapeErrAt
+		section.ErrorTime = &t
+	}
+	return section
+}
+
+// refreshDevice fetches the device information once an hour, outside the lock so a slow gateway doesn't hold up the other sections
+func (a *API) refreshDevice() {
+	a.mu.Lock()
+	if a.fetchDevice == nil {
+		// the CLI transports don't provide the serial number and versions
+		if a.device == nil {
+			a.device = &DeviceInfo{Manufacturer: "Zhone", Model: defaultModel}
+			a.deviceAt = time.Now()
+		}
+		a.mu.Unlock()
+		return
+	}
+	stale := (a.device == nil || time.Since(a.deviceAt) > deviceInfoTTL) && time.Since(a.deviceAttempted) > a.CacheTTL
+	if stale {
+		a.deviceAttempted = time.Now()
+	}
+	a.mu.Unlock()
+	if !stale {
+		return
+	}
+	device, err := a.fetchDevice()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err != nil {
+		a.deviceErr = err
+		a.deviceErrAt = time.Now()
+		return
+	}
+	a.device = &device
+	a.deviceAt = time.Now()
+	a.deviceErr = nil
+}
+
+// deviceSection returns the device information, fetching it again once an hour
+func (a *API) deviceSection() apiSection {
+	a.refreshDevice()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	section := apiSection{Status: "ok"}
+	if a.device != nil {
+		t := a.deviceAt
+		section.Timestamp = &t
+		section.Data = apiDevice{
+			Target:          a.exporter.URL,
+			Manufacturer:    a.device.Manufacturer,
+			Model:           a.device.Model,
+			SerialNumber:    a.device.SerialNumber,
+			HardwareVersion: a.device.HardwareVersion,
+			SoftwareVersion: a.device.SoftwareVersion,
+		}
+	}
+	if a.deviceErr != nil {
+		section.Status = "stale"
+		if a.device == nil {
+			section.Status = "error"
+		}
+		section.Error = a.deviceErr.Error()
+		t := a.deviceErrAt
+		section.ErrorTime = &t
+	}
+	return section
+}
+
+// ServeHTTP routes the API requests
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var section apiSection
+	switch r.URL.Path {
+	case "/api/v1/interfaces":
+		section = a.section(func(snapshot *Snapshot) interface{} {
+			return apiInterfaces(snapshot)
+		})
+	case "/api/v1/gpon":
+		section = a.section(func(snapshot *Snapshot) interface{} {
+			return newAPIGPON(snapshot.GPON)
+		})
+	case "/api/v1/wifi/clients":
+		section = a.section(func(snapshot *Snapshot) interface{} {
+			return apiWifiClients(a.exporter, snapshot)
+		})
+	case "/api/v1/device":
+		section = a.deviceSection()
+	case "/api/v1/openapi.yaml":
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(openAPISpec)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if section.Status == "error" {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(section)
+}
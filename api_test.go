@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAPIDeviceFetchDoesNotBlock(t *testing.T) {
+	exporter := NewZhoneExporter("gateway", "user", "user")
+	exporter.Transport = transportFunc(func() (*Snapshot, error) {
+		return &Snapshot{GPON: GPONData{ID: "eth0", Status: 1, RXPower: -19.5}}, nil
+	})
+	api := NewAPI(exporter)
+	started, release := make(chan struct{}), make(chan struct{})
+	api.fetchDevice = func() (DeviceInfo, error) {
+		close(started)
+		<-release
+		return DeviceInfo{Manufacturer: "Zhone", Model: defaultModel, SerialNumber: "ZNTS01234567"}, nil
+	}
+	get := func(path string) (int, apiSection) {
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var section apiSection
+		if err := json.Unmarshal(rec.Body.Bytes(), &section); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+		return rec.Code, section
+	}
+
+	device := make(chan apiSection)
+	go func() {
+		_, section := get("/api/v1/device")
+		device <- section
+	}()
+	<-started
+	// the other sections are served while the device page is fetched
+	served := make(chan int)
+	go func() {
+		code, _ := get("/api/v1/gpon")
+		served <- code
+	}()
+	select {
+	case code := <-served:
+		if code != http.StatusOK {
+			t.Errorf("/api/v1/gpon answered HTTP %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("/api/v1/gpon waited for the device page")
+	}
+	close(release)
+	if section := <-device; section.Status != "ok" || section.Data.(map[string]interface{})["serial_number"] != "ZNTS01234567" {
+		t.Errorf("device section = %+v", section)
+	}
+}
+
+func TestAPIDeviceError(t *testing.T) {
+	exporter := NewZhoneExporter("gateway", "user", "user")
+	api := NewAPI(exporter)
+	fetches := 0
+	api.fetchDevice = func() (DeviceInfo, error) {
+		fetches++
+		return DeviceInfo{}, errors.New("connection refused")
+	}
+	for i := 0; i < 2; i++ {
+		if section := api.deviceSection(); section.Status != "error" || section.Error != "connection refused" {
+			t.Errorf("device section = %+v, want the error", section)
+		}
+	}
+	// a failed fetch is not retried within the cache TTL
+	if fetches != 1 {
+		t.Errorf("fetched the device page %d times, want once", fetches)
+	}
+}
+
+// getSection requests an API path and decodes the section, with its data into data
+func getSection(t *testing.T, api *API, path string, data interface{}) (int, apiSection) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("%s: Content-Type %q", path, contentType)
+	}
+	section := apiSection{Data: data}
+	if err := json.Unmarshal(rec.Body.Bytes(), &section); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return rec.Code, section
+}
+
+func TestAPISections(t *testing.T) {
+	api := NewAPI(testGateway(t, scrapePages))
+
+	var interfaces []apiInterface
+	code, section := getSection(t, api, "/api/v1/interfaces", &interfaces)
+	if code != http.StatusOK || section.Status != "ok" || section.Timestamp == nil || section.Error != "" {
+		t.Errorf("interfaces: HTTP %d %+v", code, section)
+	}
+	found := false
+	for _, Interface := range interfaces {
+		if Interface.ID == "eth0" {
+			found = true
+			if Interface.Name != "GPON" || Interface.RXBytes != 98765432100 || Interface.RXDrops != 12 {
+				t.Errorf("eth0 = %+v", Interface)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("no eth0 among %+v", interfaces)
+	}
+
+	var gpon apiGPON
+	code, section = getSection(t, api, "/api/v1/gpon", &gpon)
+	if code != http.StatusOK || section.Status != "ok" {
+		t.Errorf("gpon: HTTP %d %+v", code, section)
+	}
+	if gpon.ID != "eth0" || gpon.Status != 1 || gpon.RXPower != -19.51 || gpon.TXPower != 2.1 || gpon.Transitions != 3 {
+		t.Errorf("gpon = %+v", gpon)
+	}
+
+	var clients []apiWifiClient
+	code, section = getSection(t, api, "/api/v1/wifi/clients", &clients)
+	if code != http.StatusOK || section.Status != "ok" {
+		t.Errorf("wifi clients: HTTP %d %+v", code, section)
+	}
+	macs := make(map[string]bool)
+	for _, client := range clients {
+		macs[client.MAC] = client.Randomized
+	}
+	if want := map[string]bool{"3c:22:fb:00:00:09": false, "da:a1:19:00:00:01": true}; !reflect.DeepEqual(macs, want) {
+		t.Errorf("wifi clients %v, want %v as randomized", macs, want)
+	}
+}
+
+func TestAPIScrapeError(t *testing.T) {
+	exporter := testGateway(t, scrapePages)
+	web := exporter.Transport
+	exporter.Transport = transportFunc(func() (*Snapshot, error) {
+		return nil, errors.New("connection refused")
+	})
+	api := NewAPI(exporter)
+	// every request scrapes the gateway
+	api.CacheTTL = 0
+	paths := []string{"/api/v1/interfaces", "/api/v1/gpon", "/api/v1/wifi/clients"}
+
+	// without any snapshot, the sections are errors
+	for _, path := range paths {
+		code, section := getSection(t, api, path, nil)
+		if code != http.StatusBadGateway || section.Status != "error" || section.Error != "connection refused" || section.ErrorTime == nil || section.Data != nil {
+			t.Errorf("%s: HTTP %d %+v, want the scrape error", path, code, section)
+		}
+	}
+
+	// the gateway answers once, then fails again: the last snapshot is served as stale
+	exporter.Transport = web
+	if code, section := getSection(t, api, "/api/v1/gpon", nil); code != http.StatusOK || section.Status != "ok" {
+		t.Fatalf("after a successful scrape: HTTP %d %+v", code, section)
+	}
+	exporter.Transport = transportFunc(func() (*Snapshot, error) {
+		return nil, errors.New("connection refused")
+	})
+	for _, path := range paths {
+		code, section := getSection(t, api, path, nil)
+		if code != http.StatusOK || section.Status != "stale" || section.Error != "connection refused" || section.Timestamp == nil || section.Data == nil {
+			t.Errorf("%s: HTTP %d %+v, want the previous data as stale", path, code, section)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Nagios plugin exit codes
+const (
+	checkOK       = 0
+	checkWarning  = 1
+	checkCritical = 2
+	checkUnknown  = 3
+)
+
+var checkStates = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// Default thresholds of the GPON optical levels, in dBm
+const (
+	defaultRXWarning  = "-25:-10"
+	defaultRXCritical = "-27:-8"
+	defaultTXWarning  = "0.5:5"
+	defaultTXCritical = "0:6"
+)
+
+// nagiosRange is a threshold range in the syntax of the Nagios plugin guidelines: [@]start:end, start defaulting to 0 and ~ meaning negative infinity
+type nagiosRange struct {
+	spec       string
+	start, end float64
+	inside     bool
+}
+
+// parseNagiosRange parses a threshold range, an empty spec never alerts
+func parseNagiosRange(spec string) (nagiosRange, error) {
+	r := nagiosRange{spec: spec, end: math.Inf(1)}
+	if spec == "" {
+		r.start = math.Inf(-1)
+		return r, nil
+	}
+	s := spec
+	if strings.HasPrefix(s, "@") {
+		r.inside = true
+		s = s[1:]
+	}
+	if s == "" {
+		return r, fmt.Errorf("invalid range %q", spec)
+	}
+	start, end := "0", s
+	if i := strings.Index(s, ":"); i >= 0 {
+		start, end = s[:i], s[i+1:]
+	}
+	var err error
+	switch start {
+	case "~":
+		r.start = math.Inf(-1)
+	case "":
+	default:
+		if r.start, err = strconv.ParseFloat(start, 64); err != nil {
+			return r, fmt.Errorf("invalid range %q", spec)
+		}
+	}
+	if end != "" {
+		if r.end, err = strconv.ParseFloat(end, 64); err != nil {
+			return r, fmt.Errorf("invalid range %q", spec)
+		}
+	}
+	if r.start > r.end {
+		return r, fmt.Errorf("invalid range %q, start is greater than end", spec)
+	}
+	return r, nil
+}
+
+// alert tells whether a value is outside the range, or inside for an @ range
+func (r nagiosRange) alert(value float64) bool {
+	if r.spec == "" {
+		return false
+	}
+	inside := value >= r.start && value <= r.end
+	return inside == r.inside
+}
+
+// checkResult collects the state, problems and perfdata of a check
+type checkResult struct {
+	state    int
+	problems []string
+	perfdata []string
+}
+
+// add records a problem, raising the state of the check
+func (c *checkResult) add(state int, problem string) {
+	if state > c.state {
+		c.state = state
+	}
+	c.problems = append(c.problems, checkStates[state]+": "+problem)
+}
+
+// threshold evaluates a value against the warning and critical ranges and adds its perfdata
+func (c *checkResult) threshold(label string, value float64, uom string, warning nagiosRange, critical nagiosRange, description string) {
+	switch {
+	case critical.alert(value):
+		c.add(checkCritical, description)
+	case warning.alert(value):
+		c.add(checkWarning, description)
+	}
+	c.perf(label, value, uom, warning.spec, critical.spec)
+}
+
+// perf adds perfdata in the 'label'=value[UOM];warn;crit format
+func (c *checkResult) perf(label string, value float64, uom string, warning string, critical string) {
+	c.perfdata = append(c.perfdata, fmt.Sprintf("'%s'=%s%s;%s;%s", label, strconv.FormatFloat(value, 'f', -1, 64), uom, warning, critical))
+}
+
+// errorRatio returns the share of errored frames of an interface between two collections, in percent. The counters
+// since boot would hide a recent burst of errors behind months of clean traffic
+func errorRatio(previous InterfaceData, current InterfaceData) float64 {
+	frames := current.rxFrames + current.txFrames - previous.rxFrames - previous.txFrames
+	errors := current.rxErrs + current.txErrs - previous.rxErrs - previous.txErrs
+	// nothing was sent, or the counters were reset in between
+	if frames <= 0 || errors < 0 {
+		return 0
+	}
+	return math.Round(errors/frames*10000) / 100
+}
+
+// runCheck implements the check subcommand, a Nagios/Icinga plugin returning the plugin exit code
+func runCheck(args []string) int {
+	flags := newSubcommand("check")
+	gateway := addGatewayFlags(flags)
+	timeout := flags.Duration("timeout", 10*time.Second, "Time allowed for the collection, UNKNOWN when exceeded")
+	rxWarning := flags.String("rx-warning", defaultRXWarning, "Warning range of the GPON receive power, in dBm")
+	rxCritical := flags.String("rx-critical", defaultRXCritical, "Critical range of the GPON receive power, in dBm")
+	txWarning := flags.String("tx-warning", defaultTXWarning, "Warning range of the GPON transmit power, in dBm")
+	txCritical := flags.String("tx-critical", defaultTXCritical, "Critical range of the GPON transmit power, in dBm")
+	interfaces := flags.String("interfaces", "", "Interfaces that must be up besides the GPON link, separated by commas")
+	errorsWarning := flags.String("errors-warning", "1", "Warning range of the errored frames of each interface, in percent")
+	errorsCritical := flags.String("errors-critical", "5", "Critical range of the errored frames of each interface, in percent")
+	interval := flags.Duration("interval", 10*time.Second, "Time between the two collections the errored frames are computed from, 0 to leave them out")
+	if err := flags.Parse(args); err != nil {
+		return checkUnknown
+	}
+	unknown := func(format string, a ...interface{}) int {
+		fmt.Printf("ZHONE UNKNOWN - "+format+"\n", a...)
+		return checkUnknown
+	}
+	if flags.NArg() != 1 {
+		return unknown("Incorrect arguments passed, see usage.")
+	}
+	ranges := make(map[string]nagiosRange)
+	for name, spec := range map[string]string{
+		"rx-warning": *rxWarning, "rx-critical": *rxCritical,
+		"tx-warning": *txWarning, "tx-critical": *txCritical,
+		"errors-warning": *errorsWarning, "errors-critical": *errorsCritical,
+	} {
+		r, err := parseNagiosRange(spec)
+		if err != nil {
+			return unknown("-%s: %v", name, err)
+		}
+		ranges[name] = r
+	}
+
+	exporter, err := gateway.exporter(flags.Arg(0))
+	if err != nil {
+		return unknown("%v", err)
+	}
+	type scrape struct {
+		snapshot *Snapshot
+		err      error
+	}
+	collect := func() (*Snapshot, error) {
+		done := make(chan scrape, 1)
+		go func() {
+			snapshot, err := exporter.Scrape()
+			done <- scrape{snapshot, err}
+		}()
+		select {
+		case result := <-done:
+			return result.snapshot, result.err
+		case <-time.After(*timeout):
+			return nil, fmt.Errorf("Collection from %s timed out after %s", exporter.URL, *timeout)
+		}
+	}
+	snapshot, err := collect()
+	if err != nil {
+		return unknown("%v", err)
+	}
+	// the errored frames are counted between two collections
+	var previous map[string]InterfaceData
+	if *interval > 0 {
+		previous = make(map[string]InterfaceData)
+		for _, Interface := range snapshot.Interfaces {
+			previous[Interface.ID] = Interface
+		}
+		time.Sleep(*interval)
+		if snapshot, err = collect(); err != nil {
+			return unknown("%v", err)
+		}
+	}
+
+	var c checkResult
+	gpon := snapshot.GPON
+	if gpon.Status != 1 {
+		c.add(checkCritical, "GPON link down")
+	}
+	c.perf("gpon_up", gpon.Status, "", "", "1:")
+	c.threshold("rx_power", gpon.RXPower, "", ranges["rx-warning"], ranges["rx-critical"], fmt.Sprintf("GPON receive power %.2f dBm", gpon.RXPower))
+	c.threshold("tx_power", gpon.TXPower, "", ranges["tx-warning"], ranges["tx-critical"], fmt.Sprintf("GPON transmit power %.2f dBm", gpon.TXPower))
+	c.perf("up_transitions", gpon.Transitions, "c", "", "")
+
+	required := make(map[string]bool)
+	if *interfaces != "" {
+		for _, id := range strings.Split(*interfaces, ",") {
+			required[strings.TrimSpace(id)] = true
+		}
+	}
+	for _, Interface := range snapshot.Interfaces {
+		if required[Interface.ID] {
+			delete(required, Interface.ID)
+			if Interface.Status != 1 {
+				c.add(checkCritical, fmt.Sprintf("%s (%s) down", Interface.ID, Interface.Name))
+			}
+		}
+		if last, ok := previous[Interface.ID]; ok {
+			ratio := errorRatio(last, Interface)
+			c.threshold(Interface.ID+"_errors", ratio, "%", ranges["errors-warning"], ranges["errors-critical"], fmt.Sprintf("%s (%s) %.2f%% errored frames in the last %s", Interface.ID, Interface.Name, ratio, *interval))
+		}
+		c.perf(Interface.ID+"_rx_bytes", Interface.rxBytes, "c", "", "")
+		c.perf(Interface.ID+"_tx_bytes", Interface.txBytes, "c", "", "")
+	}
+	for id := range required {
+		c.add(checkCritical, fmt.Sprintf("%s not found", id))
+	}
+
+	summary := fmt.Sprintf("GPON %s, RX %.2f dBm, TX %.2f dBm, %d interfaces", linkState(gpon.Status), gpon.RXPower, gpon.TXPower, len(snapshot.Interfaces))
+	if len(c.problems) > 0 {
+		// the most severe problems first, the others on the following lines
+		first := c.problems[0]
+		for _, problem := range c.problems {
+			if strings.HasPrefix(problem, checkStates[c.state]+":") {
+				first = problem
+				break
+			}
+		}
+		summary = strings.SplitN(first, ": ", 2)[1]
+		if len(c.problems) > 1 {
+			summary += fmt.Sprintf(" and %d more", len(c.problems)-1)
+		}
+	}
+	fmt.Printf("ZHONE %s - %s | %s\n", checkStates[c.state], summary, strings.Join(c.perfdata, " "))
+	for _, problem := range c.problems {
+		fmt.Println(problem)
+	}
+	return c.state
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseNagiosRange(t *testing.T) {
+	inf := math.Inf(1)
+	for _, test := range []struct {
+		spec             string
+		start, end       float64
+		inside           bool
+		alerts, noAlerts []float64
+	}{
+		{spec: "10", start: 0, end: 10, alerts: []float64{-1, 10.5}, noAlerts: []float64{0, 5, 10}},
+		{spec: "10:", start: 10, end: inf, alerts: []float64{9.9}, noAlerts: []float64{10, 1e9}},
+		{spec: "~:10", start: -inf, end: 10, alerts: []float64{11}, noAlerts: []float64{-1e9, 10}},
+		{spec: "-25:-10", start: -25, end: -10, alerts: []float64{-25.4, -9}, noAlerts: []float64{-25, -19.5, -10}},
+		{spec: "@10:20", start: 10, end: 20, inside: true, alerts: []float64{10, 15, 20}, noAlerts: []float64{9, 21}},
+		{spec: "0.5:5", start: 0.5, end: 5, alerts: []float64{0.4, 5.1}, noAlerts: []float64{2.1}},
+		{spec: "", start: -inf, end: inf, noAlerts: []float64{-1e9, 0, 1e9}},
+	} {
+		t.Run(test.spec, func(t *testing.T) {
+			r, err := parseNagiosRange(test.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.start != test.start || r.end != test.end || r.inside != test.inside {
+				t.Errorf("parseNagiosRange(%q) = %+v, want start %v end %v inside %v", test.spec, r, test.start, test.end, test.inside)
+			}
+			for _, value := range test.alerts {
+				if !r.alert(value) {
+					t.Errorf("%v doesn't alert, want an alert", value)
+				}
+			}
+			for _, value := range test.noAlerts {
+				if r.alert(value) {
+					t.Errorf("%v alerts, want none", value)
+				}
+			}
+		})
+	}
+	for _, spec := range []string{"abc", "10:abc", "20:10", "@", "~"} {
+		if _, err := parseNagiosRange(spec); err == nil {
+			t.Errorf("parseNagiosRange(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestErrorRatio(t *testing.T) {
+	previous := InterfaceData{ID: "eth0", rxFrames: 1e9, txFrames: 1e9, rxErrs: 10, txErrs: 0}
+	for _, test := range []struct {
+		name    string
+		current InterfaceData
+		want    float64
+	}{
+		{name: "burst of errors", current: InterfaceData{rxFrames: 1e9 + 600, txFrames: 1e9 + 400, rxErrs: 60, txErrs: 10}, want: 6},
+		{name: "clean", current: InterfaceData{rxFrames: 1e9 + 600, txFrames: 1e9 + 400, rxErrs: 10, txErrs: 0}, want: 0},
+		{name: "idle", current: previous, want: 0},
+		{name: "counters reset", current: InterfaceData{rxFrames: 100, txFrames: 100, rxErrs: 1}, want: 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := errorRatio(previous, test.current); got != test.want {
+				t.Errorf("errorRatio = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
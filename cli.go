@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Commands run on the gateway's Linux shell by the CLI transport
+const (
+	cliInterfacesCommand = "cat /proc/net/dev"
+	cliLinkCommand       = `for i in /sys/class/net/eth*; do echo "${i##*/} $(cat $i/operstate) $(cat $i/speed 2>/dev/null)"; done`
+	cliRXPowerCommand    = "laser power --rxread"
+	cliTXPowerCommand    = "laser power --txread"
+	cliONUStateCommand   = "gponctl getOnuState"
+)
+
+var (
+	onuOperationRE = regexp.MustCompile(`(?i)\bO5\b|operation`)
+	opticalLevelRE = regexp.MustCompile(`(-?\d+(?:\.\d+)?)\s*dBm`)
+	assocListMACRE = regexp.MustCompile(`(?i)([0-9a-f]{2}(?::[0-9a-f]{2}){5})`)
+)
+
+// The station counters printed by wlctl sta_info
+var (
+	staInNetworkRE   = regexp.MustCompile(`(?i)in network\s*(\d+)`)
+	staTXPacketsRE   = regexp.MustCompile(`(?i)tx (?:total )?pkts:\s*(\d+)`)
+	staTXUnicastRE   = regexp.MustCompile(`(?i)tx ucast pkts:\s*(\d+)`)
+	staTXFailuresRE  = regexp.MustCompile(`(?i)tx failures:\s*(\d+)`)
+	staTXRetriesRE   = regexp.MustCompile(`(?i)tx (?:pkts )?retries:\s*(\d+)`)
+	staRXUnicastRE   = regexp.MustCompile(`(?i)rx ucast pkts:\s*(\d+)`)
+	staRXBroadcastRE = regexp.MustCompile(`(?i)rx mcast/bcast pkts:\s*(\d+)`)
+	staTXRateRE      = regexp.MustCompile(`(?i)rate of last tx pkt:\s*(\d+)`)
+	staRXRateRE      = regexp.MustCompile(`(?i)rate of last rx pkt:\s*(\d+)`)
+)
+
+// CLISession runs commands on the command line of the gateway
+type CLISession interface {
+	Run(command string) (string, error)
+	Close() error
+}
+
+// CLITransport obtains the same data as the web interface by running commands over telnet or SSH,
+// for gateways with the web interface locked down
+type CLITransport struct {
+	dial func() (CLISession, error)
+}
+
+// NewTelnetTransport builds a CLITransport logging in over telnet, with the credentials returned by credentials at every login
+func NewTelnetTransport(address string, credentials func() (string, string)) *CLITransport {
+	return &CLITransport{dial: func() (CLISession, error) {
+		username, password := credentials()
+		return DialTelnet(address, username, password, 30*time.Second)
+	}}
+}
+
+// NewSSHTransport builds a CLITransport logging in over SSH with a password, with the credentials returned by credentials at every login
+func NewSSHTransport(address string, credentials func() (string, string), hostKeyCallback ssh.HostKeyCallback) *CLITransport {
+	return &CLITransport{dial: func() (CLISession, error) {
+		username, password := credentials()
+		config := &ssh.ClientConfig{
+			User:            username,
+			Auth:            []ssh.AuthMethod{ssh.Password(password)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         10 * time.Second,
+		}
+		client, err := ssh.Dial("tcp", address, config)
+		if err != nil {
+			return nil, err
+		}
+		return &sshSession{client: client}, nil
+	}}
+}
+
+// Fetch logs in on the gateway and runs the commands needed to fill a Snapshot
+func (t *CLITransport) Fetch() (*Snapshot, error) {
+	session, err := t.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	out, err := session.Run(cliInterfacesCommand)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{}
+	if err := parse("ParseProcNetDev", func() { snapshot.Interfaces = ParseProcNetDev(out) }); err != nil {
+		return nil, err
+	}
+	out, err = session.Run(cliLinkCommand)
+	if err != nil {
+		return nil, err
+	}
+	if err := parse("ParseLinkStates", func() { snapshot.Ports = ParseLinkStates(out) }); err != nil {
+		return nil, err
+	}
+	for i := range snapshot.Interfaces {
+		port := snapshot.Ports[snapshot.Interfaces[i].ID]
+		snapshot.Interfaces[i].Status = port.Status()
+		snapshot.Interfaces[i].IfSpeed = port.Speed
+	}
+	if snapshot.GPON, err = t.fetchGPON(session); err != nil {
+		return nil, err
+	}
+	for _, Interface := range snapshot.Interfaces {
+		if !strings.HasPrefix(Interface.ID, "wl") {
+			continue
+		}
+		clients, err := t.fetchWifiClients(session, Interface.ID)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.WifiClients = append(snapshot.WifiClients, clients...)
+	}
+	return snapshot, nil
+}
+
+func (t *CLITransport) fetchGPON(session CLISession) (GPONData, error) {
+	var gpon GPONData
+	out, err := session.Run(cliRXPowerCommand)
+	if err != nil {
+		return gpon, err
+	}
+	if gpon.RXPower, err = ParseOpticalLevel(out); err != nil {
+		parseErrors.WithLabelValues("ParseOpticalLevel").Inc()
+		return gpon, err
+	}
+	out, err = session.Run(cliTXPowerCommand)
+	if err != nil {
+		return gpon, err
+	}
+	if gpon.TXPower, err = ParseOpticalLevel(out); err != nil {
+		parseErrors.WithLabelValues("ParseOpticalLevel").Inc()
+		return gpon, err
+	}
+	out, err = session.Run(cliONUStateCommand)
+	if err != nil {
+		return gpon, err
+	}
+	// the ONU is registered with the OLT in operation state O5
+	if onuOperationRE.MatchString(out) {
+		gpon.Status = 1
+	}
+	return gpon, nil
+}
+
+func (t *CLITransport) fetchWifiClients(session CLISession, radio string) ([]WifiClient, error) {
+	out, err := session.Run("wlctl -i " + radio + " assoclist")
+	if err != nil {
+		return nil, err
+	}
+	var macs []string
+	if err := parse("ParseAssocList", func() { macs = ParseAssocList(out) }); err != nil {
+		return nil, err
+	}
+	if len(macs) == 0 {
+		return nil, nil
+	}
+	out, err = session.Run("wlctl -i " + radio + " noise")
+	if err != nil {
+		return nil, err
+	}
+	noise, _ := strconv.ParseFloat(strings.TrimSpace(out), 64)
+	var clients []WifiClient
+	for _, mac := range macs {
+		out, err := session.Run("wlctl -i " + radio + " sta_info " + mac)
+		if err != nil {
+			return nil, err
+		}
+		var client WifiClient
+		if err := parse("ParseStaInfo", func() { client = ParseStaInfo(out) }); err != nil {
+			return nil, err
+		}
+		client.Interface = radio
+		client.MAC = mac
+		out, err = session.Run("wlctl -i " + radio + " rssi " + mac)
+		if err != nil {
+			return nil, err
+		}
+		client.RSSI, _ = strconv.ParseFloat(strings.TrimSpace(out), 64)
+		client.Noise = noise
+		client.SNR = client.RSSI - noise
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+// ParseProcNetDev parses the interface counters in /proc/net/dev. The CLI has no descriptive interface names, so the ID is used for both
+func ParseProcNetDev(out string) []InterfaceData {
+	var interfaces []InterfaceData
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name := strings.TrimSpace(parts[0])
+		fields := strings.Fields(parts[1])
+		if name == "lo" || len(fields) < 12 {
+			continue
+		}
+		var values []float64
+		for _, field := range fields {
+			value, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				break
+			}
+			values = append(values, value)
+		}
+		if len(values) < 12 {
+			continue
+		}
+		interfaces = append(interfaces, InterfaceData{
+			ID:       name,
+			Name:     name,
+			rxBytes:  values[0],
+			rxFrames: values[1],
+			rxErrs:   values[2],
+			rxDrops:  values[3],
+			txBytes:  values[8],
+			txFrames: values[9],
+			txErrs:   values[10],
+			txDrops:  values[11],
+		})
+	}
+	return interfaces
+}
+
+// ParseLinkStates parses the "<interface> <operstate> <speed>" lines printed by cliLinkCommand
+func ParseLinkStates(out string) map[string]EthernetPort {
+	ports := make(map[string]EthernetPort)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		port := EthernetPort{ID: fields[0], State: normalizeLinkState(fields[1])}
+		if len(fields) > 2 && port.State == linkUp {
+			port.Speed, _ = strconv.ParseFloat(fields[2], 64)
+		}
+		ports[port.ID] = port
+	}
+	return ports
+}
+
+// ParseOpticalLevel extracts the level in dBm from the output of the laser tool
+func ParseOpticalLevel(out string) (float64, error) {
+	match := opticalLevelRE.FindStringSubmatch(out)
+	if match == nil {
+		return 0, fmt.Errorf("no optical level in %q", strings.TrimSpace(out))
+	}
+	return strconv.ParseFloat(match[1], 64)
+}
+
+// ParseAssocList returns the MAC addresses listed by wlctl assoclist
+func ParseAssocList(out string) []string {
+	var macs []string
+	for _, match := range assocListMACRE.FindAllString(out, -1) {
+		macs = append(macs, normalizeMAC(match))
+	}
+	return macs
+}
+
+// ParseStaInfo parses the station counters printed by wlctl sta_info
+func ParseStaInfo(out string) WifiClient {
+	var client WifiClient
+	value := func(re *regexp.Regexp) float64 {
+		match := re.FindStringSubmatch(out)
+		if match == nil {
+			return 0
+		}
+		f, _ := strconv.ParseFloat(match[1], 64)
+		return f
+	}
+	client.AssociatedTime = value(staInNetworkRE)
+	client.txFrames = value(staTXPacketsRE)
+	client.TXUnicastFrames = value(staTXUnicastRE)
+	client.txErrs = value(staTXFailuresRE)
+	client.TXRetries = value(staTXRetriesRE)
+	client.RXUnicastFrames = value(staRXUnicastRE)
+	client.RXBcastFrames = value(staRXBroadcastRE)
+	// wlctl reports rates in kbps, the web interface in Mbps
+	client.TXRate = value(staTXRateRE) / 1000
+	client.RXRate = value(staRXRateRE) / 1000
+	if client.txFrames > 0 {
+		client.TxRetryRate = client.TXRetries / client.txFrames * 100
+	}
+	return client
+}
+
+// sshSession runs every command in its own SSH session on a shared connection
+type sshSession struct {
+	client *ssh.Client
+}
+
+func (s *sshSession) Run(command string) (string, error) {
+	session, err := s.client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	out, err := session.CombinedOutput(command)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", command, err)
+	}
+	return string(out), nil
+}
+
+func (s *sshSession) Close() error {
+	return s.client.Close()
+}
+
+// Telnet protocol bytes, RFC 854
+const (
+	telnetIAC  = 255
+	telnetDONT = 254
+	telnetDO   = 253
+	telnetWONT = 252
+	telnetWILL = 251
+	telnetSB   = 250
+	telnetSE   = 240
+)
+
+var (
+	telnetLoginRE    = regexp.MustCompile(`(?i)(login|username)\s*:\s*$`)
+	telnetPasswordRE = regexp.MustCompile(`(?i)password\s*:\s*$`)
+	telnetPromptRE   = regexp.MustCompile(`[#>$]\s*$`)
+	telnetFailedRE   = regexp.MustCompile(`(?i)(incorrect|invalid|failed|denied)`)
+)
+
+// TelnetSession is a logged in telnet connection to a shell
+type TelnetSession struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+// DialTelnet connects to address and logs in. All telnet options offered by the server are refused
+func DialTelnet(address string, username string, password string, timeout time.Duration) (*TelnetSession, error) {
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	s := &TelnetSession{conn: conn, reader: bufio.NewReader(conn), timeout: timeout}
+	if _, err := s.readUntil(telnetLoginRE); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("waiting for login prompt: %w", err)
+	}
+	if err := s.write(username + "\r\n"); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if _, err := s.readUntil(telnetPasswordRE); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("waiting for password prompt: %w", err)
+	}
+	if err := s.write(password + "\r\n"); err != nil {
+		s.Close()
+		return nil, err
+	}
+	out, err := s.readUntil(telnetPromptRE, telnetLoginRE)
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("waiting for shell prompt: %w", err)
+	}
+	if telnetLoginRE.MatchString(out) || telnetFailedRE.MatchString(out) {
+		s.Close()
+		return nil, fmt.Errorf("telnet login to %s failed", address)
+	}
+	return s, nil
+}
+
+// Run sends a command and returns its output, without the echoed command line and the prompt
+func (s *TelnetSession) Run(command string) (string, error) {
+	if err := s.write(command + "\r\n"); err != nil {
+		return "", err
+	}
+	out, err := s.readUntil(telnetPromptRE)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", command, err)
+	}
+	lines := strings.Split(strings.Replace(out, "\r", "", -1), "\n")
+	if len(lines) < 2 {
+		return "", nil
+	}
+	return strings.Join(lines[1:len(lines)-1], "\n"), nil
+}
+
+// Close ends the session
+func (s *TelnetSession) Close() error {
+	return s.conn.Close()
+}
+
+func (s *TelnetSession) write(text string) error {
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.timeout)); err != nil {
+		return err
+	}
+	_, err := s.conn.Write([]byte(text))
+	return err
+}
+
+// readUntil reads text until it ends in a match for one of the patterns, answering option negotiation on the way
+func (s *TelnetSession) readUntil(patterns ...*regexp.Regexp) (string, error) {
+	if err := s.conn.SetReadDeadline(time.Now().Add(s.timeout)); err != nil {
+		return "", err
+	}
+	var text []byte
+	for {
+		b, err := s.reader.ReadByte()
+		if err != nil {
+			return string(text), err
+		}
+		if b == telnetIAC {
+			// IAC IAC is an escaped 255 data byte
+			if next, err := s.reader.Peek(1); err == nil && next[0] == telnetIAC {
+				s.reader.ReadByte()
+				text = append(text, b)
+				continue
+			}
+			if err := s.negotiate(); err != nil {
+				return string(text), err
+			}
+			continue
+		}
+		if b != 0 {
+			text = append(text, b)
+		}
+		// only look for a prompt once the server has stopped sending
+		if s.reader.Buffered() > 0 {
+			continue
+		}
+		for _, pattern := range patterns {
+			if pattern.Match(text) {
+				return string(text), nil
+			}
+		}
+	}
+}
+
+// negotiate handles the command following an IAC byte
+func (s *TelnetSession) negotiate() error {
+	command, err := s.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch command {
+	case telnetDO, telnetDONT, telnetWILL, telnetWONT:
+		option, err := s.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch command {
+		case telnetDO:
+			return s.write(string([]byte{telnetIAC, telnetWONT, option}))
+		case telnetWILL:
+			return s.write(string([]byte{telnetIAC, telnetDONT, option}))
+		}
+	case telnetSB:
+		// skip subnegotiation up to IAC SE
+		for {
+			b, err := s.reader.ReadByte()
+			if err != nil {
+				return err
+			}
+			if b == telnetIAC {
+				if b, err = s.reader.ReadByte(); err != nil || b == telnetSE {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// cliReplay maps the commands run by the CLI transport to the output recorded on a gateway, in testdata/cli
+var cliReplay = map[string]string{
+	cliInterfacesCommand:                      "proc_net_dev.txt",
+	cliLinkCommand:                            "operstate.txt",
+	cliRXPowerCommand:                         "laser_rxread.txt",
+	cliTXPowerCommand:                         "laser_txread.txt",
+	cliONUStateCommand:                        "gponctl_getonustate.txt",
+	"wlctl -i wl0 assoclist":                  "wlctl_assoclist.txt",
+	"wlctl -i wl0 noise":                      "wlctl_noise.txt",
+	"wlctl -i wl0 sta_info 3c:22:fb:00:00:09": "wlctl_sta_info_3c22fb000009.txt",
+	"wlctl -i wl0 sta_info da:a1:19:00:00:01": "wlctl_sta_info_daa119000001.txt",
+	"wlctl -i wl0 rssi 3c:22:fb:00:00:09":     "wlctl_rssi_3c22fb000009.txt",
+	"wlctl -i wl0 rssi da:a1:19:00:00:01":     "wlctl_rssi_daa119000001.txt",
+}
+
+// readOutput returns recorded command output from testdata/cli
+func readOutput(t *testing.T, name string) string {
+	t.Helper()
+	out, err := os.ReadFile(filepath.Join("testdata", "cli", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+// replay returns the recorded output of a command, and false for a command the gateway doesn't know
+func replay(command string) (string, bool) {
+	name, ok := cliReplay[command]
+	if !ok {
+		return fmt.Sprintf("sh: %s: not found\n", strings.Fields(command)[0]), false
+	}
+	out, err := os.ReadFile(filepath.Join("testdata", "cli", name))
+	if err != nil {
+		return err.Error() + "\n", false
+	}
+	return string(out), true
+}
+
+// fakeTelnet serves a BusyBox style telnet login replaying the recorded output, and returns its address
+func fakeTelnet(t *testing.T, username string, password string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTelnet(conn, username, password)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveTelnet(conn net.Conn, username string, password string) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	// readLine reads a line, dropping the answers to the option negotiation
+	readLine := func() (string, error) {
+		var line []byte
+		for {
+			b, err := reader.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			switch {
+			case b == telnetIAC:
+				reader.Discard(2)
+			case b == '\n':
+				return strings.TrimSuffix(string(line), "\r"), nil
+			default:
+				line = append(line, b)
+			}
+		}
+	}
+	// WILL ECHO, WILL SUPPRESS-GO-AHEAD, DO TERMINAL-TYPE
+	conn.Write([]byte{telnetIAC, telnetWILL, 1, telnetIAC, telnetWILL, 3, telnetIAC, telnetDO, 24})
+	conn.Write([]byte("ZNID-GPON-2726A1-UK login: "))
+	user, err := readLine()
+	if err != nil {
+		return
+	}
+	conn.Write([]byte("Password: "))
+	pass, err := readLine()
+	if err != nil {
+		return
+	}
+	if user != username || pass != password {
+		conn.Write([]byte("\r\nLogin incorrect\r\nZNID-GPON-2726A1-UK login: "))
+		readLine()
+		return
+	}
+	conn.Write([]byte("\r\n\r\nBusyBox v1.17.2 (2019-03-11 10:14:52 CET) built-in shell (ash)\r\nEnter 'help' for a list of built-in commands.\r\n\r\n# "))
+	for {
+		command, err := readLine()
+		if err != nil {
+			return
+		}
+		out, _ := replay(command)
+		conn.Write([]byte(command + "\r\n" + strings.Replace(out, "\n", "\r\n", -1) + "# "))
+	}
+}
+
+// fakeSSH serves exec sessions replaying the recorded output, and returns its address and host key
+func fakeSSH(t *testing.T, username string, password string) (string, ssh.PublicKey) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if conn.User() == username && string(pass) == password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %s", conn.User())
+		},
+	}
+	config.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+	return listener.Addr().String(), signer.PublicKey()
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var exec struct{ Command string }
+				ssh.Unmarshal(req.Payload, &exec)
+				req.Reply(true, nil)
+				out, ok := replay(exec.Command)
+				status := uint32(0)
+				if !ok {
+					status = 127
+				}
+				channel.Write([]byte(out))
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+				return
+			}
+		}()
+	}
+}
+
+// knownHostsFile writes a known_hosts file trusting key for address
+func knownHostsFile(t *testing.T, address string, key ssh.PublicKey) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(path, []byte(knownhosts.Line([]string{address}, key)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// cliSnapshot is the snapshot the recorded output amounts to
+var cliSnapshot = &Snapshot{
+	Interfaces: []InterfaceData{
+		{ID: "eth0", Name: "eth0", Status: 1, IfSpeed: 2500, rxBytes: 98765432100, rxFrames: 76543210, rxDrops: 12, txBytes: 12345678900, txFrames: 23456789},
+		{ID: "eth1", Name: "eth1", Status: 1, IfSpeed: 1000, rxBytes: 5000000, rxFrames: 40000, rxErrs: 1, txBytes: 60000000, txFrames: 50000, txDrops: 2},
+		{ID: "eth2", Name: "eth2"},
+		{ID: "br0", Name: "br0", rxBytes: 8000000, rxFrames: 60000, txBytes: 70000000, txFrames: 60000},
+		{ID: "wl0", Name: "wl0", rxBytes: 3000000, rxFrames: 30000, rxDrops: 3, txBytes: 4000000, txFrames: 35000, txErrs: 5},
+	},
+	Ports: map[string]EthernetPort{
+		"eth0": {ID: "eth0", State: linkUp, Speed: 2500},
+		"eth1": {ID: "eth1", State: linkUp, Speed: 1000},
+		"eth2": {ID: "eth2", State: linkDown},
+	},
+	GPON: GPONData{Status: 1, RXPower: -19.51, TXPower: 2.10},
+	WifiClients: []WifiClient{
+		{
+			Interface: "wl0", MAC: "3c:22:fb:00:00:09", AssociatedTime: 3600,
+			txFrames: 10000, TXUnicastFrames: 9000, txErrs: 10, TXRetries: 100, TxRetryRate: 1, TXRate: 866.7,
+			RXUnicastFrames: 8000, RXBcastFrames: 200, RXRate: 780,
+			RSSI: -50, Noise: -90, SNR: 40,
+		},
+		{
+			Interface: "wl0", MAC: "da:a1:19:00:00:01", AssociatedTime: 120,
+			txFrames: 500, txErrs: 2, TXRetries: 30, TxRetryRate: 30.0 / 500 * 100, TXRate: 72,
+			RXUnicastFrames: 400, RXBcastFrames: 20, RXRate: 65,
+			RSSI: -70, Noise: -90, SNR: 20,
+		},
+	},
+}
+
+func TestCLITransport(t *testing.T) {
+	telnetAddress := fakeTelnet(t, "admin", "secret")
+	sshAddress, hostKey := fakeSSH(t, "admin", "secret")
+	_, otherKey := fakeSSH(t, "admin", "secret")
+	for _, test := range []struct {
+		name     string
+		config   TransportConfig
+		password string
+		ok       bool
+	}{
+		{"telnet", TransportConfig{Transport: "telnet", CLIAddress: telnetAddress}, "secret", true},
+		{"telnet wrong password", TransportConfig{Transport: "telnet", CLIAddress: telnetAddress}, "wrong", false},
+		{"ssh", TransportConfig{Transport: "ssh", CLIAddress: sshAddress, SSHKnownHosts: knownHostsFile(t, sshAddress, hostKey)}, "secret", true},
+		{"ssh insecure", TransportConfig{Transport: "ssh", CLIAddress: sshAddress, SSHInsecure: true}, "secret", true},
+		{"ssh wrong password", TransportConfig{Transport: "ssh", CLIAddress: sshAddress, SSHInsecure: true}, "wrong", false},
+		{"ssh changed host key", TransportConfig{Transport: "ssh", CLIAddress: sshAddress, SSHKnownHosts: knownHostsFile(t, sshAddress, otherKey)}, "secret", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			exporter := NewZhoneExporter("gateway", "admin", test.password)
+			if err := exporter.SetTransport(test.config); err != nil {
+				t.Fatal(err)
+			}
+			snapshot, err := exporter.Transport.Fetch()
+			if !test.ok {
+				if err == nil {
+					t.Fatal("Fetch succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(snapshot, cliSnapshot) {
+				t.Errorf("Fetch =\n%+v\nwant\n%+v", snapshot, cliSnapshot)
+			}
+		})
+	}
+}
+
+// the SSH transport only accepts any host key when asked to
+func TestSSHTransportHostKey(t *testing.T) {
+	exporter := NewZhoneExporter("gateway", "admin", "secret")
+	if err := exporter.SetTransport(TransportConfig{Transport: "ssh"}); err == nil {
+		t.Error("SetTransport succeeded without a known_hosts file or -ssh-insecure")
+	}
+	if err := exporter.SetTransport(TransportConfig{Transport: "ssh", SSHKnownHosts: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("SetTransport succeeded with a missing known_hosts file")
+	}
+}
+
+func TestParseProcNetDev(t *testing.T) {
+	got := ParseProcNetDev(readOutput(t, "proc_net_dev.txt"))
+	want := []InterfaceData{
+		{ID: "eth0", Name: "eth0", rxBytes: 98765432100, rxFrames: 76543210, rxDrops: 12, txBytes: 12345678900, txFrames: 23456789},
+		{ID: "eth1", Name: "eth1", rxBytes: 5000000, rxFrames: 40000, rxErrs: 1, txBytes: 60000000, txFrames: 50000, txDrops: 2},
+		{ID: "eth2", Name: "eth2"},
+		{ID: "br0", Name: "br0", rxBytes: 8000000, rxFrames: 60000, txBytes: 70000000, txFrames: 60000},
+		{ID: "wl0", Name: "wl0", rxBytes: 3000000, rxFrames: 30000, rxDrops: 3, txBytes: 4000000, txFrames: 35000, txErrs: 5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseProcNetDev =\n%+v\nwant\n%+v", got, want)
+	}
+	if got := ParseProcNetDev("sh: cat: not found\n  eth0: 1 2 3\n"); got != nil {
+		t.Errorf("ParseProcNetDev of unexpected output = %+v, want none", got)
+	}
+}
+
+func TestParseLinkStates(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		want  map[string]EthernetPort
+	}{
+		{
+			input: readOutput(t, "operstate.txt"),
+			want: map[string]EthernetPort{
+				"eth0": {ID: "eth0", State: linkUp, Speed: 2500},
+				"eth1": {ID: "eth1", State: linkUp, Speed: 1000},
+				"eth2": {ID: "eth2", State: linkDown},
+			},
+		},
+		{
+			input: "eth1 lowerlayerdown\neth2 dormant\neth3\n\n",
+			want: map[string]EthernetPort{
+				"eth1": {ID: "eth1", State: linkNoLink},
+				"eth2": {ID: "eth2", State: linkUnknown},
+			},
+		},
+		{
+			input: "",
+			want:  map[string]EthernetPort{},
+		},
+	} {
+		if got := ParseLinkStates(test.input); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseLinkStates(%q) = %+v, want %+v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestParseOpticalLevel(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		want  float64
+		ok    bool
+	}{
+		{readOutput(t, "laser_rxread.txt"), -19.51, true},
+		{readOutput(t, "laser_txread.txt"), 2.10, true},
+		{"Rx Optical Level: -40 dBm\n", -40, true},
+		{"Rx Optical Level: N/A\n", 0, false},
+		{"", 0, false},
+	} {
+		got, err := ParseOpticalLevel(test.input)
+		if (err == nil) != test.ok {
+			t.Errorf("ParseOpticalLevel(%q) error = %v, want ok %v", test.input, err, test.ok)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseOpticalLevel(%q) = %v, want %v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestParseAssocList(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		want  []string
+	}{
+		{readOutput(t, "wlctl_assoclist.txt"), []string{"3c:22:fb:00:00:09", "da:a1:19:00:00:01"}},
+		{"", nil},
+	} {
+		if got := ParseAssocList(test.input); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseAssocList(%q) = %v, want %v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestParseStaInfo(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		want WifiClient
+	}{
+		{
+			name: "wlctl_sta_info_3c22fb000009.txt",
+			want: WifiClient{
+				AssociatedTime: 3600, txFrames: 10000, TXUnicastFrames: 9000, txErrs: 10, TXRetries: 100, TxRetryRate: 1,
+				TXRate: 866.7, RXUnicastFrames: 8000, RXBcastFrames: 200, RXRate: 780,
+			},
+		},
+		{
+			// older drivers print tx pkts without the total, and no unicast transmit counter
+			name: "wlctl_sta_info_daa119000001.txt",
+			want: WifiClient{
+				AssociatedTime: 120, txFrames: 500, txErrs: 2, TXRetries: 30, TxRetryRate: 30.0 / 500 * 100,
+				TXRate: 72, RXUnicastFrames: 400, RXBcastFrames: 20, RXRate: 65,
+			},
+		},
+	} {
+		if got := ParseStaInfo(readOutput(t, test.name)); got != test.want {
+			t.Errorf("ParseStaInfo(%s) =\n%+v\nwant\n%+v", test.name, got, test.want)
+		}
+	}
+	if got := ParseStaInfo("wl: not found"); got != (WifiClient{}) {
+		t.Errorf("ParseStaInfo of unexpected output = %+v, want zero", got)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// gatewayFlags are the flags of the subcommands to reach the gateway
+type gatewayFlags struct {
+	username, password, transport, cliAddress, sshKnownHosts, ouiFile *string
+	sshInsecure                                                       *bool
+}
+
+// addGatewayFlags defines the gateway flags on a subcommand's flag set
+func addGatewayFlags(flags *flag.FlagSet) *gatewayFlags {
+	return &gatewayFlags{
+		username:      flags.String("u", "user", "Username"),
+		password:      flags.String("p", "user", "Password"),
+		transport:     flags.String("transport", "web", "How to retrieve data from the gateway: web, telnet or ssh"),
+		cliAddress:    flags.String("cli-address", "", "Address of the telnet or SSH server, defaults to the gateway on the standard port"),
+		sshKnownHosts: flags.String("ssh-known-hosts", "", "known_hosts file to verify the gateway's SSH host key"),
+		sshInsecure:   flags.Bool("ssh-insecure", false, "Accept any SSH host key when there is no -ssh-known-hosts"),
+		ouiFile:       flags.String("oui-file", "", "IEEE OUI database (oui.csv or oui.txt) to use instead of the embedded copy"),
+	}
+}
+
+// exporter builds the exporter for host as configured by the flags
+func (g *gatewayFlags) exporter(host string) (*ZhoneExporter, error) {
+	exporter := NewZhoneExporter(host, *g.username, *g.password)
+	if err := exporter.SetTransport(g.transportConfig()); err != nil {
+		return nil, err
+	}
+	if *g.ouiFile != "" {
+		oui, err := LoadOUIDatabase(*g.ouiFile)
+		if err != nil {
+			return nil, err
+		}
+		exporter.OUI = oui
+	}
+	return exporter, nil
+}
+
+// transportConfig returns the transport selected by the flags
+func (g *gatewayFlags) transportConfig() TransportConfig {
+	return TransportConfig{Transport: *g.transport, CLIAddress: *g.cliAddress, SSHKnownHosts: *g.sshKnownHosts, SSHInsecure: *g.sshInsecure}
+}
+
+// newSubcommand builds the flag set of a subcommand taking the gateway as its argument
+func newSubcommand(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [FLAGS...] HOSTNAME_TO_QUERY\n", os.Args[0], name)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// runScrape implements the scrape subcommand, printing the metrics of a single collection in the text exposition format
+func runScrape(args []string) int {
+	flags := newSubcommand("scrape")
+	gateway := addGatewayFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	exporter, err := gateway.exporter(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	failed := false
+	exporter.SubscribeFailures(func(error) {
+		failed = true
+	})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter)
+	families, err := registry.Gather()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(os.Stdout, family); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// statusReport is the JSON representation of the status subcommand's output
+type statusReport struct {
+	Target      string          `json:"target"`
+	Timestamp   time.Time       `json:"timestamp"`
+	Interfaces  []apiInterface  `json:"interfaces"`
+	GPON        apiGPON         `json:"gpon"`
+	WifiClients []apiWifiClient `json:"wifi_clients"`
+}
+
+// runStatus implements the status subcommand, printing the interfaces, GPON link and wifi clients as tables or JSON
+func runStatus(args []string) int {
+	flags := newSubcommand("status")
+	gateway := addGatewayFlags(flags)
+	asJSON := flags.Bool("json", false, "Print the status as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	exporter, err := gateway.exporter(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	snapshot, err := exporter.Scrape()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to collect from %s: %v\n", exporter.URL, err)
+		return 1
+	}
+	report := statusReport{
+		Target:      exporter.URL,
+		Timestamp:   snapshot.Time,
+		Interfaces:  apiInterfaces(snapshot),
+		GPON:        newAPIGPON(snapshot.GPON),
+		WifiClients: apiWifiClients(exporter, snapshot),
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	printStatus(os.Stdout, report)
+	return 0
+}
+
+// printStatus renders a status report as aligned tables
+func printStatus(out io.Writer, report statusReport) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Gateway %s at %s\n\n", report.Target, report.Timestamp.Format(time.RFC3339))
+
+	gpon := report.GPON
+	fmt.Fprintln(w, "LINK\tSTATUS\tRX POWER\tTX POWER\tTRANSITIONS")
+	fmt.Fprintf(w, "GPON\t%s\t%.2f dBm\t%.2f dBm\t%.0f\n", linkState(gpon.Status), gpon.RXPower, gpon.TXPower, gpon.Transitions)
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "INTERFACE\tNAME\tSTATUS\tSPEED\tRX BYTES\tTX BYTES\tRX FRAMES\tTX FRAMES\tDROPS\tERRORS")
+	for _, Interface := range report.Interfaces {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.0f\t%.0f\t%.0f\t%.0f\t%.0f\t%.0f\t%.0f\n",
+			Interface.ID, Interface.Name, linkState(Interface.Status), Interface.Speed,
+			Interface.RXBytes, Interface.TXBytes, Interface.RXFrames, Interface.TXFrames,
+			Interface.RXDrops+Interface.TXDrops, Interface.RXErrors+Interface.TXErrors)
+	}
+	fmt.Fprintln(w)
+
+	clients := report.WifiClients
+	sort.SliceStable(clients, func(i, j int) bool {
+		if clients[i].Interface != clients[j].Interface {
+			return clients[i].Interface < clients[j].Interface
+		}
+		return clients[i].RSSI > clients[j].RSSI
+	})
+	fmt.Fprintln(w, "RADIO\tMAC\tVENDOR\tRSSI\tSNR\tQUALITY\tTX RATE\tRX RATE\tASSOCIATED")
+	for _, client := range clients {
+		vendor := client.Vendor
+		if client.Randomized {
+			vendor = "(randomized)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.0f dBm\t%.0f dB\t%.0f%%\t%.0f\t%.0f\t%s\n",
+			client.Interface, client.MAC, vendor, client.RSSI, client.SNR, client.Quality,
+			client.TXRate, client.RXRate, time.Duration(client.AssociatedTime)*time.Second)
+	}
+	if len(clients) == 0 {
+		fmt.Fprintln(w, "(no clients)")
+	}
+	w.Flush()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPrintStatus(t *testing.T) {
+	report := statusReport{
+		Target:    "192.168.1.1",
+		Timestamp: time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		Interfaces: []apiInterface{
+			{ID: "eth0", Name: "GPON", Status: 1, Speed: 2500, RXBytes: 98765432100, TXBytes: 1234, RXFrames: 10, TXFrames: 20, RXDrops: 1, TXDrops: 2, RXErrors: 3, TXErrors: 4},
+			{ID: "eth1", Name: "LAN1"},
+		},
+		GPON: apiGPON{Status: 1, RXPower: -19.51, TXPower: 2.1, Transitions: 3},
+		WifiClients: []apiWifiClient{
+			{Interface: "wl1", MAC: "3c:22:fb:00:00:09", Vendor: "Apple, Inc.", RSSI: -70, SNR: 20, Quality: 60, TXRate: 144, RXRate: 130, AssociatedTime: 3700},
+			{Interface: "wl0", MAC: "da:a1:19:00:00:01", Randomized: true, RSSI: -60, SNR: 30, Quality: 80, TXRate: 866, RXRate: 780, AssociatedTime: 65},
+			{Interface: "wl0", MAC: "00:a0:c8:00:00:02", Vendor: "Zhone Technologies", RSSI: -40, SNR: 50, Quality: 100, TXRate: 1200, RXRate: 1100, AssociatedTime: 5},
+		},
+	}
+	// the clients are grouped by radio, strongest first
+	want := `Gateway 192.168.1.1 at 2024-03-01T12:30:00Z
+
+LINK  STATUS  RX POWER    TX POWER  TRANSITIONS
+GPON  up      -19.51 dBm  2.10 dBm  3
+
+INTERFACE  NAME  STATUS  SPEED  RX BYTES     TX BYTES  RX FRAMES  TX FRAMES  DROPS  ERRORS
+eth0       GPON  up      2500   98765432100  1234      10         20         3      7
+eth1       LAN1  down    0      0            0         0          0          0      0
+
+RADIO  MAC                VENDOR              RSSI     SNR    QUALITY  TX RATE  RX RATE  ASSOCIATED
+wl0    00:a0:c8:00:00:02  Zhone Technologies  -40 dBm  50 dB  100%     1200     1100     5s
+wl0    da:a1:19:00:00:01  (randomized)        -60 dBm  30 dB  80%      866      780      1m5s
+wl1    3c:22:fb:00:00:09  Apple, Inc.         -70 dBm  20 dB  60%      144      130      1h1m40s
+`
+	var out bytes.Buffer
+	printStatus(&out, report)
+	if out.String() != want {
+		t.Errorf("printStatus printed\n%s\nwant\n%s", out.String(), want)
+	}
+
+	report.WifiClients = nil
+	out.Reset()
+	printStatus(&out, report)
+	if !bytes.HasSuffix(out.Bytes(), []byte("ASSOCIATED\n(no clients)\n")) {
+		t.Errorf("printStatus without clients printed\n%s", out.String())
+	}
+}
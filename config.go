@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds the settings that can be changed without a restart, read from -config-file on top of the flags
+type Config struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// EventOpticalThreshold is the change in dB of the GPON receive or transmit power reported as an event
+	EventOpticalThreshold float64      `yaml:"event_optical_threshold"`
+	Notify                NotifyConfig `yaml:"notify"`
+	// Modules are the named ways of reaching gateways the targets refer to
+	Modules map[string]ModuleConfig `yaml:"modules"`
+	// Targets are gateways collected alongside the one given on the command line
+	Targets []TargetConfig `yaml:"targets"`
+}
+
+// defaultModule is the module of the transport flags and the top level credentials
+const defaultModule = "default"
+
+// ModuleConfig is the transport and credentials shared by a group of gateways
+type ModuleConfig struct {
+	TransportConfig `yaml:",inline"`
+	// Username and Password default to the top level credentials
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// TargetConfig is a gateway to collect
+type TargetConfig struct {
+	Address string `yaml:"address"`
+	// Alias is the instance label of the gateway's metrics, its address if empty
+	Alias string `yaml:"alias"`
+	// Module is how the gateway is reached, the default module if empty
+	Module string `yaml:"module"`
+}
+
+// instance returns the instance label of the target
+func (t TargetConfig) instance() string {
+	if t.Alias != "" {
+		return t.Alias
+	}
+	return t.Address
+}
+
+// NotifyConfig holds the notification rules and limits
+type NotifyConfig struct {
+	GPONRXBelow    float64       `yaml:"gpon_rx_below"`
+	InterfacesDown []string      `yaml:"interfaces_down"`
+	RSSIBelow      float64       `yaml:"rssi_below"`
+	DownScrapes    int           `yaml:"down_scrapes"`
+	RepeatInterval time.Duration `yaml:"repeat_interval"`
+	MaxPerHour     int           `yaml:"max_per_hour"`
+}
+
+// rules returns the notification rules of the configuration
+func (c NotifyConfig) rules() NotifyRules {
+	return NotifyRules{
+		GPONRXPowerBelow: c.GPONRXBelow,
+		InterfacesDown:   c.InterfacesDown,
+		WifiRSSIBelow:    c.RSSIBelow,
+		DownScrapes:      c.DownScrapes,
+	}
+}
+
+// validate rejects a configuration the exporter can't run with
+func (c Config) validate() error {
+	switch {
+	case c.Username == "":
+		return fmt.Errorf("username is empty")
+	case c.EventOpticalThreshold <= 0:
+		return fmt.Errorf("event_optical_threshold must be positive, got %g", c.EventOpticalThreshold)
+	case c.Notify.DownScrapes < 0:
+		return fmt.Errorf("notify down_scrapes can't be negative, got %d", c.Notify.DownScrapes)
+	case c.Notify.RepeatInterval <= 0:
+		return fmt.Errorf("notify repeat_interval must be positive, got %s", c.Notify.RepeatInterval)
+	case c.Notify.MaxPerHour < 0:
+		return fmt.Errorf("notify max_per_hour can't be negative, got %d", c.Notify.MaxPerHour)
+	}
+	for _, id := range c.Notify.InterfacesDown {
+		if strings.TrimSpace(id) == "" {
+			return fmt.Errorf("notify interfaces_down lists an empty interface")
+		}
+	}
+	for name, module := range c.Modules {
+		switch {
+		case name == defaultModule:
+			return fmt.Errorf("module %s is given by the transport flags and can't be redefined", name)
+		case module.Transport != "web" && module.Transport != "telnet" && module.Transport != "ssh":
+			return fmt.Errorf("module %s: transport must be web, telnet or ssh, got %q", name, module.Transport)
+		case module.Transport == "ssh" && module.SSHKnownHosts == "" && !module.SSHInsecure:
+			return fmt.Errorf("module %s: the ssh transport needs ssh_known_hosts, or ssh_insecure to accept any host key", name)
+		}
+	}
+	instances := make(map[string]bool)
+	for _, target := range c.Targets {
+		if target.Address == "" {
+			return fmt.Errorf("a target has no address")
+		}
+		if _, ok := c.Modules[target.Module]; !ok && target.Module != "" && target.Module != defaultModule {
+			return fmt.Errorf("target %s: unknown module %q", target.instance(), target.Module)
+		}
+		if instances[target.instance()] {
+			return fmt.Errorf("target %s is listed twice, give the targets distinct aliases", target.instance())
+		}
+		instances[target.instance()] = true
+	}
+	return nil
+}
+
+// LoadConfig reads the configuration file at path over defaults, a setting missing from the file keeping its default.
+// Without a path, defaults is the configuration
+func LoadConfig(path string, defaults Config) (Config, error) {
+	config := defaults
+	// the slice is shared with defaults, a file listing interfaces replaces it
+	config.Notify.InterfacesDown = append([]string(nil), defaults.Notify.InterfacesDown...)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return defaults, err
+		}
+		if err := yaml.UnmarshalStrict(data, &config); err != nil {
+			return defaults, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+	if err := config.validate(); err != nil {
+		if path == "" {
+			return defaults, fmt.Errorf("invalid configuration: %w", err)
+		}
+		return defaults, fmt.Errorf("invalid configuration %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// Reloader applies the configuration file to the running exporter, on SIGHUP or a POST to /-/reload
+type Reloader struct {
+	path     string
+	defaults Config
+	// the components are nil when they aren't enabled
+	exporter *ZhoneExporter
+	targets  *TargetSet
+	events   *EventStream
+	notifier *Notifier
+
+	mu sync.Mutex
+}
+
+// NewReloader reloads path over the configuration given by the flags, defaults
+func NewReloader(path string, defaults Config, exporter *ZhoneExporter, targets *TargetSet, events *EventStream, notifier *Notifier) *Reloader {
+	return &Reloader{path: path, defaults: defaults, exporter: exporter, targets: targets, events: events, notifier: notifier}
+}
+
+// Reload reads and validates the configuration file, then applies it as a whole. The running configuration is kept when it is invalid
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	config, err := LoadConfig(r.path, r.defaults)
+	// the targets are built first, as they may still fail, e.g. on an unreadable known_hosts file
+	if err == nil && r.targets != nil {
+		err = r.targets.Configure(config)
+	}
+	observeReload(err)
+	if err != nil {
+		return err
+	}
+	if r.exporter != nil {
+		r.exporter.SetCredentials(config.Username, config.Password)
+	}
+	if r.events != nil {
+		r.events.SetOpticalThreshold(config.EventOpticalThreshold)
+	}
+	if r.notifier != nil {
+		r.notifier.Configure(config.Notify.rules(), config.Notify.RepeatInterval, config.Notify.MaxPerHour)
+	}
+	if r.path == "" {
+		log.Printf("No -config-file to reload, the flags still apply")
+	} else {
+		log.Printf("Reloaded the configuration from %s", r.path)
+	}
+	return nil
+}
+
+// ServeHTTP reloads the configuration on a POST, answering with the reason it was rejected
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST requests reload the configuration.", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.Reload(); err != nil {
+		log.Printf("Unable to reload the configuration: %v", err)
+		http.Error(w, fmt.Sprintf("Unable to reload the configuration: %v", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "Configuration reloaded.")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// defaultModel is the model the exporter was written for, used when the gateway doesn't report one
+const defaultModel = "ZNID-GPON-2726A1-UK"
+
+// DeviceInfo identifies the gateway
+type DeviceInfo struct {
+	Manufacturer    string
+	Model           string
+	SerialNumber    string
+	HardwareVersion string
+	SoftwareVersion string
+}
+
+// ParseDeviceInfo reads the model, serial number and versions from the device information page
+func ParseDeviceInfo(data *goquery.Document) DeviceInfo {
+	device := DeviceInfo{Manufacturer: "Zhone", Model: defaultModel}
+	for label, value := range labelValues(data) {
+		if value == "" {
+			continue
+		}
+		label = strings.ToLower(label)
+		switch {
+		case strings.Contains(label, "serial"):
+			device.SerialNumber = value
+		case strings.Contains(label, "model"), label == "board id", label == "product name":
+			device.Model = value
+		case strings.Contains(label, "hardware version"):
+			device.HardwareVersion = value
+		case strings.Contains(label, "software version"), strings.Contains(label, "firmware version"):
+			device.SoftwareVersion = value
+		}
+	}
+	return device
+}
+
+// FetchDeviceInfo executes the web scrape of the device information page
+func (e *ZhoneExporter) FetchDeviceInfo() (DeviceInfo, error) {
+	infodata, err := e.fetchPage("info.html", nil)
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+	return ParseDeviceInfo(infodata), nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// doctorReport prints the outcome of the doctor checks to out as they complete
+type doctorReport struct {
+	out                      io.Writer
+	passed, warnings, failed int
+}
+
+// result prints the outcome of a check, followed by a hint on what to do about it
+func (r *doctorReport) result(status string, name string, detail string, hint string) {
+	switch status {
+	case "PASS":
+		r.passed++
+	case "WARN":
+		r.warnings++
+	case "FAIL":
+		r.failed++
+	}
+	fmt.Fprintf(r.out, "%-4s  %-22s  %s\n", status, name, detail)
+	if hint != "" {
+		fmt.Fprintf(r.out, "%-4s  %-22s  hint: %s\n", "", "", hint)
+	}
+}
+
+// doctor diagnoses why the exporter can't collect from a gateway
+type doctor struct {
+	exporter *ZhoneExporter
+	client   *http.Client
+	report   *doctorReport
+}
+
+// get fetches a page of the web interface, with or without the credentials
+func (d *doctor) get(path string, query url.Values, credentials bool) (*http.Response, error) {
+	u := url.URL{Scheme: "http", Host: d.exporter.URL, Path: path, RawQuery: query.Encode()}
+	if credentials {
+		u.User = url.UserPassword(d.exporter.Credentials())
+	}
+	return d.client.Get(u.String())
+}
+
+// page fetches and parses a page of the web interface, reporting a failure under name
+func (d *doctor) page(name string, path string, query url.Values) *goquery.Document {
+	res, err := d.get(path, query, true)
+	if err != nil {
+		d.report.result("FAIL", name, err.Error(), "the gateway stopped answering, it may be overloaded or rebooting")
+		return nil
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		d.report.result("FAIL", name, res.Status, "the page doesn't exist on this model or firmware, the telnet or ssh transport may work instead")
+		return nil
+	case res.StatusCode != http.StatusOK:
+		d.report.result("FAIL", name, res.Status, "")
+		return nil
+	}
+	doc, err := goquery.NewDocumentFromReader(res.Body)
+	if err != nil {
+		d.report.result("FAIL", name, err.Error(), "")
+		return nil
+	}
+	return doc
+}
+
+// connectivity resolves the gateway and connects to address, reporting whether the later checks can proceed
+func (d *doctor) connectivity(host string, address string, timeout time.Duration) bool {
+	if net.ParseIP(host) != nil {
+		d.report.result("PASS", "address", host+" is an IP address", "")
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		cancel()
+		if err != nil {
+			d.report.result("FAIL", "address", err.Error(), "check the hostname, or use the gateway's IP address, usually 192.168.1.1")
+			return false
+		}
+		d.report.result("PASS", "address", fmt.Sprintf("%s resolves to %v", host, addrs), "")
+	}
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		d.report.result("FAIL", "connect", err.Error(), "check that this host is on the gateway's LAN and that nothing filters the port")
+		return false
+	}
+	conn.Close()
+	d.report.result("PASS", "connect", fmt.Sprintf("connected to %s in %s", address, time.Since(start).Round(time.Millisecond)), "")
+	return true
+}
+
+// web checks the credentials and every page the web transport uses
+func (d *doctor) web() {
+	res, err := d.get("statsifc.html", nil, false)
+	if err != nil {
+		d.report.result("FAIL", "http", err.Error(), "the port accepts connections but doesn't answer HTTP, check the address")
+		return
+	}
+	res.Body.Close()
+	anonymous := res.StatusCode
+	res, err = d.get("statsifc.html", nil, true)
+	if err != nil {
+		d.report.result("FAIL", "http", err.Error(), "")
+		return
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusUnauthorized:
+		d.report.result("FAIL", "auth", "credentials rejected: "+res.Status, "check -u and -p, the defaults are those of the user account printed on the gateway's label")
+		return
+	case anonymous == http.StatusUnauthorized:
+		d.report.result("PASS", "auth", "credentials accepted", "")
+	default:
+		d.report.result("WARN", "auth", fmt.Sprintf("the gateway doesn't request credentials, HTTP %d without them", anonymous), "it may not be a Zhone gateway, or its web interface is open to anyone on the LAN")
+	}
+
+	// the model is informational, collection works without the device information page
+	if res, err := d.get("info.html", nil, true); err != nil || res.StatusCode != http.StatusOK {
+		detail := "device information page unavailable"
+		if err == nil {
+			res.Body.Close()
+			detail += ": " + res.Status
+		}
+		d.report.result("WARN", "model", detail, "the model can't be verified, the exporter was written for the "+defaultModel)
+	} else {
+		doc, err := goquery.NewDocumentFromReader(res.Body)
+		res.Body.Close()
+		if err != nil {
+			d.report.result("WARN", "model", err.Error(), "")
+		} else if device := ParseDeviceInfo(doc); device.Model != defaultModel {
+			d.report.result("WARN", "model", fmt.Sprintf("%s (software %s)", device.Model, device.SoftwareVersion), "the exporter was written for the "+defaultModel+", pages of other models may not parse")
+		} else {
+			d.report.result("PASS", "model", fmt.Sprintf("%s (software %s)", device.Model, device.SoftwareVersion), "")
+		}
+	}
+
+	stats := d.page("statsifc.html", "statsifc.html", nil)
+	status := d.page("zhnethernetstatus.html", "zhnethernetstatus.html", nil)
+	var interfaces []InterfaceData
+	if stats != nil && status != nil {
+		var ports map[string]EthernetPort
+		if err := parse("ParseEthernetStatus", func() { ports = ParseEthernetStatus(status) }); err != nil {
+			d.report.result("FAIL", "zhnethernetstatus.html", err.Error(), "")
+		} else if len(ports) == 0 {
+			d.report.result("WARN", "zhnethernetstatus.html", "no ethernet ports found", "the ethernet port metrics will be missing")
+		} else {
+			d.report.result("PASS", "zhnethernetstatus.html", fmt.Sprintf("%d ethernet ports", len(ports)), "")
+		}
+		if err := parse("ParseInterfaceData", func() { interfaces = ParseInterfaceData(stats, status) }); err != nil {
+			d.report.result("FAIL", "statsifc.html", err.Error(), "")
+		} else if len(interfaces) == 0 {
+			d.report.result("FAIL", "statsifc.html", "no interfaces found", "the page layout differs from the supported model")
+		} else {
+			d.report.result("PASS", "statsifc.html", fmt.Sprintf("%d interfaces", len(interfaces)), "")
+		}
+	}
+
+	if doc := d.page("zhngponstatus.html", "zhngponstatus.html", nil); doc != nil {
+		var gpon GPONData
+		if err := parse("ParseGPONData", func() { gpon = ParseGPONData(doc) }); err != nil {
+			d.report.result("FAIL", "zhngponstatus.html", err.Error(), "")
+		} else if gpon.Status == 0 && gpon.RXPower == 0 && gpon.TXPower == 0 {
+			d.report.result("FAIL", "zhngponstatus.html", "no GPON status or optical levels found", "the page layout differs from the supported model")
+		} else {
+			d.report.result("PASS", "zhngponstatus.html", fmt.Sprintf("link %s, RX %.2f dBm, TX %.2f dBm", linkState(gpon.Status), gpon.RXPower, gpon.TXPower), "")
+		}
+	}
+
+	if stats == nil || status == nil {
+		d.report.result("SKIP", "wifi", "the radios are listed on statsifc.html", "")
+		return
+	}
+	radios := wlanRadios(interfaces)
+	if len(radios) == 0 {
+		d.report.result("WARN", "wifi", "no radios found among the interfaces", "the wifi client metrics will be missing")
+		return
+	}
+	for _, radio := range radios {
+		query := url.Values{}
+		query.Set("curRadio", radio)
+		name := "wifi radio " + radio
+		statusPage := d.page(name, "zhnwlstatus.cmd", query)
+		query.Set("action", "view")
+		infoPage := d.page(name, "zhnwlinfo.cmd", query)
+		if statusPage == nil || infoPage == nil {
+			continue
+		}
+		var clients []WifiClient
+		err := parse("ParseWirelessData", func() {
+			clients = ParseWirelessData([2]map[string]*goquery.Document{{radio: statusPage}, {radio: infoPage}})
+		})
+		if err != nil {
+			d.report.result("FAIL", name, err.Error(), "")
+			continue
+		}
+		d.report.result("PASS", name, fmt.Sprintf("%d clients", len(clients)), "")
+	}
+}
+
+// cli checks that the telnet or SSH transport logs in and collects
+func (d *doctor) cli() {
+	snapshot, err := d.exporter.Scrape()
+	if err != nil {
+		d.report.result("FAIL", "login", err.Error(), "check -u and -p, and -ssh-known-hosts if the host key changed")
+		return
+	}
+	d.report.result("PASS", "login", "logged in and ran the commands", "")
+	if len(snapshot.Interfaces) == 0 {
+		d.report.result("FAIL", "interfaces", "no interfaces found", "the command output differs from the supported model")
+	} else {
+		d.report.result("PASS", "interfaces", fmt.Sprintf("%d interfaces", len(snapshot.Interfaces)), "")
+	}
+	gpon := snapshot.GPON
+	d.report.result("PASS", "gpon", fmt.Sprintf("link %s, RX %.2f dBm, TX %.2f dBm", linkState(gpon.Status), gpon.RXPower, gpon.TXPower), "")
+}
+
+// runDoctor implements the doctor subcommand, checking connectivity, credentials and parsing step by step
+func runDoctor(args []string) int {
+	flags := newSubcommand("doctor")
+	gateway := addGatewayFlags(flags)
+	timeout := flags.Duration("timeout", 10*time.Second, "Time allowed for each check")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	exporter, err := gateway.exporter(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	report := &doctorReport{out: os.Stdout}
+	d := &doctor{exporter: exporter, client: &http.Client{Timeout: *timeout}, report: report}
+	fmt.Printf("Diagnosing %s with the %s transport\n\n", exporter.URL, *gateway.transport)
+
+	host, port, err := net.SplitHostPort(exporter.URL)
+	if err != nil {
+		host, port = exporter.URL, "80"
+	}
+	address := net.JoinHostPort(host, port)
+	if *gateway.transport != "web" {
+		address = cliHostPort(exporter.URL, *gateway.cliAddress, map[string]string{"telnet": "23", "ssh": "22"}[*gateway.transport])
+	}
+	if d.connectivity(host, address, *timeout) {
+		if *gateway.transport == "web" {
+			d.web()
+		} else {
+			d.cli()
+		}
+		if *gateway.transport == "ssh" && *gateway.sshKnownHosts == "" {
+			d.report.result("WARN", "host key", "any SSH host key is accepted", "pass -ssh-known-hosts so a gateway impersonating this one is refused")
+		}
+	}
+
+	fmt.Printf("\n%d passed, %d warnings, %d failed\n", report.passed, report.warnings, report.failed)
+	if report.failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// doctorGateway serves captured pages like testGateway, asking for the credentials user/user when protected
+func doctorGateway(t *testing.T, pages map[string]string, protected bool) *ZhoneExporter {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); protected && (!ok || user != "user" || pass != "user") {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Broadband Router"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		file, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join("testdata", file))
+	}))
+	t.Cleanup(server.Close)
+	return NewZhoneExporter(strings.TrimPrefix(server.URL, "http://"), "user", "user")
+}
+
+// withPages returns scrapePages with the device information page, changed by the given paths, an empty file removing a page
+func withPages(changes map[string]string) map[string]string {
+	pages := map[string]string{"/info.html": "info.html"}
+	for path, file := range scrapePages {
+		pages[path] = file
+	}
+	for path, file := range changes {
+		if file == "" {
+			delete(pages, path)
+		} else {
+			pages[path] = file
+		}
+	}
+	return pages
+}
+
+// checkDoctorReport checks that the report has a line for each of want, given as status and check name
+func checkDoctorReport(t *testing.T, report string, want []string) {
+	t.Helper()
+	for _, result := range want {
+		fields := strings.SplitN(result, " ", 2)
+		if line := fmt.Sprintf("%-4s  %-22s  ", fields[0], fields[1]); !strings.Contains("\n"+report, "\n"+line) {
+			t.Errorf("no %q in the report:\n%s", result, report)
+		}
+	}
+}
+
+func TestDoctorWeb(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		pages     map[string]string
+		protected bool
+		password  string
+		// want are the lines expected in the report, as status and check name
+		want             []string
+		warnings, failed int
+	}{
+		{
+			name:      "healthy gateway",
+			pages:     withPages(nil),
+			protected: true,
+			want:      []string{"PASS auth", "PASS model", "PASS zhnethernetstatus.html", "PASS statsifc.html", "PASS zhngponstatus.html", "PASS wifi radio 0"},
+		},
+		{
+			name:      "wrong password",
+			pages:     withPages(nil),
+			protected: true,
+			password:  "admin",
+			want:      []string{"FAIL auth"},
+			failed:    1,
+		},
+		{
+			name:     "credentials not requested",
+			pages:    withPages(nil),
+			want:     []string{"WARN auth", "PASS statsifc.html"},
+			warnings: 1,
+		},
+		{
+			name:      "missing pages",
+			pages:     withPages(map[string]string{"/info.html": "", "/zhngponstatus.html": ""}),
+			protected: true,
+			want:      []string{"PASS auth", "WARN model", "FAIL zhngponstatus.html", "PASS statsifc.html"},
+			warnings:  1,
+			failed:    1,
+		},
+		{
+			name:      "unexpected page",
+			pages:     withPages(map[string]string{"/zhngponstatus.html": "info.html"}),
+			protected: true,
+			want:      []string{"PASS auth", "FAIL zhngponstatus.html"},
+			failed:    1,
+		},
+		{
+			name:      "without the ethernet status page",
+			pages:     withPages(map[string]string{"/zhnethernetstatus.html": ""}),
+			protected: true,
+			want:      []string{"FAIL zhnethernetstatus.html", "SKIP wifi"},
+			failed:    1,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			exporter := doctorGateway(t, test.pages, test.protected)
+			if test.password != "" {
+				exporter.SetCredentials("user", test.password)
+			}
+			var out bytes.Buffer
+			report := &doctorReport{out: &out}
+			d := &doctor{exporter: exporter, client: &http.Client{Timeout: 5 * time.Second}, report: report}
+			d.web()
+			checkDoctorReport(t, out.String(), test.want)
+			if report.warnings != test.warnings || report.failed != test.failed {
+				t.Errorf("%d warnings and %d failures, want %d and %d:\n%s", report.warnings, report.failed, test.warnings, test.failed, out.String())
+			}
+			if test.password != "" && report.passed != 0 {
+				t.Errorf("checks went on after the credentials were rejected:\n%s", out.String())
+			}
+		})
+	}
+}
+
+func TestDoctorCLI(t *testing.T) {
+	address := fakeTelnet(t, "admin", "secret")
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	for _, test := range []struct {
+		name     string
+		address  string
+		password string
+		want     []string
+		failed   int
+	}{
+		{"telnet", address, "secret", []string{"PASS address", "PASS connect", "PASS login", "PASS interfaces", "PASS gpon"}, 0},
+		{"wrong password", address, "wrong", []string{"PASS connect", "FAIL login"}, 1},
+		{"closed port", closed.Addr().String(), "secret", []string{"PASS address", "FAIL connect"}, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			exporter := NewZhoneExporter("127.0.0.1", "admin", test.password)
+			if err := exporter.SetTransport(TransportConfig{Transport: "telnet", CLIAddress: test.address}); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			report := &doctorReport{out: &out}
+			d := &doctor{exporter: exporter, client: &http.Client{Timeout: 5 * time.Second}, report: report}
+			if d.connectivity("127.0.0.1", test.address, 5*time.Second) {
+				d.cli()
+			}
+			checkDoctorReport(t, out.String(), test.want)
+			if report.failed != test.failed {
+				t.Errorf("%d failures, want %d:\n%s", report.failed, test.failed, out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Link states reported for the ethernet ports
+const (
+	linkUp       = "up"
+	linkDown     = "down"
+	linkDisabled = "disabled"
+	linkNoLink   = "no_link"
+	linkUnknown  = "unknown"
+)
+
+var linkStates = []string{linkUp, linkDown, linkDisabled, linkNoLink, linkUnknown}
+
+// EthernetPort contains everything the ethernet status page reports for a single port
+type EthernetPort struct {
+	ID    string
+	State string
+	// Speed is the negotiated speed in Mbit/s, 0 when there is no link
+	Speed           float64
+	Duplex          string
+	AutoNegotiation string
+	Media           string
+	Role            string
+}
+
+var (
+	ethernetLinkState = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "ethernet", "link_state"), "Ethernet port link state, one series per possible state.", []string{
+			"instance",
+			"interface",
+			"state",
+		}, nil)
+	ethernetSpeed = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "ethernet", "speed_bits_per_second"), "Ethernet port negotiated speed, only present while the port has a link.", []string{
+			"instance",
+			"interface",
+		}, nil)
+	ethernetInfo = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "ethernet", "port_info"), "Ethernet port duplex, autonegotiation, media and role.", []string{
+			"instance",
+			"interface",
+			"duplex",
+			"autonegotiation",
+			"media",
+			"role",
+		}, nil)
+)
+
+// set assigns a value from row index of the portlistAll variable. Rows are recognised by their label,
+// falling back on the position of the link state and speed rows for firmware with unexpected labels
+func (p *EthernetPort) set(index int, label string, value string) {
+	if value == "-" {
+		value = ""
+	}
+	label = strings.ToLower(label)
+	switch {
+	case strings.Contains(label, "duplex"):
+		p.Duplex = strings.ToLower(value)
+	case strings.Contains(label, "auto") || strings.Contains(label, "negotiat"):
+		p.AutoNegotiation = strings.ToLower(value)
+	case strings.Contains(label, "media"):
+		p.Media = value
+	case strings.Contains(label, "role") || strings.Contains(label, "mode"):
+		p.Role = strings.ToUpper(value)
+	case strings.Contains(label, "speed") || strings.Contains(label, "rate"):
+		p.Speed, _ = strconv.ParseFloat(value, 64)
+	case strings.Contains(label, "stat") || strings.Contains(label, "link"):
+		p.State = normalizeLinkState(value)
+	case index == 0:
+		p.State = normalizeLinkState(value)
+	case index == 1:
+		p.Speed, _ = strconv.ParseFloat(value, 64)
+	}
+}
+
+// normalizeLinkState maps the link state shown by the gateway, or the operstate of the CLI, onto one of linkStates
+func normalizeLinkState(value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch strings.Replace(value, " ", "", -1) {
+	case "up":
+		return linkUp
+	case "down":
+		return linkDown
+	case "disabled":
+		return linkDisabled
+	case "", "nolink", "lowerlayerdown":
+		return linkNoLink
+	}
+	return linkUnknown
+}
+
+// Status returns the port status as the 0/1 value used for cpe_if_status
+func (p EthernetPort) Status() float64 {
+	if p.State == linkUp {
+		return 1
+	}
+	return 0
+}
+
+// collectEthernet exports the link state as a state set, alongside the remaining port details
+func (e *ZhoneExporter) collectEthernet(ch chan<- prometheus.Metric, ports map[string]EthernetPort) {
+	for _, port := range ports {
+		for _, state := range linkStates {
+			value := float64(0)
+			if port.State == state {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(
+				ethernetLinkState, prometheus.GaugeValue, value, e.Instance, port.ID, state,
+			)
+		}
+		if port.Speed > 0 {
+			ch <- prometheus.MustNewConstMetric(
+				ethernetSpeed, prometheus.GaugeValue, port.Speed*1e6, e.Instance, port.ID,
+			)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			ethernetInfo, prometheus.GaugeValue, 1, e.Instance, port.ID, port.Duplex, port.AutoNegotiation, port.Media, port.Role,
+		)
+	}
+}
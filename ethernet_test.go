@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestNormalizeLinkState(t *testing.T) {
+	for input, want := range map[string]string{
+		"Up":             linkUp,
+		" up ":           linkUp,
+		"Down":           linkDown,
+		"Disabled":       linkDisabled,
+		"No Link":        linkNoLink,
+		"":               linkNoLink,
+		"lowerlayerdown": linkNoLink,
+		"LowerLayerDown": linkNoLink,
+		"Testing":        linkUnknown,
+		"dormant":        linkUnknown,
+	} {
+		if got := normalizeLinkState(input); got != want {
+			t.Errorf("normalizeLinkState(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestParseEthernetStatus(t *testing.T) {
+	got := ParseEthernetStatus(readPage(t, "zhnethernetstatus.html"))
+	want := map[string]EthernetPort{
+		"eth1": {ID: "eth1", State: linkUp, Speed: 1000, Duplex: "full", AutoNegotiation: "enabled", Media: "Copper", Role: "LAN"},
+		"eth2": {ID: "eth2", State: linkNoLink, AutoNegotiation: "enabled", Media: "Copper", Role: "LAN"},
+		"eth3": {ID: "eth3", State: linkDisabled, AutoNegotiation: "enabled", Media: "Copper", Role: "LAN"},
+		"eth4": {ID: "eth4", State: linkUnknown, Speed: 100, Duplex: "half", AutoNegotiation: "disabled", Media: "Copper", Role: "WAN"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseEthernetStatus =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+// every port has exactly one of the link states set, whatever the gateway reported
+func TestCollectEthernetStateSet(t *testing.T) {
+	exporter := NewZhoneExporter("gateway", "user", "user")
+	ports := ParseEthernetStatus(readPage(t, "zhnethernetstatus.html"))
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) { exporter.collectEthernet(ch, ports) }))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "cpe_ethernet_link_state" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			set[label(metric, "interface")] += metric.GetGauge().GetValue()
+		}
+	}
+	want := map[string]float64{"eth1": 1, "eth2": 1, "eth3": 1, "eth4": 1}
+	if !reflect.DeepEqual(set, want) {
+		t.Errorf("link states set per port = %v, want %v", set, want)
+	}
+}
+
+// label returns the value of the named label of a gathered metric
+func label(metric *dto.Metric, name string) string {
+	for _, pair := range metric.GetLabel() {
+		if pair.GetName() == name {
+			return pair.GetValue()
+		}
+	}
+	return ""
+}
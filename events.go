@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types emitted when consecutive snapshots differ
+const (
+	EventWifiClientJoined    = "wifi_client_joined"
+	EventWifiClientLeft      = "wifi_client_left"
+	EventInterfaceUp         = "interface_up"
+	EventInterfaceDown       = "interface_down"
+	EventGPONLinkFlap        = "gpon_link_flap"
+	EventOpticalLevelChanged = "optical_level_changed"
+)
+
+// eventHistory is the number of events kept to replay to SSE clients reconnecting with Last-Event-ID
+const eventHistory = 100
+
+// Event is a change of the gateway state between two snapshots
+type Event struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Instance  string    `json:"instance"`
+	Interface string    `json:"interface,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	MAC       string    `json:"mac,omitempty"`
+	Vendor    string    `json:"vendor,omitempty"`
+	// State is the link state after the change, up or down
+	State       string   `json:"state,omitempty"`
+	Transitions *float64 `json:"transitions,omitempty"`
+	RXPower     *float64 `json:"rx_power,omitempty"`
+	TXPower     *float64 `json:"tx_power,omitempty"`
+	PrevRXPower *float64 `json:"previous_rx_power,omitempty"`
+	PrevTXPower *float64 `json:"previous_tx_power,omitempty"`
+}
+
+// linkState names an interface or GPON status
+func linkState(status float64) string {
+	if status == 1 {
+		return "up"
+	}
+	return "down"
+}
+
+// float returns a pointer to a copy of f, for the optional Event fields
+func float(f float64) *float64 {
+	return &f
+}
+
+// DiffSnapshots returns the events between two consecutive snapshots, reporting optical levels that moved by at least threshold dB
+func DiffSnapshots(previous *Snapshot, current *Snapshot, threshold float64) []Event {
+	var events []Event
+	event := func(e Event) {
+		e.Time = current.Time
+		events = append(events, e)
+	}
+
+	known := make(map[string]WifiClient)
+	for _, client := range previous.WifiClients {
+		known[client.Interface+"/"+client.MAC] = client
+	}
+	for _, client := range current.WifiClients {
+		key := client.Interface + "/" + client.MAC
+		if _, ok := known[key]; ok {
+			delete(known, key)
+			continue
+		}
+		event(Event{Type: EventWifiClientJoined, Interface: client.Interface, MAC: client.MAC})
+	}
+	for _, client := range previous.WifiClients {
+		if _, ok := known[client.Interface+"/"+client.MAC]; ok {
+			event(Event{Type: EventWifiClientLeft, Interface: client.Interface, MAC: client.MAC})
+		}
+	}
+
+	status := make(map[string]float64)
+	for _, Interface := range previous.Interfaces {
+		status[Interface.ID] = Interface.Status
+	}
+	for _, Interface := range current.Interfaces {
+		before, ok := status[Interface.ID]
+		if !ok || before == Interface.Status {
+			continue
+		}
+		eventType := EventInterfaceDown
+		if Interface.Status == 1 {
+			eventType = EventInterfaceUp
+		}
+		event(Event{Type: eventType, Interface: Interface.ID, Name: Interface.Name, State: linkState(Interface.Status)})
+	}
+
+	// a flap between two polls only shows in the transitions counter
+	gpon, prev := current.GPON, previous.GPON
+	if gpon.Status != prev.Status || gpon.Transitions > prev.Transitions {
+		event(Event{Type: EventGPONLinkFlap, Interface: gpon.ID, Name: gpon.Name, State: linkState(gpon.Status), Transitions: float(gpon.Transitions)})
+	}
+	if math.Abs(gpon.RXPower-prev.RXPower) >= threshold || math.Abs(gpon.TXPower-prev.TXPower) >= threshold {
+		event(Event{
+			Type:        EventOpticalLevelChanged,
+			Interface:   gpon.ID,
+			Name:        gpon.Name,
+			RXPower:     float(gpon.RXPower),
+			TXPower:     float(gpon.TXPower),
+			PrevRXPower: float(prev.RXPower),
+			PrevTXPower: float(prev.TXPower),
+		})
+	}
+	return events
+}
+
+// logfmt formats an event as a structured log line of key=value pairs
+func (e Event) logfmt() string {
+	var b strings.Builder
+	pair := func(key string, value string) {
+		if value == "" {
+			return
+		}
+		if strings.ContainsAny(value, " \"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", key, value)
+	}
+	optional := func(key string, value *float64) {
+		if value != nil {
+			pair(key, strconv.FormatFloat(*value, 'f', -1, 64))
+		}
+	}
+	b.WriteString("event=" + e.Type)
+	pair("id", strconv.FormatInt(e.ID, 10))
+	pair("instance", e.Instance)
+	pair("interface", e.Interface)
+	pair("name", e.Name)
+	pair("mac", e.MAC)
+	pair("vendor", e.Vendor)
+	pair("state", e.State)
+	optional("transitions", e.Transitions)
+	optional("rx_power", e.RXPower)
+	optional("tx_power", e.TXPower)
+	optional("previous_rx_power", e.PrevRXPower)
+	optional("previous_tx_power", e.PrevTXPower)
+	return b.String()
+}
+
+// EventStream diffs the snapshots of an exporter, logs the events and serves them as Server-Sent Events
+type EventStream struct {
+	exporter *ZhoneExporter
+	// OpticalThreshold is the change in dB of the receive or transmit power reported as optical_level_changed
+	OpticalThreshold float64
+
+	mu       sync.Mutex
+	previous *Snapshot
+	lastID   int64
+	history  []Event
+	clients  map[chan Event]bool
+}
+
+// NewEventStream subscribes to the snapshots of exporter
+func NewEventStream(exporter *ZhoneExporter, opticalThreshold float64) *EventStream {
+	s := &EventStream{
+		exporter:         exporter,
+		OpticalThreshold: opticalThreshold,
+		clients:          make(map[chan Event]bool),
+	}
+	exporter.Subscribe(s.update)
+	return s
+}
+
+// SetOpticalThreshold changes the optical level change reported as optical_level_changed
+func (s *EventStream) SetOpticalThreshold(threshold float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.OpticalThreshold = threshold
+}
+
+// update diffs a snapshot against the previous one and dispatches the events
+func (s *EventStream) update(snapshot *Snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous := s.previous
+	// concurrent scrapes may complete out of order
+	if previous != nil && snapshot.Time.Before(previous.Time) {
+		return
+	}
+	// keep the optical levels last reported, so a slow drift is reported once it adds up to the threshold
+	next := *snapshot
+	s.previous = &next
+	if previous == nil {
+		return
+	}
+	optical := false
+	for _, event := range DiffSnapshots(previous, snapshot, s.OpticalThreshold) {
+		s.lastID++
+		event.ID = s.lastID
+		event.Instance = s.exporter.Instance
+		if event.MAC != "" {
+			event.Vendor, _ = s.exporter.clientVendor(event.MAC)
+		}
+		if event.Type == EventOpticalLevelChanged {
+			optical = true
+		}
+		log.Print(event.logfmt())
+		s.history = append(s.history, event)
+		if len(s.history) > eventHistory {
+			s.history = s.history[len(s.history)-eventHistory:]
+		}
+		for client := range s.clients {
+			select {
+			case client <- event:
+			default:
+				// a client that doesn't keep up loses events rather than holding up the others
+			}
+		}
+	}
+	if !optical {
+		next.GPON.RXPower = previous.GPON.RXPower
+		next.GPON.TXPower = previous.GPON.TXPower
+	}
+}
+
+// subscribe registers an SSE client, returning the events it missed since lastID
+func (s *EventStream) subscribe(lastID int64) (chan Event, []Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	client := make(chan Event, 64)
+	s.clients[client] = true
+	var missed []Event
+	if lastID > 0 {
+		for _, event := range s.history {
+			if event.ID > lastID {
+				missed = append(missed, event)
+			}
+		}
+	}
+	return client, missed
+}
+
+// unsubscribe removes an SSE client
+func (s *EventStream) unsubscribe(client chan Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, client)
+}
+
+// ServeHTTP streams the events as Server-Sent Events, optionally limited to a comma separated list of types
+func (s *EventStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	var types map[string]bool
+	if filter := r.URL.Query().Get("types"); filter != "" {
+		types = make(map[string]bool)
+		for _, t := range strings.Split(filter, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+	lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	client, missed := s.subscribe(lastID)
+	defer s.unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	send := func(event Event) error {
+		if types != nil && !types[event.Type] {
+			return nil
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		return err
+	}
+	for _, event := range missed {
+		if send(event) != nil {
+			return
+		}
+	}
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event := <-client:
+			if send(event) != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
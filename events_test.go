@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	gpon := GPONData{ID: "eth0", Name: "GPON", Status: 1, RXPower: -19.5, TXPower: 2.1, Transitions: 3}
+	interfaces := []InterfaceData{{ID: "eth0", Name: "GPON", Status: 1}, {ID: "eth1", Name: "LAN1", Status: 1}}
+	phone := WifiClient{Interface: "wl0", MAC: "3c:22:fb:00:00:09"}
+	laptop := WifiClient{Interface: "wl1", MAC: "da:a1:19:00:00:01"}
+	for _, test := range []struct {
+		name              string
+		previous, current Snapshot
+		want              []Event
+	}{
+		{
+			name:     "unchanged",
+			previous: Snapshot{Interfaces: interfaces, GPON: gpon, WifiClients: []WifiClient{phone, laptop}},
+			current:  Snapshot{Interfaces: interfaces, GPON: gpon, WifiClients: []WifiClient{laptop, phone}},
+		},
+		{
+			name:     "wifi clients join, leave and roam",
+			previous: Snapshot{GPON: gpon, WifiClients: []WifiClient{phone, laptop}},
+			current:  Snapshot{GPON: gpon, WifiClients: []WifiClient{{Interface: "wl1", MAC: phone.MAC}}},
+			want: []Event{
+				{Type: EventWifiClientJoined, Interface: "wl1", MAC: phone.MAC},
+				{Type: EventWifiClientLeft, Interface: "wl0", MAC: phone.MAC},
+				{Type: EventWifiClientLeft, Interface: "wl1", MAC: laptop.MAC},
+			},
+		},
+		{
+			name:     "an interface goes down, new interfaces are not reported",
+			previous: Snapshot{Interfaces: interfaces, GPON: gpon},
+			current: Snapshot{Interfaces: []InterfaceData{
+				{ID: "eth0", Name: "GPON", Status: 1},
+				{ID: "eth1", Name: "LAN1", Status: 0},
+				{ID: "eth2", Name: "LAN2", Status: 1},
+			}, GPON: gpon},
+			want: []Event{{Type: EventInterfaceDown, Interface: "eth1", Name: "LAN1", State: "down"}},
+		},
+		{
+			name:     "GPON link down",
+			previous: Snapshot{GPON: gpon},
+			current:  Snapshot{GPON: GPONData{ID: "eth0", Name: "GPON", Status: 0, RXPower: -19.5, TXPower: 2.1, Transitions: 4}},
+			want:     []Event{{Type: EventGPONLinkFlap, Interface: "eth0", Name: "GPON", State: "down", Transitions: float(4)}},
+		},
+		{
+			name:     "GPON flap between two polls",
+			previous: Snapshot{GPON: gpon},
+			current:  Snapshot{GPON: GPONData{ID: "eth0", Name: "GPON", Status: 1, RXPower: -19.5, TXPower: 2.1, Transitions: 5}},
+			want:     []Event{{Type: EventGPONLinkFlap, Interface: "eth0", Name: "GPON", State: "up", Transitions: float(5)}},
+		},
+		{
+			name:     "optical level changed by the threshold",
+			previous: Snapshot{GPON: gpon},
+			current:  Snapshot{GPON: GPONData{ID: "eth0", Name: "GPON", Status: 1, RXPower: -20.5, TXPower: 2.3, Transitions: 3}},
+			want: []Event{{
+				Type: EventOpticalLevelChanged, Interface: "eth0", Name: "GPON",
+				RXPower: float(-20.5), TXPower: float(2.3), PrevRXPower: float(-19.5), PrevTXPower: float(2.1),
+			}},
+		},
+		{
+			name:     "optical level changed below the threshold",
+			previous: Snapshot{GPON: gpon},
+			current:  Snapshot{GPON: GPONData{ID: "eth0", Name: "GPON", Status: 1, RXPower: -20.4, TXPower: 1.2, Transitions: 3}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.current.Time = at
+			for i := range test.want {
+				test.want[i].Time = at
+			}
+			got := DiffSnapshots(&test.previous, &test.current, 1)
+			if len(got) != 0 || len(test.want) != 0 {
+				if !reflect.DeepEqual(got, test.want) {
+					t.Errorf("DiffSnapshots =\n%+v\nwant\n%+v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestEventLogfmt(t *testing.T) {
+	event := Event{
+		ID: 7, Type: EventOpticalLevelChanged, Instance: "gateway", Interface: "eth0", Name: "GPON uplink",
+		RXPower: float(-20.5), PrevRXPower: float(-19.5),
+	}
+	want := `event=optical_level_changed id=7 instance=gateway interface=eth0 name="GPON uplink" rx_power=-20.5 previous_rx_power=-19.5`
+	if got := event.logfmt(); got != want {
+		t.Errorf("logfmt =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestEventStreamInstance(t *testing.T) {
+	status := 1.0
+	exporter := NewZhoneExporter("192.168.2.1", "user", "user")
+	exporter.Instance = "upstairs"
+	exporter.Transport = transportFunc(func() (*Snapshot, error) {
+		return &Snapshot{Interfaces: []InterfaceData{{ID: "eth1", Name: "LAN1", Status: status}}}, nil
+	})
+	stream := NewEventStream(exporter, 1)
+	exporter.Scrape()
+	status = 0
+	exporter.Scrape()
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	// the events carry the instance label of the metrics, the alias rather than the address
+	if len(stream.history) != 1 || stream.history[0].Instance != "upstairs" {
+		t.Errorf("events %+v, want an interface_down of upstairs", stream.history)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var graphiteInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// GraphiteSink writes points to Carbon using the plaintext protocol
+type GraphiteSink struct {
+	address string
+	prefix  string
+	conn    net.Conn
+}
+
+// NewGraphiteSink builds a GraphiteSink for the Carbon server at address, naming every metric below prefix
+func NewGraphiteSink(address string, prefix string) *GraphiteSink {
+	return &GraphiteSink{address: address, prefix: strings.Trim(prefix, ".")}
+}
+
+// graphiteNode makes a value usable as a single node of a metric path
+func graphiteNode(s string) string {
+	return graphiteInvalidChars.ReplaceAllString(s, "_")
+}
+
+// GraphitePaths returns the plaintext lines of a point, as prefix.instance.measurement.tags.field value timestamp
+func GraphitePaths(prefix string, point Point) []string {
+	nodes := []string{}
+	if prefix != "" {
+		nodes = append(nodes, prefix)
+	}
+	// the instance goes first, the interface name only labels the interface ID
+	for _, tag := range point.Tags {
+		if tag.Key == "instance" {
+			nodes = append(nodes, graphiteNode(tag.Value))
+		}
+	}
+	nodes = append(nodes, graphiteNode(point.Measurement))
+	for _, tag := range point.Tags {
+		if tag.Key != "instance" && tag.Key != "interface_name" && tag.Value != "" {
+			nodes = append(nodes, graphiteNode(tag.Value))
+		}
+	}
+	base := strings.Join(nodes, ".")
+	timestamp := strconv.FormatInt(point.Time.Unix(), 10)
+	var lines []string
+	for _, field := range point.Fields {
+		lines = append(lines, base+"."+graphiteNode(field.Key)+" "+strconv.FormatFloat(field.Value, 'f', -1, 64)+" "+timestamp+"\n")
+	}
+	return lines
+}
+
+// Write sends the points over a TCP connection, which is reopened after a failure
+func (s *GraphiteSink) Write(points []Point) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.address, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	w := bufio.NewWriter(s.conn)
+	for _, point := range points {
+		for _, line := range GraphitePaths(s.prefix, point) {
+			w.WriteString(line)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
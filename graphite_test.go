@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGraphitePaths(t *testing.T) {
+	at := time.Unix(1700000000, 999999999)
+	for _, test := range []struct {
+		name   string
+		prefix string
+		point  Point
+		want   []string
+	}{
+		{
+			name:   "interface",
+			prefix: "zhone",
+			point: Point{
+				Measurement: "interface",
+				Tags:        []Tag{{"instance", "192.168.1.1:80"}, {"interface", "eth0"}, {"interface_name", "GPON"}},
+				Fields:      []Field{{"rx_bytes", 8294965796}, {"status", 1}},
+				Time:        at,
+			},
+			want: []string{
+				"zhone.192_168_1_1_80.interface.eth0.rx_bytes 8294965796 1700000000\n",
+				"zhone.192_168_1_1_80.interface.eth0.status 1 1700000000\n",
+			},
+		},
+		{
+			name:   "wifi client",
+			prefix: "zhone",
+			point: Point{
+				Measurement: "wifi",
+				Tags:        []Tag{{"instance", "gateway"}, {"wlan_interface", "wl0.1"}, {"client_mac", "3c:22:fb:00:00:09"}},
+				Fields:      []Field{{"rssi", -50}, {"tx_rate", 866.7}},
+				Time:        at,
+			},
+			want: []string{
+				"zhone.gateway.wifi.wl0_1.3c_22_fb_00_00_09.rssi -50 1700000000\n",
+				"zhone.gateway.wifi.wl0_1.3c_22_fb_00_00_09.tx_rate 866.7 1700000000\n",
+			},
+		},
+		{
+			name: "no prefix and empty tags",
+			point: Point{
+				Measurement: "gpon",
+				Tags:        []Tag{{"instance", "gateway"}, {"interface", ""}, {"interface_name", ""}},
+				Fields:      []Field{{"rx_power", -19.51}},
+				Time:        at,
+			},
+			want: []string{"gateway.gpon.rx_power -19.51 1700000000\n"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := GraphitePaths(test.prefix, test.point); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("GraphitePaths =\n%q\nwant\n%q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	influxTagEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+)
+
+// InfluxSink writes points to the InfluxDB v2 HTTP write API in line protocol
+type InfluxSink struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewInfluxSink builds an InfluxSink for the bucket of an organisation on the InfluxDB server at address
+func NewInfluxSink(address string, org string, bucket string, token string) *InfluxSink {
+	query := url.Values{}
+	query.Set("org", org)
+	query.Set("bucket", bucket)
+	query.Set("precision", "ns")
+	return &InfluxSink{
+		url:    strings.TrimSuffix(address, "/") + "/api/v2/write?" + query.Encode(),
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// AppendLineProtocol appends a point to buf in InfluxDB line protocol, leaving out empty tags
+func AppendLineProtocol(buf []byte, point Point) []byte {
+	buf = append(buf, influxMeasurementEscaper.Replace(point.Measurement)...)
+	for _, tag := range point.Tags {
+		if tag.Value == "" {
+			continue
+		}
+		buf = append(buf, ',')
+		buf = append(buf, influxTagEscaper.Replace(tag.Key)...)
+		buf = append(buf, '=')
+		buf = append(buf, influxTagEscaper.Replace(tag.Value)...)
+	}
+	for i, field := range point.Fields {
+		if i == 0 {
+			buf = append(buf, ' ')
+		} else {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, influxTagEscaper.Replace(field.Key)...)
+		buf = append(buf, '=')
+		buf = strconv.AppendFloat(buf, field.Value, 'g', -1, 64)
+	}
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, point.Time.UnixNano(), 10)
+	return append(buf, '\n')
+}
+
+// Write posts the points to InfluxDB, rejected points are reported as permanent errors
+func (s *InfluxSink) Write(points []Point) error {
+	var buf []byte
+	for _, point := range points {
+		buf = AppendLineProtocol(buf, point)
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	err = fmt.Errorf("InfluxDB write: %s: %s", res.Status, bytes.TrimSpace(body))
+	if res.StatusCode == http.StatusBadRequest || res.StatusCode == http.StatusRequestEntityTooLarge {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAppendLineProtocol(t *testing.T) {
+	at := time.Unix(1700000000, 123456789)
+	for _, test := range []struct {
+		name  string
+		point Point
+		want  string
+	}{
+		{
+			name: "interface",
+			point: Point{
+				Measurement: "interface",
+				Tags:        []Tag{{"instance", "192.168.1.1"}, {"interface", "eth0"}, {"interface_name", "GPON"}},
+				Fields:      []Field{{"status", 1}, {"rx_bytes", 8294965796}, {"speed", 2.5e9}},
+				Time:        at,
+			},
+			want: "interface,instance=192.168.1.1,interface=eth0,interface_name=GPON status=1,rx_bytes=8.294965796e+09,speed=2.5e+09 1700000000123456789\n",
+		},
+		{
+			name: "empty tags are left out",
+			point: Point{
+				Measurement: "gpon",
+				Tags:        []Tag{{"instance", "gateway"}, {"interface", ""}, {"interface_name", ""}},
+				Fields:      []Field{{"rx_power", -19.51}, {"tx_power", 2.1}},
+				Time:        at,
+			},
+			want: "gpon,instance=gateway rx_power=-19.51,tx_power=2.1 1700000000123456789\n",
+		},
+		{
+			name: "escaping",
+			point: Point{
+				Measurement: "wifi clients,2",
+				Tags:        []Tag{{"instance", "home gateway"}, {"wlan_interface", "wl0,1"}, {"client_mac", "a=b"}},
+				Fields:      []Field{{"tx rate", 866.7}},
+				Time:        at,
+			},
+			want: `wifi\ clients\,2,instance=home\ gateway,wlan_interface=wl0\,1,client_mac=a\=b tx\ rate=866.7 1700000000123456789` + "\n",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := string(AppendLineProtocol(nil, test.point)); got != test.want {
+				t.Errorf("AppendLineProtocol =\n%q\nwant\n%q", got, test.want)
+			}
+		})
+	}
+
+	// points are appended to the buffer
+	first := Point{Measurement: "gpon", Fields: []Field{{"status", 1}}, Time: at}
+	if got, want := string(AppendLineProtocol(AppendLineProtocol(nil, first), first)), "gpon status=1 1700000000123456789\ngpon status=1 1700000000123456789\n"; got != want {
+		t.Errorf("two points = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// LANHost describes a device seen on the LAN side of the gateway
+type LANHost struct {
+	MAC       string
+	IP        string
+	Hostname  string
+	Interface string
+}
+
+var (
+	lanHostInfo = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "lan", "host_info"), "LAN host, with the interface it was learned on.", []string{
+			"instance",
+			"mac",
+			"ip",
+			"hostname",
+			"interface",
+		}, nil)
+	lanHosts = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "lan", "hosts"), "Number of LAN hosts per interface.", []string{
+			"instance",
+			"interface",
+		}, nil)
+)
+
+// tableColumns finds the first table on the page with a header cell reading header, and returns its rows as maps keyed by the header text
+func tableColumns(data *goquery.Document, header string) []map[string]string {
+	var rows []map[string]string
+	data.Find("table").EachWithBreak(func(_ int, table *goquery.Selection) bool {
+		trs := table.Find("tr")
+		var names []string
+		trs.Eq(0).Find("td,th").Each(func(_ int, cell *goquery.Selection) {
+			names = append(names, strings.TrimSpace(cell.Text()))
+		})
+		found := false
+		for _, name := range names {
+			if strings.EqualFold(name, header) {
+				found = true
+			}
+		}
+		if !found {
+			return true
+		}
+		trs.Slice(1, trs.Length()).Each(func(_ int, tr *goquery.Selection) {
+			row := make(map[string]string)
+			tr.Find("td").Each(func(i int, cell *goquery.Selection) {
+				if i < len(names) {
+					row[strings.ToLower(names[i])] = strings.TrimSpace(cell.Text())
+				}
+			})
+			rows = append(rows, row)
+		})
+		return false
+	})
+	return rows
+}
+
+// normalizeMAC returns the MAC address in the canonical lowercase, colon separated form, or an empty string if it is not valid
+func normalizeMAC(s string) string {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		return ""
+	}
+	return mac.String()
+}
+
+// ParseARPTable parses the ARP table page into a map of MAC address to IP address and device
+func ParseARPTable(data *goquery.Document) map[string][2]string {
+	arp := make(map[string][2]string)
+	for _, row := range tableColumns(data, "HW Address") {
+		mac := normalizeMAC(row["hw address"])
+		// incomplete entries are listed with an all zero MAC address
+		if mac == "" || mac == "00:00:00:00:00:00" {
+			continue
+		}
+		arp[mac] = [2]string{row["ip address"], row["device"]}
+	}
+	return arp
+}
+
+// ParseDHCPLeases parses the DHCP lease page into a map of MAC address to the hostname the client provided
+func ParseDHCPLeases(data *goquery.Document) map[string]string {
+	leases := make(map[string]string)
+	for _, row := range tableColumns(data, "Hostname") {
+		mac := normalizeMAC(row["mac address"])
+		if mac == "" {
+			continue
+		}
+		leases[mac] = row["hostname"]
+	}
+	return leases
+}
+
+// ParseBridgeForwarding parses the bridge forwarding database into a map of MAC address to the bridge port it was learned on.
+// The gateway's own addresses are skipped
+func ParseBridgeForwarding(data *goquery.Document) map[string]string {
+	fdb := make(map[string]string)
+	for _, row := range tableColumns(data, "MAC Address") {
+		mac := normalizeMAC(row["mac address"])
+		if mac == "" || strings.EqualFold(row["is local"], "yes") {
+			continue
+		}
+		fdb[mac] = row["interface"]
+	}
+	return fdb
+}
+
+// ParseLANHosts combines the ARP table, the DHCP leases and the bridge forwarding database into a list of LAN hosts.
+// Hosts are placed on the bridge port they were learned on, falling back to the device from the ARP table
+func ParseLANHosts(arp map[string][2]string, leases map[string]string, fdb map[string]string) []LANHost {
+	var hosts []LANHost
+	for mac, entry := range arp {
+		host := LANHost{MAC: mac, IP: entry[0], Hostname: leases[mac], Interface: entry[1]}
+		if port, ok := fdb[mac]; ok && port != "" {
+			host.Interface = port
+		}
+		hosts = append(hosts, host)
+	}
+	// hosts without an IP address in the ARP cache are still visible in the forwarding database
+	for mac, port := range fdb {
+		if _, ok := arp[mac]; ok {
+			continue
+		}
+		hosts = append(hosts, LANHost{MAC: mac, Hostname: leases[mac], Interface: port})
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].MAC < hosts[j].MAC })
+	return hosts
+}
+
+// FetchLANData executes the web scrapes for the ARP table, DHCP leases and bridge forwarding database
+func (e *ZhoneExporter) FetchLANData() (*goquery.Document, *goquery.Document, *goquery.Document, error) {
+	pages := []string{"arpview.cmd", "dhcpinfo.html", "zhnbridgemacs.cmd"}
+	var results [3]*goquery.Document
+	for i := range pages {
+		doc, err := e.fetchPage(pages[i], nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		results[i] = doc
+	}
+	return results[0], results[1], results[2], nil
+}
+
+// collectLAN exports the LAN host table. The LAN pages are not essential to the other metrics, so failures are logged rather than fatal
+func (e *ZhoneExporter) collectLAN(ch chan<- prometheus.Metric) {
+	arpdata, dhcpdata, fdbdata, err := e.FetchLANData()
+	if err != nil {
+		log.Printf("Unable to fetch LAN host table: %v", err)
+		return
+	}
+	var arp map[string][2]string
+	var leases, fdb map[string]string
+	var hosts []LANHost
+	for _, parser := range []struct {
+		name  string
+		parse func()
+	}{
+		{"ParseARPTable", func() { arp = ParseARPTable(arpdata) }},
+		{"ParseDHCPLeases", func() { leases = ParseDHCPLeases(dhcpdata) }},
+		{"ParseBridgeForwarding", func() { fdb = ParseBridgeForwarding(fdbdata) }},
+		{"ParseLANHosts", func() { hosts = ParseLANHosts(arp, leases, fdb) }},
+	} {
+		if err := parse(parser.name, parser.parse); err != nil {
+			log.Printf("Unable to parse LAN host table: %v", err)
+			return
+		}
+	}
+	counts := make(map[string]float64)
+	for _, host := range hosts {
+		counts[host.Interface]++
+		ch <- prometheus.MustNewConstMetric(
+			lanHostInfo, prometheus.GaugeValue, 1, e.Instance, host.MAC, host.IP, host.Hostname, host.Interface,
+		)
+	}
+	for iface, count := range counts {
+		ch <- prometheus.MustNewConstMetric(
+			lanHosts, prometheus.GaugeValue, count, e.Instance, iface,
+		)
+	}
+}
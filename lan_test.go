@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// readPage parses a captured gateway page from testdata
+func readPage(t *testing.T, name string) *goquery.Document {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	doc, err := goquery.NewDocumentFromReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestParseARPTable(t *testing.T) {
+	got := ParseARPTable(readPage(t, "arpview.cmd.html"))
+	want := map[string][2]string{
+		"aa:bb:cc:00:11:33": {"192.168.1.10", "br0"},
+		"3c:22:fb:00:00:09": {"192.168.1.23", "br0"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseARPTable = %v, want %v", got, want)
+	}
+}
+
+func TestParseDHCPLeases(t *testing.T) {
+	got := ParseDHCPLeases(readPage(t, "dhcpinfo.html"))
+	want := map[string]string{
+		"aa:bb:cc:00:11:33": "nas",
+		"3c:22:fb:00:00:09": "iPhone",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseDHCPLeases = %v, want %v", got, want)
+	}
+}
+
+func TestParseBridgeForwarding(t *testing.T) {
+	got := ParseBridgeForwarding(readPage(t, "zhnbridgemacs.cmd.html"))
+	want := map[string]string{
+		"aa:bb:cc:00:11:33": "eth1",
+		"3c:22:fb:00:00:09": "wl0",
+		"aa:bb:cc:00:11:44": "eth2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseBridgeForwarding = %v, want %v", got, want)
+	}
+}
+
+func TestParseLANHosts(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		arp    map[string][2]string
+		leases map[string]string
+		fdb    map[string]string
+		want   []LANHost
+	}{
+		{
+			name:   "captured pages",
+			arp:    ParseARPTable(readPage(t, "arpview.cmd.html")),
+			leases: ParseDHCPLeases(readPage(t, "dhcpinfo.html")),
+			fdb:    ParseBridgeForwarding(readPage(t, "zhnbridgemacs.cmd.html")),
+			want: []LANHost{
+				{MAC: "3c:22:fb:00:00:09", IP: "192.168.1.23", Hostname: "iPhone", Interface: "wl0"},
+				{MAC: "aa:bb:cc:00:11:33", IP: "192.168.1.10", Hostname: "nas", Interface: "eth1"},
+				{MAC: "aa:bb:cc:00:11:44", Interface: "eth2"},
+			},
+		},
+		{
+			name: "not in the forwarding database",
+			arp:  map[string][2]string{"aa:bb:cc:00:11:33": {"192.168.1.10", "br0"}},
+			want: []LANHost{{MAC: "aa:bb:cc:00:11:33", IP: "192.168.1.10", Interface: "br0"}},
+		},
+		{
+			name: "empty",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := ParseLANHosts(test.arp, test.leases, test.fdb)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseLANHosts = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
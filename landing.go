@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// landingTemplate is the page served on /, linking to the endpoints of the exporter
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Zhone Exporter</title></head>
+<body>
+<h1>Zhone Exporter</h1>
+{{if .Target}}<p>Collecting from {{.Target}}</p>{{end}}
+<ul>
+{{range .Links}}<li><a href="{{.Path}}">{{.Path}}</a> {{.Description}}</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// landingLink is an endpoint listed on the landing page
+type landingLink struct {
+	Path        string
+	Description string
+}
+
+// LandingPage lists the endpoints of the exporter on /
+type LandingPage struct {
+	Target string
+	Links  []landingLink
+}
+
+// Add lists an endpoint on the landing page
+func (l *LandingPage) Add(path string, description string) {
+	l.Links = append(l.Links, landingLink{path, description})
+}
+
+// ServeHTTP serves the landing page, and a 404 for any other path not otherwise handled
+func (l *LandingPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	landingTemplate.Execute(w, l)
+}
+
+// Health serves the liveness and readiness endpoints, readiness following the last collection from the gateway
+type Health struct {
+	mu        sync.Mutex
+	gateway   bool
+	collected time.Time
+	err       error
+	errAt     time.Time
+}
+
+// NewHealth follows the collections of exporter, which is nil when the exporter has no gateway to query
+func NewHealth(exporter *ZhoneExporter) *Health {
+	h := &Health{gateway: exporter != nil}
+	if exporter == nil {
+		return h
+	}
+	exporter.Subscribe(func(snapshot *Snapshot) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.collected = snapshot.Time
+		h.err = nil
+	})
+	exporter.SubscribeFailures(func(err error) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.err = err
+		h.errAt = time.Now()
+	})
+	return h
+}
+
+// ServeHealthy reports the exporter is running, without touching the gateway
+func (h *Health) ServeHealthy(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "zhone-exporter is Healthy.")
+}
+
+// ServeReady reports whether the last collection from the gateway succeeded, without starting one
+func (h *Health) ServeReady(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case !h.gateway:
+		fmt.Fprintln(w, "zhone-exporter is Ready.")
+	case h.err != nil:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "zhone-exporter is not Ready, the last collection failed at %s: %v\n", h.errAt.Format(time.RFC3339), h.err)
+	case h.collected.IsZero():
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "zhone-exporter is not Ready, nothing was collected from the gateway yet.")
+	default:
+		fmt.Fprintf(w, "zhone-exporter is Ready, last collected at %s.\n", h.collected.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealthReady(t *testing.T) {
+	ready := func(h *Health) (int, string) {
+		w := httptest.NewRecorder()
+		h.ServeReady(w, httptest.NewRequest(http.MethodGet, "/-/ready", nil))
+		return w.Code, w.Body.String()
+	}
+
+	if code, body := ready(NewHealth(nil)); code != http.StatusOK || body != "zhone-exporter is Ready.\n" {
+		t.Errorf("without a gateway: HTTP %d %q", code, body)
+	}
+
+	exporter := testGateway(t, scrapePages)
+	web := exporter.Transport
+	health := NewHealth(exporter)
+	if code, body := ready(health); code != http.StatusServiceUnavailable || !strings.Contains(body, "nothing was collected") {
+		t.Errorf("before the first collection: HTTP %d %q", code, body)
+	}
+	if _, err := exporter.Scrape(); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := ready(health); code != http.StatusOK || !strings.Contains(body, "Ready, last collected at") {
+		t.Errorf("after a collection: HTTP %d %q", code, body)
+	}
+
+	exporter.Transport = transportFunc(func() (*Snapshot, error) {
+		return nil, errors.New("connection refused")
+	})
+	if _, err := exporter.Scrape(); err == nil {
+		t.Fatal("Scrape succeeded on an unreachable gateway")
+	}
+	if code, body := ready(health); code != http.StatusServiceUnavailable || !strings.Contains(body, "the last collection failed at") || !strings.Contains(body, "connection refused") {
+		t.Errorf("after a failed collection: HTTP %d %q", code, body)
+	}
+	exporter.Transport = web
+	if _, err := exporter.Scrape(); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := ready(health); code != http.StatusOK {
+		t.Errorf("after the gateway recovered: HTTP %d %q", code, body)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	mqttOnline  = "online"
+	mqttOffline = "offline"
+	mqttHome    = "home"
+	mqttAway    = "not_home"
+)
+
+var mqttIDChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// mqttID turns a host name, interface or MAC address into a topic level and Home Assistant object id
+func mqttID(s string) string {
+	return strings.Trim(mqttIDChars.ReplaceAllString(strings.ToLower(s), "_"), "_")
+}
+
+// mqttDevice is the device block shared by all Home Assistant discovery configs of a gateway
+type mqttDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+// mqttDiscovery is a Home Assistant MQTT discovery config for a sensor or device_tracker
+type mqttDiscovery struct {
+	Name              string     `json:"name"`
+	UniqueID          string     `json:"unique_id"`
+	StateTopic        string     `json:"state_topic"`
+	ValueTemplate     string     `json:"value_template,omitempty"`
+	UnitOfMeasurement string     `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string     `json:"device_class,omitempty"`
+	StateClass        string     `json:"state_class,omitempty"`
+	PayloadHome       string     `json:"payload_home,omitempty"`
+	PayloadNotHome    string     `json:"payload_not_home,omitempty"`
+	SourceType        string     `json:"source_type,omitempty"`
+	AvailabilityTopic string     `json:"availability_topic"`
+	Device            mqttDevice `json:"device"`
+}
+
+// mqttGPONState is published to <prefix>/<node>/gpon
+type mqttGPONState struct {
+	Status      float64 `json:"status"`
+	RXPower     float64 `json:"rx_power"`
+	TXPower     float64 `json:"tx_power"`
+	Transitions float64 `json:"transitions"`
+}
+
+// mqttInterfaceState is published to <prefix>/<node>/interface/<interface>
+type mqttInterfaceState struct {
+	Name    string  `json:"name"`
+	Status  float64 `json:"status"`
+	Speed   float64 `json:"speed"`
+	RXBytes float64 `json:"rx_bytes"`
+	TXBytes float64 `json:"tx_bytes"`
+	RXRate  float64 `json:"rx_rate"`
+	TXRate  float64 `json:"tx_rate"`
+}
+
+// mqttClientState is published to <prefix>/<node>/client/<mac>
+type mqttClientState struct {
+	Interface string  `json:"interface"`
+	MAC       string  `json:"mac"`
+	Vendor    string  `json:"vendor"`
+	RSSI      float64 `json:"rssi"`
+	TXRate    float64 `json:"tx_rate"`
+	RXRate    float64 `json:"rx_rate"`
+}
+
+// MQTTPublisher publishes every snapshot of a gateway to an MQTT broker, along with Home Assistant discovery configs
+type MQTTPublisher struct {
+	exporter        *ZhoneExporter
+	client          mqtt.Client
+	prefix          string
+	discoveryPrefix string
+	node            string
+	device          mqttDevice
+
+	mutex      sync.Mutex
+	previous   *Snapshot
+	discovered map[string]bool
+	clients    map[string]bool
+}
+
+// NewMQTTPublisher connects to the broker and subscribes to the snapshots of the exporter
+func NewMQTTPublisher(exporter *ZhoneExporter, broker string, username string, password string, prefix string, discoveryPrefix string) (*MQTTPublisher, error) {
+	node := mqttID(exporter.URL)
+	p := &MQTTPublisher{
+		exporter:        exporter,
+		prefix:          strings.TrimSuffix(prefix, "/"),
+		discoveryPrefix: strings.TrimSuffix(discoveryPrefix, "/"),
+		node:            node,
+		device: mqttDevice{
+			Identifiers:  []string{"zhone_" + node},
+			Name:         "Zhone " + exporter.URL,
+			Manufacturer: "Zhone",
+			Model:        "ZNID-GPON-2726A1-UK",
+		},
+		discovered: make(map[string]bool),
+		clients:    make(map[string]bool),
+	}
+	options := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID("zhone-exporter-"+node).
+		SetUsername(username).
+		SetPassword(password).
+		SetAutoReconnect(true).
+		SetWill(p.topic("status"), mqttOffline, 1, true).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			// the broker may have lost the retained configs, announce everything again
+			p.mutex.Lock()
+			p.discovered = make(map[string]bool)
+			p.mutex.Unlock()
+			client.Publish(p.topic("status"), 1, true, mqttOnline)
+		})
+	p.client = mqtt.NewClient(options)
+	token := p.client.Connect()
+	if !token.WaitTimeout(10 * time.Second) {
+		return nil, fmt.Errorf("MQTT: timeout connecting to %s", broker)
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("MQTT: %w", err)
+	}
+	exporter.Subscribe(p.Publish)
+	return p, nil
+}
+
+// topic returns the state topic below the gateway's node
+func (p *MQTTPublisher) topic(levels ...string) string {
+	return strings.Join(append([]string{p.prefix, p.node}, levels...), "/")
+}
+
+// publish sends a payload, marshalling it to JSON unless it is a string
+func (p *MQTTPublisher) publish(topic string, retained bool, payload interface{}) {
+	if s, ok := payload.(string); ok {
+		p.client.Publish(topic, 0, retained, s)
+		return
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("MQTT: %s: %v", topic, err)
+		return
+	}
+	p.client.Publish(topic, 0, retained, data)
+}
+
+// discover publishes a retained discovery config the first time an entity is seen
+func (p *MQTTPublisher) discover(component string, object string, config mqttDiscovery) {
+	id := p.node + "_" + object
+	if p.discovered[component+"/"+id] {
+		return
+	}
+	config.UniqueID = "zhone_" + id
+	config.AvailabilityTopic = p.topic("status")
+	config.Device = p.device
+	p.publish(strings.Join([]string{p.discoveryPrefix, component, p.node, object, "config"}, "/"), true, config)
+	p.discovered[component+"/"+id] = true
+}
+
+// sensor announces a sensor reading one field of a JSON state topic
+func (p *MQTTPublisher) sensor(object string, name string, stateTopic string, field string, unit string, deviceClass string) {
+	stateClass := "measurement"
+	if deviceClass == "" && unit == "" {
+		stateClass = ""
+	}
+	p.discover("sensor", object, mqttDiscovery{
+		Name:              name,
+		StateTopic:        stateTopic,
+		ValueTemplate:     "{{ value_json." + field + " }}",
+		UnitOfMeasurement: unit,
+		DeviceClass:       deviceClass,
+		StateClass:        stateClass,
+	})
+}
+
+// rate returns the bit rate of a byte counter since the previous snapshot
+func rate(current float64, previous float64, elapsed time.Duration) float64 {
+	if elapsed <= 0 || current < previous {
+		return 0
+	}
+	return (current - previous) * 8 / elapsed.Seconds()
+}
+
+// Publish sends the GPON levels, interface counters and rates and the wifi clients of a snapshot to the broker
+func (p *MQTTPublisher) Publish(snapshot *Snapshot) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.client.IsConnectionOpen() {
+		return
+	}
+
+	gponTopic := p.topic("gpon")
+	p.sensor("gpon_rx_power", "GPON receive power", gponTopic, "rx_power", "dBm", "signal_strength")
+	p.sensor("gpon_tx_power", "GPON transmit power", gponTopic, "tx_power", "dBm", "signal_strength")
+	p.sensor("gpon_transitions", "GPON link transitions", gponTopic, "transitions", "", "")
+	p.publish(gponTopic, false, mqttGPONState{
+		Status:      snapshot.GPON.Status,
+		RXPower:     snapshot.GPON.RXPower,
+		TXPower:     snapshot.GPON.TXPower,
+		Transitions: snapshot.GPON.Transitions,
+	})
+
+	previous := make(map[string]InterfaceData)
+	var elapsed time.Duration
+	if p.previous != nil {
+		for _, Interface := range p.previous.Interfaces {
+			previous[Interface.ID] = Interface
+		}
+		elapsed = snapshot.Time.Sub(p.previous.Time)
+	}
+	for _, Interface := range snapshot.Interfaces {
+		id := mqttID(Interface.ID)
+		state := mqttInterfaceState{
+			Name:    Interface.Name,
+			Status:  Interface.Status,
+			Speed:   Interface.IfSpeed,
+			RXBytes: Interface.rxBytes,
+			TXBytes: Interface.txBytes,
+		}
+		if last, ok := previous[Interface.ID]; ok {
+			state.RXRate = rate(Interface.rxBytes, last.rxBytes, elapsed)
+			state.TXRate = rate(Interface.txBytes, last.txBytes, elapsed)
+		}
+		interfaceTopic := p.topic("interface", id)
+		p.sensor(id+"_rx_rate", Interface.ID+" receive rate", interfaceTopic, "rx_rate", "bit/s", "data_rate")
+		p.sensor(id+"_tx_rate", Interface.ID+" transmit rate", interfaceTopic, "tx_rate", "bit/s", "data_rate")
+		p.publish(interfaceTopic, false, state)
+	}
+	p.previous = snapshot
+
+	present := make(map[string]bool)
+	for _, client := range snapshot.WifiClients {
+		mac := normalizeMAC(client.MAC)
+		if mac == "" {
+			mac = strings.ToLower(client.MAC)
+		}
+		id := mqttID(mac)
+		vendor, _ := p.exporter.clientVendor(mac)
+		clientTopic := p.topic("client", id)
+		p.sensor(id+"_rssi", mac+" RSSI", clientTopic, "rssi", "dBm", "signal_strength")
+		p.discover("device_tracker", id, mqttDiscovery{
+			Name:           mac,
+			StateTopic:     clientTopic + "/presence",
+			PayloadHome:    mqttHome,
+			PayloadNotHome: mqttAway,
+			SourceType:     "router",
+		})
+		p.publish(clientTopic, false, mqttClientState{
+			Interface: client.Interface,
+			MAC:       mac,
+			Vendor:    vendor,
+			RSSI:      client.RSSI,
+			TXRate:    client.TXRate,
+			RXRate:    client.RXRate,
+		})
+		p.publish(clientTopic+"/presence", true, mqttHome)
+		present[id] = true
+	}
+	for id := range p.clients {
+		if !present[id] {
+			p.publish(p.topic("client", id, "presence"), true, mqttAway)
+		}
+	}
+	p.clients = present
+}
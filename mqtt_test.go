@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// brokerMessage is a PUBLISH seen by the fake broker
+type brokerMessage struct {
+	topic    string
+	payload  string
+	retained bool
+}
+
+// fakeBroker is a minimal MQTT 3.1.1 broker keeping retained messages and publishing the last will of clients
+// whose connection drops. It understands just enough of the protocol for the paho client
+type fakeBroker struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	retained map[string]string
+	messages []brokerMessage
+	conns    map[string]net.Conn
+	users    map[string]string
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	b := &fakeBroker{listener: listener, retained: make(map[string]string), conns: make(map[string]net.Conn), users: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+// readPacket reads the fixed header and body of an MQTT control packet
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+// mqttString reads a length-prefixed string from body
+func mqttString(body []byte) (string, []byte) {
+	n := int(binary.BigEndian.Uint16(body))
+	return string(body[2 : 2+n]), body[2+n:]
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	header, body, err := readPacket(r)
+	if err != nil || header>>4 != 1 {
+		return
+	}
+	_, body = mqttString(body) // protocol name
+	flags := body[1]
+	body = body[4:]
+	var clientID, user string
+	var will *brokerMessage
+	clientID, body = mqttString(body)
+	if flags&0x04 != 0 {
+		will = &brokerMessage{retained: flags&0x20 != 0}
+		will.topic, body = mqttString(body)
+		will.payload, body = mqttString(body)
+	}
+	if flags&0x80 != 0 {
+		user, _ = mqttString(body)
+	}
+	b.mu.Lock()
+	b.conns[clientID] = conn
+	b.users[clientID] = user
+	b.mu.Unlock()
+	conn.Write([]byte{0x20, 2, 0, 0})
+
+	for {
+		header, body, err := readPacket(r)
+		if err != nil {
+			if will != nil {
+				b.publish(*will)
+			}
+			return
+		}
+		switch header >> 4 {
+		case 3: // PUBLISH
+			var message brokerMessage
+			message.retained = header&0x01 != 0
+			message.topic, body = mqttString(body)
+			if qos := header >> 1 & 0x03; qos > 0 {
+				conn.Write([]byte{0x40, 2, body[0], body[1]})
+				body = body[2:]
+			}
+			message.payload = string(body)
+			b.publish(message)
+		case 8: // SUBSCRIBE, accepted but nothing is forwarded
+			conn.Write([]byte{0x90, 3, body[0], body[1], 0})
+		case 12: // PINGREQ
+			conn.Write([]byte{0xd0, 0})
+		case 14: // DISCONNECT, the will is discarded
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) publish(message brokerMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.messages = append(b.messages, message)
+	if message.retained {
+		b.retained[message.topic] = message.payload
+	}
+}
+
+// drop closes the connection of a client without a DISCONNECT, as a network failure would
+func (b *fakeBroker) drop(clientID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conns[clientID].Close()
+}
+
+// wait polls until condition holds on the broker state
+func (b *fakeBroker) wait(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		b.mu.Lock()
+		ok := condition()
+		b.mu.Unlock()
+		if ok {
+			return
+		}
+	}
+	t.Fatalf("timeout waiting for %s", what)
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	broker := newFakeBroker(t)
+	snapshots := []*Snapshot{
+		{
+			Interfaces: []InterfaceData{{ID: "eth0", Name: "GPON", Status: 1, rxBytes: 1000, txBytes: 2000}},
+			GPON:       GPONData{ID: "veip0", Status: 1, RXPower: -19.5, TXPower: 2.1},
+			WifiClients: []WifiClient{
+				{Interface: "wl0", MAC: "3C:22:FB:00:00:09", RSSI: -50},
+				{Interface: "wl1", MAC: "da:a1:19:00:00:01", RSSI: -70},
+			},
+		},
+		{
+			Interfaces:  []InterfaceData{{ID: "eth0", Name: "GPON", Status: 1, rxBytes: 11000, txBytes: 2000}},
+			GPON:        GPONData{ID: "veip0", Status: 1, RXPower: -19.5, TXPower: 2.1},
+			WifiClients: []WifiClient{{Interface: "wl0", MAC: "3C:22:FB:00:00:09", RSSI: -52}},
+		},
+	}
+	exporter := NewZhoneExporter("gateway", "user", "user")
+	exporter.Transport = transportFunc(func() (*Snapshot, error) {
+		snapshot := snapshots[0]
+		snapshots = snapshots[1:]
+		return snapshot, nil
+	})
+	publisher, err := NewMQTTPublisher(exporter, "tcp://"+broker.listener.Addr().String(), "mqtt", "secret", "zhone/", "homeassistant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.client.Disconnect(0)
+	broker.wait(t, "the online status", func() bool { return broker.retained["zhone/gateway/status"] == mqttOnline })
+	if user := broker.users["zhone-exporter-gateway"]; user != "mqtt" {
+		t.Errorf("connected as %q, want mqtt", user)
+	}
+
+	for range snapshots {
+		if _, err := exporter.Scrape(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	presence := "zhone/gateway/client/da_a1_19_00_00_01/presence"
+	broker.wait(t, "the client to leave", func() bool { return broker.retained[presence] == mqttAway })
+	if got := broker.retained["zhone/gateway/client/3c_22_fb_00_00_09/presence"]; got != mqttHome {
+		t.Errorf("presence of the remaining client = %q, want %q", got, mqttHome)
+	}
+
+	// the discovery configs are retained, and only sent once per entity
+	configs := make(map[string]int)
+	var rate mqttInterfaceState
+	broker.mu.Lock()
+	for _, message := range broker.messages {
+		if strings.HasPrefix(message.topic, "homeassistant/") {
+			if !message.retained {
+				t.Errorf("%s is not retained", message.topic)
+			}
+			configs[message.topic]++
+		}
+		if message.topic == "zhone/gateway/interface/eth0" {
+			if err := json.Unmarshal([]byte(message.payload), &rate); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	var tracker mqttDiscovery
+	if err := json.Unmarshal([]byte(broker.retained["homeassistant/device_tracker/gateway/3c_22_fb_00_00_09/config"]), &tracker); err != nil {
+		t.Error(err)
+	}
+	var sensor mqttDiscovery
+	if err := json.Unmarshal([]byte(broker.retained["homeassistant/sensor/gateway/gpon_rx_power/config"]), &sensor); err != nil {
+		t.Error(err)
+	}
+	broker.mu.Unlock()
+	for _, topic := range []string{
+		"homeassistant/sensor/gateway/gpon_rx_power/config",
+		"homeassistant/sensor/gateway/gpon_tx_power/config",
+		"homeassistant/sensor/gateway/gpon_transitions/config",
+		"homeassistant/sensor/gateway/eth0_rx_rate/config",
+		"homeassistant/sensor/gateway/eth0_tx_rate/config",
+		"homeassistant/sensor/gateway/3c_22_fb_00_00_09_rssi/config",
+		"homeassistant/sensor/gateway/da_a1_19_00_00_01_rssi/config",
+		"homeassistant/device_tracker/gateway/3c_22_fb_00_00_09/config",
+		"homeassistant/device_tracker/gateway/da_a1_19_00_00_01/config",
+	} {
+		if configs[topic] != 1 {
+			t.Errorf("%s published %d times, want once", topic, configs[topic])
+		}
+	}
+	if len(configs) != 9 {
+		t.Errorf("got %d discovery configs, want 9: %v", len(configs), configs)
+	}
+	want := mqttDiscovery{
+		Name:              "3c:22:fb:00:00:09",
+		UniqueID:          "zhone_gateway_3c_22_fb_00_00_09",
+		StateTopic:        "zhone/gateway/client/3c_22_fb_00_00_09/presence",
+		PayloadHome:       mqttHome,
+		PayloadNotHome:    mqttAway,
+		SourceType:        "router",
+		AvailabilityTopic: "zhone/gateway/status",
+		Device:            publisher.device,
+	}
+	if !reflect.DeepEqual(tracker, want) {
+		t.Errorf("device_tracker config = %+v, want %+v", tracker, want)
+	}
+	if sensor.StateTopic != "zhone/gateway/gpon" || sensor.ValueTemplate != "{{ value_json.rx_power }}" ||
+		sensor.UnitOfMeasurement != "dBm" || sensor.DeviceClass != "signal_strength" || sensor.StateClass != "measurement" {
+		t.Errorf("GPON receive power config = %+v", sensor)
+	}
+	// only the receive counter moved between the scrapes
+	if rate.RXRate <= 0 || rate.TXRate != 0 {
+		t.Errorf("eth0 rates = %v/%v bit/s, want a receive rate only", rate.RXRate, rate.TXRate)
+	}
+
+	// the broker publishes the last will when the connection drops, and the publisher announces itself again
+	broker.drop("zhone-exporter-gateway")
+	broker.wait(t, "the last will", func() bool {
+		for _, message := range broker.messages {
+			if message.topic == "zhone/gateway/status" && message.payload == mqttOffline && message.retained {
+				return true
+			}
+		}
+		return false
+	})
+	broker.wait(t, "the reconnection", func() bool { return broker.retained["zhone/gateway/status"] == mqttOnline })
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rule names of the built-in notification rules
+const (
+	RuleGatewayDown     = "gateway_down"
+	RuleGPONRXPowerLow  = "gpon_rx_power_low"
+	RuleInterfaceDown   = "interface_down"
+	RuleWifiClientRSSI  = "wifi_rssi_low"
+	alertStatusFiring   = "firing"
+	alertStatusResolved = "resolved"
+)
+
+// NotifyRules configures the built-in rules, a rule is disabled with its zero value
+type NotifyRules struct {
+	// GPONRXPowerBelow fires when the GPON receive power is below this level in dBm
+	GPONRXPowerBelow float64
+	// InterfacesDown lists the interfaces that fire when they are down
+	InterfacesDown []string
+	// WifiRSSIBelow fires for every wifi client with an RSSI below this level in dBm
+	WifiRSSIBelow float64
+	// DownScrapes fires when this many consecutive scrapes failed
+	DownScrapes int
+}
+
+// Alert is the state of a rule for one subject, such as an interface or a wifi client
+type Alert struct {
+	Rule      string     `json:"rule"`
+	Subject   string     `json:"subject"`
+	Status    string     `json:"status"`
+	Summary   string     `json:"summary"`
+	Value     *float64   `json:"value,omitempty"`
+	Threshold *float64   `json:"threshold,omitempty"`
+	StartsAt  time.Time  `json:"starts_at"`
+	EndsAt    *time.Time `json:"ends_at,omitempty"`
+}
+
+// key identifies the alert across evaluations
+func (a *Alert) key() string {
+	return a.Rule + "/" + a.Subject
+}
+
+// Notification is the webhook payload, grouping the alerts that changed in an evaluation
+type Notification struct {
+	Instance string  `json:"instance"`
+	Firing   int     `json:"firing"`
+	Resolved int     `json:"resolved"`
+	Alerts   []Alert `json:"alerts"`
+}
+
+// NotifyChannel delivers notifications, such as a webhook or an email
+type NotifyChannel interface {
+	Name() string
+	Send(notification Notification) error
+}
+
+// channelState keeps what was last sent to a channel, for deduplication and rate limiting
+type channelState struct {
+	channel NotifyChannel
+	// sent holds the status last sent per alert, and when
+	sent     map[string]string
+	sentAt   map[string]time.Time
+	history  []time.Time
+	deferred bool
+	// sending holds the alerts of the notification on its way, nil when there is none. The changes meanwhile go in the next one
+	sending map[string]bool
+}
+
+// Notifier evaluates the rules against every snapshot and sends deduplicated, rate-limited notifications
+type Notifier struct {
+	exporter *ZhoneExporter
+	rules    NotifyRules
+	// RepeatInterval is how long before a firing alert is notified again
+	RepeatInterval time.Duration
+	// MaxPerHour limits the notifications sent to each channel, further changes wait for the next slot
+	MaxPerHour int
+
+	mu       sync.Mutex
+	alerts   map[string]*Alert
+	failures int
+	latest   time.Time
+	channels []*channelState
+	// inflight counts the notifications being sent, idle is signalled when it drops to zero
+	inflight int
+	idle     *sync.Cond
+}
+
+// NewNotifier subscribes to the snapshots and failed scrapes of exporter
+func NewNotifier(exporter *ZhoneExporter, rules NotifyRules, channels ...NotifyChannel) *Notifier {
+	n := &Notifier{
+		exporter:       exporter,
+		rules:          rules,
+		RepeatInterval: 4 * time.Hour,
+		MaxPerHour:     10,
+		alerts:         make(map[string]*Alert),
+	}
+	n.idle = sync.NewCond(&n.mu)
+	for _, channel := range channels {
+		n.channels = append(n.channels, &channelState{channel: channel, sent: make(map[string]string), sentAt: make(map[string]time.Time)})
+	}
+	exporter.Subscribe(n.evaluate)
+	exporter.SubscribeFailures(n.failed)
+	return n
+}
+
+// Configure replaces the rules and limits, alerts of a rule that no longer fires resolving at the next evaluation
+func (n *Notifier) Configure(rules NotifyRules, repeatInterval time.Duration, maxPerHour int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.rules = rules
+	n.RepeatInterval = repeatInterval
+	n.MaxPerHour = maxPerHour
+}
+
+// set fires or updates the alert of a rule and subject
+func (n *Notifier) set(now time.Time, alert Alert) {
+	if existing, ok := n.alerts[alert.key()]; ok && existing.Status == alertStatusFiring {
+		alert.StartsAt = existing.StartsAt
+	} else {
+		alert.StartsAt = now
+	}
+	alert.Status = alertStatusFiring
+	n.alerts[alert.key()] = &alert
+}
+
+// resolve resolves the firing alerts of the rules that aren't in active
+func (n *Notifier) resolve(now time.Time, rules map[string]bool, active map[string]bool) {
+	for key, alert := range n.alerts {
+		if rules[alert.Rule] && alert.Status == alertStatusFiring && !active[key] {
+			alert.Status = alertStatusResolved
+			end := now
+			alert.EndsAt = &end
+		}
+	}
+}
+
+// evaluate applies the snapshot rules, and resolves the gateway down alert
+func (n *Notifier) evaluate(snapshot *Snapshot) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// concurrent scrapes may complete out of order
+	if snapshot.Time.Before(n.latest) {
+		return
+	}
+	n.latest = snapshot.Time
+	now := snapshot.Time
+	n.failures = 0
+	active := make(map[string]bool)
+	fire := func(alert Alert) {
+		n.set(now, alert)
+		active[alert.key()] = true
+	}
+
+	if threshold := n.rules.GPONRXPowerBelow; threshold != 0 && snapshot.GPON.RXPower < threshold {
+		fire(Alert{
+			Rule:      RuleGPONRXPowerLow,
+			Subject:   "gpon",
+			Summary:   fmt.Sprintf("GPON receive power %.2f dBm is below %.2f dBm", snapshot.GPON.RXPower, threshold),
+			Value:     float(snapshot.GPON.RXPower),
+			Threshold: float(threshold),
+		})
+	}
+	watched := make(map[string]bool)
+	for _, id := range n.rules.InterfacesDown {
+		watched[id] = true
+	}
+	for _, Interface := range snapshot.Interfaces {
+		if watched[Interface.ID] && Interface.Status != 1 {
+			fire(Alert{
+				Rule:    RuleInterfaceDown,
+				Subject: Interface.ID,
+				Summary: fmt.Sprintf("Interface %s (%s) is down", Interface.ID, Interface.Name),
+			})
+		}
+	}
+	if threshold := n.rules.WifiRSSIBelow; threshold != 0 {
+		for _, client := range snapshot.WifiClients {
+			if client.RSSI < threshold {
+				fire(Alert{
+					Rule:      RuleWifiClientRSSI,
+					Subject:   client.MAC,
+					Summary:   fmt.Sprintf("Wifi client %s on %s has an RSSI of %.0f dBm, below %.0f dBm", client.MAC, client.Interface, client.RSSI, threshold),
+					Value:     float(client.RSSI),
+					Threshold: float(threshold),
+				})
+			}
+		}
+	}
+	n.resolve(now, map[string]bool{RuleGPONRXPowerLow: true, RuleInterfaceDown: true, RuleWifiClientRSSI: true, RuleGatewayDown: true}, active)
+	n.dispatch(now)
+}
+
+// failed counts a failed scrape, firing the gateway down alert once there are enough in a row
+func (n *Notifier) failed(err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	n.failures++
+	if n.rules.DownScrapes > 0 && n.failures >= n.rules.DownScrapes {
+		n.set(now, Alert{
+			Rule:    RuleGatewayDown,
+			Subject: n.exporter.Instance,
+			Summary: fmt.Sprintf("Gateway %s could not be scraped %d times in a row: %v", n.exporter.URL, n.failures, err),
+			Value:   float(float64(n.failures)),
+		})
+	}
+	n.dispatch(now)
+}
+
+// dispatch queues the alerts that changed, or are due a repeat, to every channel within its rate limit. The
+// notifications are sent in the background, so a slow channel doesn't hold up the scrapes
+func (n *Notifier) dispatch(now time.Time) {
+	for _, state := range n.channels {
+		if state.sending != nil {
+			continue
+		}
+		var alerts []Alert
+		for key, alert := range n.alerts {
+			sent, ok := state.sent[key]
+			switch {
+			case alert.Status == alertStatusFiring && (!ok || sent != alertStatusFiring):
+			case alert.Status == alertStatusFiring && now.Sub(state.sentAt[key]) >= n.RepeatInterval:
+			case alert.Status == alertStatusResolved && ok && sent == alertStatusFiring:
+			default:
+				continue
+			}
+			alerts = append(alerts, *alert)
+		}
+		if len(alerts) == 0 {
+			continue
+		}
+		for len(state.history) > 0 && now.Sub(state.history[0]) >= time.Hour {
+			state.history = state.history[1:]
+		}
+		if n.MaxPerHour > 0 && len(state.history) >= n.MaxPerHour {
+			if !state.deferred {
+				log.Printf("Notify %s: rate limit of %d per hour reached, deferring %d alerts", state.channel.Name(), n.MaxPerHour, len(alerts))
+				state.deferred = true
+			}
+			continue
+		}
+		sort.Slice(alerts, func(i, j int) bool { return alerts[i].key() < alerts[j].key() })
+		notification := Notification{Instance: n.exporter.Instance, Alerts: alerts}
+		for _, alert := range alerts {
+			if alert.Status == alertStatusFiring {
+				notification.Firing++
+			} else {
+				notification.Resolved++
+			}
+		}
+		state.sending = make(map[string]bool)
+		for _, alert := range alerts {
+			state.sending[alert.key()] = true
+		}
+		n.inflight++
+		go n.send(state, notification, now)
+	}
+	n.forget()
+}
+
+// send delivers a notification to a channel and records what was sent
+func (n *Notifier) send(state *channelState, notification Notification, now time.Time) {
+	err := state.channel.Send(notification)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	state.sending = nil
+	if n.inflight--; n.inflight == 0 {
+		n.idle.Broadcast()
+	}
+	// a failed notification is sent again with the next evaluation
+	if err != nil {
+		log.Printf("Notify %s: %v", state.channel.Name(), err)
+		return
+	}
+	state.history = append(state.history, now)
+	state.deferred = false
+	for _, alert := range notification.Alerts {
+		state.sent[alert.key()] = alert.Status
+		state.sentAt[alert.key()] = now
+	}
+	n.forget()
+}
+
+// forget drops the resolved alerts once every channel was told, or that never fired to any channel. An alert in a
+// notification on its way is kept, as the channel may yet learn that it fired
+func (n *Notifier) forget() {
+	for key, alert := range n.alerts {
+		if alert.Status != alertStatusResolved {
+			continue
+		}
+		pending := false
+		for _, state := range n.channels {
+			if state.sent[key] == alertStatusFiring || state.sending[key] {
+				pending = true
+			}
+		}
+		if !pending {
+			delete(n.alerts, key)
+			for _, state := range n.channels {
+				delete(state.sent, key)
+				delete(state.sentAt, key)
+			}
+		}
+	}
+}
+
+// Flush waits until the notifications on their way are sent, or ctx is done
+func (n *Notifier) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		n.mu.Lock()
+		for n.inflight > 0 {
+			n.idle.Wait()
+		}
+		n.mu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WebhookChannel posts the notifications as JSON to a URL
+type WebhookChannel struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookChannel builds a WebhookChannel for url
+func NewWebhookChannel(url string) *WebhookChannel {
+	return &WebhookChannel{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Name identifies the channel in the logs
+func (c *WebhookChannel) Name() string {
+	return "webhook"
+}
+
+// Send posts the notification
+func (c *WebhookChannel) Send(notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	res, err := c.client.Post(c.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("Status code: %d %s", res.StatusCode, res.Status)
+	}
+	return nil
+}
+
+// SMTPChannel mails the notifications
+type SMTPChannel struct {
+	server string
+	from   string
+	to     []string
+	auth   smtp.Auth
+	// timeout bounds the whole conversation with the server
+	timeout time.Duration
+}
+
+// NewSMTPChannel builds an SMTPChannel for the server at host:port, authenticating when username is set
+func NewSMTPChannel(server string, from string, to []string, username string, password string) *SMTPChannel {
+	c := &SMTPChannel{server: server, from: from, to: to, timeout: 30 * time.Second}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(server)
+		c.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return c
+}
+
+// Name identifies the channel in the logs
+func (c *SMTPChannel) Name() string {
+	return "SMTP"
+}
+
+// Send mails the notification as plain text, using STARTTLS when the server offers it
+func (c *SMTPChannel) Send(notification Notification) error {
+	var subject []string
+	if notification.Firing > 0 {
+		subject = append(subject, fmt.Sprintf("%d firing", notification.Firing))
+	}
+	if notification.Resolved > 0 {
+		subject = append(subject, fmt.Sprintf("%d resolved", notification.Resolved))
+	}
+	var body strings.Builder
+	for _, alert := range notification.Alerts {
+		fmt.Fprintf(&body, "[%s] %s: %s\r\n", strings.ToUpper(alert.Status), alert.Rule, alert.Summary)
+		fmt.Fprintf(&body, "    since %s", alert.StartsAt.Format(time.RFC1123Z))
+		if alert.EndsAt != nil {
+			fmt.Fprintf(&body, ", resolved %s", alert.EndsAt.Format(time.RFC1123Z))
+		}
+		body.WriteString("\r\n\r\n")
+	}
+	msg := "From: " + c.from + "\r\n" +
+		"To: " + strings.Join(c.to, ", ") + "\r\n" +
+		"Subject: [zhone-exporter] " + strings.Join(subject, ", ") + " on " + notification.Instance + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + body.String()
+	return c.sendMail([]byte(msg))
+}
+
+// sendMail delivers msg as smtp.SendMail does, within the timeout of the channel
+func (c *SMTPChannel) sendMail(msg []byte) error {
+	conn, err := (&net.Dialer{Timeout: c.timeout}).Dial("tcp", c.server)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	host, _, _ := net.SplitHostPort(c.server)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if c.auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("SMTP server doesn't support AUTH")
+		}
+		if err := client.Auth(c.auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(c.from); err != nil {
+		return err
+	}
+	for _, to := range c.to {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
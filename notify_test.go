@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flush waits for the notifications on their way
+func flush(t *testing.T, n *Notifier) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := n.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNotifierWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var received []Notification
+	release := make(chan struct{})
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		var notification Notification
+		if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		received = append(received, notification)
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+
+	rx := -27.0
+	exporter := NewZhoneExporter("192.168.2.1", "user", "user")
+	exporter.Instance = "upstairs"
+	exporter.Transport = transportFunc(func() (*Snapshot, error) {
+		return &Snapshot{GPON: GPONData{ID: "eth0", Status: 1, RXPower: rx}}, nil
+	})
+	notifier := NewNotifier(exporter, NotifyRules{GPONRXPowerBelow: -25}, NewWebhookChannel(webhook.URL))
+
+	// the scrape doesn't wait for the webhook, nor does the notifier lock
+	scraped := make(chan error)
+	go func() {
+		_, err := exporter.Scrape()
+		scraped <- err
+	}()
+	select {
+	case err := <-scraped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the scrape waited for the webhook")
+	}
+	notifier.Configure(NotifyRules{GPONRXPowerBelow: -25}, time.Hour, 10)
+	close(release)
+	flush(t, notifier)
+
+	// an alert still firing is not sent again
+	exporter.Scrape()
+	flush(t, notifier)
+	rx = -20
+	exporter.Scrape()
+	flush(t, notifier)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("received %d notifications, want a firing and a resolved one: %+v", len(received), received)
+	}
+	firing, resolved := received[0], received[1]
+	if firing.Instance != "upstairs" || firing.Firing != 1 || len(firing.Alerts) != 1 || firing.Alerts[0].Rule != RuleGPONRXPowerLow ||
+		*firing.Alerts[0].Value != -27 || *firing.Alerts[0].Threshold != -25 {
+		t.Errorf("firing notification = %+v", firing)
+	}
+	if resolved.Resolved != 1 || len(resolved.Alerts) != 1 || resolved.Alerts[0].Status != alertStatusResolved || resolved.Alerts[0].EndsAt == nil {
+		t.Errorf("resolved notification = %+v", resolved)
+	}
+	if len(notifier.alerts) != 0 {
+		t.Errorf("%d alerts kept after they resolved", len(notifier.alerts))
+	}
+}
+
+func TestNotifierRetry(t *testing.T) {
+	var mu sync.Mutex
+	status := http.StatusInternalServerError
+	requests := 0
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		w.WriteHeader(status)
+	}))
+	defer webhook.Close()
+
+	exporter := NewZhoneExporter("gateway", "user", "user")
+	exporter.Transport = transportFunc(func() (*Snapshot, error) {
+		return &Snapshot{Interfaces: []InterfaceData{{ID: "eth1", Name: "LAN1", Status: 0}}}, nil
+	})
+	notifier := NewNotifier(exporter, NotifyRules{InterfacesDown: []string{"eth1"}}, NewWebhookChannel(webhook.URL))
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			mu.Lock()
+			status = http.StatusOK
+			mu.Unlock()
+		}
+		exporter.Scrape()
+		flush(t, notifier)
+	}
+	exporter.Scrape()
+	flush(t, notifier)
+	mu.Lock()
+	defer mu.Unlock()
+	// two failures, the successful retry, and nothing once it went through
+	if requests != 3 {
+		t.Errorf("got %d webhook requests, want 3", requests)
+	}
+}
+
+// fakeSMTP serves a single SMTP session, advertising AUTH PLAIN, and returns the transcript of the client's commands
+func fakeSMTP(t *testing.T) (string, <-chan []string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	transcript := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var lines []string
+		defer func() { transcript <- lines }()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 mail.example.com ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			lines = append(lines, line)
+			switch command := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); command {
+			case "EHLO":
+				reply("250-mail.example.com")
+				reply("250 AUTH PLAIN")
+			case "AUTH":
+				reply("235 2.7.0 Authentication successful")
+			case "MAIL", "RCPT":
+				reply("250 2.1.0 Ok")
+			case "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					lines = append(lines, strings.TrimRight(line, "\r\n"))
+				}
+				reply("250 2.0.0 Ok: queued")
+			case "QUIT":
+				reply("221 2.0.0 Bye")
+				return
+			default:
+				reply("502 5.5.2 Error: command not recognized")
+			}
+		}
+	}()
+	return listener.Addr().String(), transcript
+}
+
+func TestSMTPChannel(t *testing.T) {
+	address, transcript := fakeSMTP(t)
+	channel := NewSMTPChannel(address, "exporter@example.com", []string{"ops@example.com", "noc@example.com"}, "alerts", "secret")
+	starts := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	err := channel.Send(Notification{Instance: "gateway", Firing: 1, Alerts: []Alert{{
+		Rule: RuleInterfaceDown, Subject: "eth1", Status: alertStatusFiring, Summary: "Interface eth1 (LAN1) is down", StartsAt: starts,
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := <-transcript
+	session := strings.Join(lines, "\n")
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00alerts\x00secret"))
+	for _, want := range []string{
+		"AUTH PLAIN " + credentials,
+		"MAIL FROM:<exporter@example.com>",
+		"RCPT TO:<ops@example.com>",
+		"RCPT TO:<noc@example.com>",
+		"Subject: [zhone-exporter] 1 firing on gateway",
+		"[FIRING] interface_down: Interface eth1 (LAN1) is down",
+		"    since " + starts.Format(time.RFC1123Z),
+		"QUIT",
+	} {
+		if !strings.Contains(session, want) {
+			t.Errorf("SMTP session lacks %q:\n%s", want, session)
+		}
+	}
+}
+
+func TestSMTPChannelTimeout(t *testing.T) {
+	// a server that accepts the connection and never greets
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+	channel := NewSMTPChannel(listener.Addr().String(), "exporter@example.com", []string{"ops@example.com"}, "", "")
+	channel.timeout = 100 * time.Millisecond
+	start := time.Now()
+	if err := channel.Send(Notification{Instance: "gateway", Firing: 1}); err == nil {
+		t.Error("sent to a server that never answered")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("gave up after %s, want the timeout", elapsed)
+	}
+}
+
+// blockingChannel records the notifications, each Send waiting for a value on release
+type blockingChannel struct {
+	release chan struct{}
+
+	mu   sync.Mutex
+	sent []Notification
+}
+
+func (c *blockingChannel) Name() string {
+	return "blocking"
+}
+
+func (c *blockingChannel) Send(notification Notification) error {
+	<-c.release
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent = append(c.sent, notification)
+	return nil
+}
+
+func TestNotifierResolvedWhileSending(t *testing.T) {
+	status := 0.0
+	exporter := NewZhoneExporter("gateway", "user", "user")
+	exporter.Transport = transportFunc(func() (*Snapshot, error) {
+		return &Snapshot{Interfaces: []InterfaceData{{ID: "eth1", Name: "LAN1", Status: status}}}, nil
+	})
+	channel := &blockingChannel{release: make(chan struct{})}
+	notifier := NewNotifier(exporter, NotifyRules{InterfacesDown: []string{"eth1"}}, channel)
+	release := func() {
+		t.Helper()
+		select {
+		case channel.release <- struct{}{}:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no notification was sent")
+		}
+	}
+
+	// the interface comes back while the firing notification is still on its way
+	exporter.Scrape()
+	status = 1
+	exporter.Scrape()
+	release()
+	flush(t, notifier)
+	// the next evaluation tells the channel it resolved
+	exporter.Scrape()
+	release()
+	flush(t, notifier)
+	// and a new outage is notified again
+	status = 0
+	exporter.Scrape()
+	release()
+	flush(t, notifier)
+
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	var got []string
+	for _, notification := range channel.sent {
+		got = append(got, notification.Alerts[0].Status)
+	}
+	if want := []string{alertStatusFiring, alertStatusResolved, alertStatusFiring}; !reflect.DeepEqual(got, want) {
+		t.Errorf("notifications %v, want %v", got, want)
+	}
+}
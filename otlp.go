@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const otlpGRPCPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// otlpInstrument is how a cpe_* metric family is represented in OpenTelemetry
+type otlpInstrument struct {
+	unit string
+	// sum marks the families that are counters, even though the exporter exposes them as gauges
+	sum bool
+}
+
+// otlpInstruments maps the cpe_* metric families to OTel instruments with UCUM units
+var otlpInstruments = map[string]otlpInstrument{
+	"cpe_up":                                  {"1", false},
+	"cpe_if_status":                           {"1", false},
+	"cpe_if_speed":                            {"Mbit/s", false},
+	"cpe_receive_bytes":                       {"By", true},
+	"cpe_transmit_bytes":                      {"By", true},
+	"cpe_receive_frames":                      {"{frame}", true},
+	"cpe_transmit_frames":                     {"{frame}", true},
+	"cpe_receive_drops":                       {"{frame}", true},
+	"cpe_transmit_drops":                      {"{frame}", true},
+	"cpe_receive_errors":                      {"{error}", true},
+	"cpe_transmit_errors":                     {"{error}", true},
+	"cpe_gpon_receive_power":                  {"dBm", false},
+	"cpe_gpon_transmit_power":                 {"dBm", false},
+	"cpe_gpon_up_transitions":                 {"{transition}", true},
+	"cpe_ethernet_link_state":                 {"1", false},
+	"cpe_ethernet_speed_bits_per_second":      {"bit/s", false},
+	"cpe_ethernet_port_info":                  {"1", false},
+	"cpe_lan_host_info":                       {"1", false},
+	"cpe_lan_hosts":                           {"{host}", false},
+	"cpe_wan_info":                            {"1", false},
+	"cpe_wan_connection_up":                   {"1", false},
+	"cpe_wan_uptime_seconds":                  {"s", false},
+	"cpe_upnp_up":                             {"1", false},
+	"cpe_upnp_receive_bytes":                  {"By", true},
+	"cpe_upnp_transmit_bytes":                 {"By", true},
+	"cpe_upnp_receive_packets":                {"{packet}", true},
+	"cpe_upnp_transmit_packets":               {"{packet}", true},
+	"cpe_upnp_link_up":                        {"1", false},
+	"cpe_upnp_upstream_max_bits_per_second":   {"bit/s", false},
+	"cpe_upnp_downstream_max_bits_per_second": {"bit/s", false},
+	"cpe_wifi_client_info":                    {"1", false},
+	"cpe_wifi_time_associated":                {"s", false},
+	"cpe_wifi_transmit_frames":                {"{frame}", true},
+	"cpe_wifi_transmit_unicast_frames":        {"{frame}", true},
+	"cpe_wifi_transmit_errors":                {"{error}", true},
+	"cpe_wifi_transmit_retries":               {"{retry}", true},
+	"cpe_wifi_transmit_rate":                  {"Mbit/s", false},
+	"cpe_wifi_transmit_retry_rate":            {"1", false},
+	"cpe_wifi_receive_unicast_frames":         {"{frame}", true},
+	"cpe_wifi_receive_broadcast_frames":       {"{frame}", true},
+	"cpe_wifi_receive_rate":                   {"Mbit/s", false},
+	"cpe_wifi_rssi":                           {"dBm", false},
+	"cpe_wifi_noise":                          {"dBm", false},
+	"cpe_wifi_snr":                            {"dB", false},
+	"cpe_wifi_quality":                        {"%", false},
+	"cpe_tr069_last_inform_timestamp_seconds": {"s", false},
+	"cpe_tr069_device_info":                   {"1", false},
+}
+
+// appendOTLPKeyValue appends a KeyValue with a string AnyValue as field num
+func appendOTLPKeyValue(b []byte, num protowire.Number, key string, value string) []byte {
+	var anyValue []byte
+	anyValue = protowire.AppendTag(anyValue, 1, protowire.BytesType)
+	anyValue = protowire.AppendString(anyValue, value)
+	var kv []byte
+	kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+	kv = protowire.AppendString(kv, key)
+	kv = protowire.AppendTag(kv, 2, protowire.BytesType)
+	kv = protowire.AppendBytes(kv, anyValue)
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, kv)
+}
+
+// otlpSeries is the last sample of a cumulative series
+type otlpSeries struct {
+	start time.Time
+	value float64
+	time  time.Time
+}
+
+// otlpStartTimes keeps the start time of the cumulative series, which restart when the gateway counters reset
+type otlpStartTimes struct {
+	start  time.Time
+	series map[string]otlpSeries
+}
+
+// newOTLPStartTimes starts the series first seen after start at start
+func newOTLPStartTimes(start time.Time) *otlpStartTimes {
+	return &otlpStartTimes{start: start, series: make(map[string]otlpSeries)}
+}
+
+// observe records value for the series key and returns its start time, moved past the previous sample when the value went down
+func (s *otlpStartTimes) observe(key string, value float64, now time.Time) time.Time {
+	series, ok := s.series[key]
+	if !ok {
+		series.start = s.start
+	} else if value < series.value {
+		// the counter was reset, at the earliest right after the previous sample
+		series.start = series.time
+	}
+	series.value, series.time = value, now
+	s.series[key] = series
+	return series.start
+}
+
+// prune forgets the series that were not observed at now
+func (s *otlpStartTimes) prune(now time.Time) {
+	for key, series := range s.series {
+		if !series.time.Equal(now) {
+			delete(s.series, key)
+		}
+	}
+}
+
+// EncodeOTLPMetrics marshals the cpe_* metric families into an ExportMetricsServiceRequest protobuf, with one ResourceMetrics per instance label
+func EncodeOTLPMetrics(families []*dto.MetricFamily, resource func(instance string) []Tag, starts *otlpStartTimes, now time.Time) []byte {
+	scopes := make(map[string][]byte)
+	var instances []string
+	for _, family := range families {
+		name := family.GetName()
+		if !strings.HasPrefix(name, "cpe_") {
+			continue
+		}
+		instrument, ok := otlpInstruments[name]
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			instrument.sum = true
+			if !ok {
+				instrument.unit = "1"
+			}
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+		default:
+			continue
+		}
+		points := make(map[string][]byte)
+		var order []string
+		for _, metric := range family.GetMetric() {
+			var value float64
+			switch {
+			case metric.Counter != nil:
+				value = metric.GetCounter().GetValue()
+			case metric.Gauge != nil:
+				value = metric.GetGauge().GetValue()
+			default:
+				value = metric.GetUntyped().GetValue()
+			}
+			var instance string
+			var point []byte
+			key := name
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "instance" {
+					instance = label.GetValue()
+				}
+				point = appendOTLPKeyValue(point, 7, label.GetName(), label.GetValue())
+				key += "\xff" + label.GetName() + "\xff" + label.GetValue()
+			}
+			if instrument.sum {
+				point = protowire.AppendTag(point, 2, protowire.Fixed64Type)
+				point = protowire.AppendFixed64(point, uint64(starts.observe(key, value, now).UnixNano()))
+			}
+			point = protowire.AppendTag(point, 3, protowire.Fixed64Type)
+			point = protowire.AppendFixed64(point, uint64(now.UnixNano()))
+			point = protowire.AppendTag(point, 4, protowire.Fixed64Type)
+			point = protowire.AppendFixed64(point, math.Float64bits(value))
+			if _, ok := points[instance]; !ok {
+				order = append(order, instance)
+			}
+			points[instance] = protowire.AppendTag(points[instance], 1, protowire.BytesType)
+			points[instance] = protowire.AppendBytes(points[instance], point)
+		}
+		for _, instance := range order {
+			data := points[instance]
+			var m []byte
+			m = protowire.AppendTag(m, 1, protowire.BytesType)
+			m = protowire.AppendString(m, name)
+			m = protowire.AppendTag(m, 2, protowire.BytesType)
+			m = protowire.AppendString(m, family.GetHelp())
+			m = protowire.AppendTag(m, 3, protowire.BytesType)
+			m = protowire.AppendString(m, instrument.unit)
+			if instrument.sum {
+				// cumulative temporality, monotonic
+				data = protowire.AppendTag(data, 2, protowire.VarintType)
+				data = protowire.AppendVarint(data, 2)
+				data = protowire.AppendTag(data, 3, protowire.VarintType)
+				data = protowire.AppendVarint(data, 1)
+				m = protowire.AppendTag(m, 7, protowire.BytesType)
+			} else {
+				m = protowire.AppendTag(m, 5, protowire.BytesType)
+			}
+			m = protowire.AppendBytes(m, data)
+			if _, ok := scopes[instance]; !ok {
+				instances = append(instances, instance)
+			}
+			scopes[instance] = protowire.AppendTag(scopes[instance], 2, protowire.BytesType)
+			scopes[instance] = protowire.AppendBytes(scopes[instance], m)
+		}
+	}
+	starts.prune(now)
+	sort.Strings(instances)
+
+	var scopeInfo []byte
+	scopeInfo = protowire.AppendTag(scopeInfo, 1, protowire.BytesType)
+	scopeInfo = protowire.AppendString(scopeInfo, "github.com/Ichabond/zhone-exporter")
+	var req []byte
+	for _, instance := range instances {
+		var scope []byte
+		scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+		scope = protowire.AppendBytes(scope, scopeInfo)
+		scope = append(scope, scopes[instance]...)
+		var res []byte
+		for _, attribute := range resource(instance) {
+			res = appendOTLPKeyValue(res, 1, attribute.Key, attribute.Value)
+		}
+		var rm []byte
+		rm = protowire.AppendTag(rm, 1, protowire.BytesType)
+		rm = protowire.AppendBytes(rm, res)
+		rm = protowire.AppendTag(rm, 2, protowire.BytesType)
+		rm = protowire.AppendBytes(rm, scope)
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, rm)
+	}
+	return req
+}
+
+// OTLPExporter periodically exports the cpe_* metrics to an OpenTelemetry Collector over OTLP/gRPC or OTLP/HTTP
+type OTLPExporter struct {
+	gatherer prometheus.Gatherer
+	url      string
+	grpc     bool
+	headers  map[string]string
+	client   *http.Client
+	// target is the instance label of the gateway given on the command line, the only one identified by its device information
+	target string
+	starts *otlpStartTimes
+	// fetchDevice identifies the gateway for the resource attributes, nil when only the defaults are known
+	fetchDevice func() (DeviceInfo, error)
+	device      *DeviceInfo
+}
+
+// NewOTLPExporter builds an OTLPExporter for endpoint, with protocol grpc or http/protobuf and headers as key=value pairs separated by commas
+func NewOTLPExporter(gatherer prometheus.Gatherer, endpoint string, protocol string, headers string, target string, fetchDevice func() (DeviceInfo, error)) (*OTLPExporter, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	o := &OTLPExporter{
+		gatherer:    gatherer,
+		headers:     make(map[string]string),
+		target:      target,
+		starts:      newOTLPStartTimes(time.Now()),
+		fetchDevice: fetchDevice,
+	}
+	for _, header := range strings.Split(headers, ",") {
+		if kv := strings.SplitN(header, "=", 2); len(kv) == 2 {
+			o.headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	switch protocol {
+	case "grpc":
+		o.grpc = true
+		u.Path = otlpGRPCPath
+		transport := &http2.Transport{}
+		if u.Scheme == "http" {
+			// gRPC without TLS is HTTP/2 with prior knowledge
+			transport.AllowHTTP = true
+			transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			}
+		}
+		o.client = &http.Client{Transport: transport, Timeout: 30 * time.Second}
+	case "http/protobuf":
+		if !strings.HasSuffix(u.Path, "/v1/metrics") {
+			u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/metrics"
+		}
+		o.client = &http.Client{Timeout: 30 * time.Second}
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q, expected grpc or http/protobuf", protocol)
+	}
+	o.url = u.String()
+	return o, nil
+}
+
+// resource returns the resource attributes of the metrics of instance, identifying the command line gateway once its device information could be retrieved
+func (o *OTLPExporter) resource(instance string) []Tag {
+	resource := []Tag{{"service.name", "zhone-exporter"}}
+	if instance == "" {
+		return resource
+	}
+	resource = append(resource, Tag{"server.address", instance})
+	if instance != o.target {
+		return resource
+	}
+	if o.device == nil {
+		if o.fetchDevice == nil {
+			o.device = &DeviceInfo{Manufacturer: "Zhone", Model: defaultModel}
+		} else if device, err := o.fetchDevice(); err == nil {
+			o.device = &device
+		} else {
+			log.Printf("OTLP: unable to fetch device information: %v", err)
+		}
+	}
+	if o.device != nil {
+		for _, attribute := range []Tag{
+			{"device.manufacturer", o.device.Manufacturer},
+			{"device.model.identifier", o.device.Model},
+			{"device.id", o.device.SerialNumber},
+			{"device.software_version", o.device.SoftwareVersion},
+		} {
+			if attribute.Value != "" {
+				resource = append(resource, attribute)
+			}
+		}
+	}
+	return resource
+}
+
+// Export collects the metrics once and sends them to the collector
+func (o *OTLPExporter) Export() error {
+	now := time.Now()
+	families, err := o.gatherer.Gather()
+	if err != nil {
+		log.Printf("OTLP: %v", err)
+	}
+	body := EncodeOTLPMetrics(families, o.resource, o.starts, now)
+	contentType := "application/x-protobuf"
+	if o.grpc {
+		// gRPC message framing: uncompressed flag and big endian length
+		frame := make([]byte, 5, 5+len(body))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(body)))
+		body = append(frame, body...)
+		contentType = "application/grpc"
+	}
+	req, err := http.NewRequest(http.MethodPost, o.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if o.grpc {
+		req.Header.Set("TE", "trailers")
+	}
+	for key, value := range o.headers {
+		req.Header.Set(key, value)
+	}
+	res, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	response, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(response))
+	}
+	if o.grpc {
+		// trailers-only responses carry the status in the headers
+		status, message := res.Trailer.Get("Grpc-Status"), res.Trailer.Get("Grpc-Message")
+		if status == "" {
+			status, message = res.Header.Get("Grpc-Status"), res.Header.Get("Grpc-Message")
+		}
+		if status != "0" {
+			message, _ = url.PathUnescape(message)
+			return fmt.Errorf("gRPC status %s: %s", status, message)
+		}
+	}
+	return nil
+}
+
+// Run exports the metrics every interval
+func (o *OTLPExporter) Run(interval time.Duration) {
+	for {
+		if err := o.Export(); err != nil {
+			log.Printf("OTLP: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpGateways registers the metrics of two gateways and a metric of the exporter itself
+func otlpGateways() (*prometheus.Registry, *prometheus.GaugeVec) {
+	registry := prometheus.NewRegistry()
+	rxBytes := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "cpe_receive_bytes", Help: "Received bytes"}, []string{"instance", "interface"})
+	up := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "cpe_up", Help: "Gateway reachable"}, []string{"instance"})
+	errors := prometheus.NewCounter(prometheus.CounterOpts{Name: "cpe_exporter_parse_errors_total", Help: "Parse errors"})
+	ignored := prometheus.NewGauge(prometheus.GaugeOpts{Name: "go_goroutines_test", Help: "Not a cpe_* metric"})
+	registry.MustRegister(rxBytes, up, errors, ignored)
+	rxBytes.WithLabelValues("192.168.1.1", "eth0").Set(1000)
+	rxBytes.WithLabelValues("upstairs", "eth0").Set(500)
+	up.WithLabelValues("192.168.1.1").Set(1)
+	up.WithLabelValues("upstairs").Set(1)
+	errors.Add(2)
+	return registry, rxBytes
+}
+
+// decodeOTLP unmarshals an ExportMetricsServiceRequest and indexes its resources by server.address
+func decodeOTLP(t *testing.T, body []byte) map[string]*metricspb.ResourceMetrics {
+	t.Helper()
+	var req colmetricspb.ExportMetricsServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	resources := make(map[string]*metricspb.ResourceMetrics)
+	for _, rm := range req.GetResourceMetrics() {
+		address := ""
+		for _, attribute := range rm.GetResource().GetAttributes() {
+			if attribute.GetKey() == "server.address" {
+				address = attribute.GetValue().GetStringValue()
+			}
+		}
+		if _, ok := resources[address]; ok {
+			t.Fatalf("resource %q repeated", address)
+		}
+		resources[address] = rm
+	}
+	return resources
+}
+
+// otlpAttributes returns the resource attributes as a map
+func otlpAttributes(rm *metricspb.ResourceMetrics) map[string]string {
+	attributes := make(map[string]string)
+	for _, attribute := range rm.GetResource().GetAttributes() {
+		attributes[attribute.GetKey()] = attribute.GetValue().GetStringValue()
+	}
+	return attributes
+}
+
+// otlpMetric returns the metric called name of a resource
+func otlpMetric(t *testing.T, rm *metricspb.ResourceMetrics, name string) *metricspb.Metric {
+	t.Helper()
+	for _, scope := range rm.GetScopeMetrics() {
+		for _, metric := range scope.GetMetrics() {
+			if metric.GetName() == name {
+				return metric
+			}
+		}
+	}
+	t.Fatalf("no %s metric", name)
+	return nil
+}
+
+func TestEncodeOTLPMetrics(t *testing.T) {
+	registry, rxBytes := otlpGateways()
+	start := time.Unix(1700000000, 0)
+	starts := newOTLPStartTimes(start)
+	resource := func(instance string) []Tag {
+		if instance == "" {
+			return []Tag{{"service.name", "zhone-exporter"}}
+		}
+		return []Tag{{"service.name", "zhone-exporter"}, {"server.address", instance}}
+	}
+	encode := func(now time.Time) map[string]*metricspb.ResourceMetrics {
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decodeOTLP(t, EncodeOTLPMetrics(families, resource, starts, now))
+	}
+
+	first := start.Add(time.Minute)
+	resources := encode(first)
+	if len(resources) != 3 {
+		t.Fatalf("got %d resources, want one per gateway and one for the exporter", len(resources))
+	}
+	for address, rm := range resources {
+		for _, scope := range rm.GetScopeMetrics() {
+			for _, metric := range scope.GetMetrics() {
+				if !strings.HasPrefix(metric.GetName(), "cpe_") {
+					t.Errorf("%s exported", metric.GetName())
+				}
+				if address == "" && metric.GetName() != "cpe_exporter_parse_errors_total" {
+					t.Errorf("%s exported without an instance", metric.GetName())
+				}
+			}
+		}
+	}
+	if got, want := otlpAttributes(resources[""]), map[string]string{"service.name": "zhone-exporter"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("exporter resource %v, want %v", got, want)
+	}
+
+	received := otlpMetric(t, resources["upstairs"], "cpe_receive_bytes")
+	if received.GetUnit() != "By" {
+		t.Errorf("unit %q, want By", received.GetUnit())
+	}
+	sum := received.GetSum()
+	if sum == nil {
+		t.Fatalf("cpe_receive_bytes is not a sum: %v", received)
+	}
+	if sum.GetAggregationTemporality() != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE || !sum.GetIsMonotonic() {
+		t.Errorf("sum temporality %v monotonic %v, want a cumulative monotonic sum", sum.GetAggregationTemporality(), sum.GetIsMonotonic())
+	}
+	if len(sum.GetDataPoints()) != 1 {
+		t.Fatalf("got %d data points for upstairs, want 1", len(sum.GetDataPoints()))
+	}
+	point := sum.GetDataPoints()[0]
+	if point.GetAsDouble() != 500 || point.GetStartTimeUnixNano() != uint64(start.UnixNano()) || point.GetTimeUnixNano() != uint64(first.UnixNano()) {
+		t.Errorf("data point %v, want 500 from the exporter start", point)
+	}
+	if gauge := otlpMetric(t, resources["192.168.1.1"], "cpe_up").GetGauge(); gauge == nil || gauge.GetDataPoints()[0].GetAsDouble() != 1 {
+		t.Errorf("cpe_up is not a gauge of 1: %v", gauge)
+	}
+	if errors := otlpMetric(t, resources[""], "cpe_exporter_parse_errors_total").GetSum(); errors == nil || errors.GetDataPoints()[0].GetAsDouble() != 2 {
+		t.Errorf("counter is not a sum of 2: %v", errors)
+	}
+
+	// a gateway reboot resets its counters, starting a new series after the previous sample
+	rxBytes.WithLabelValues("192.168.1.1", "eth0").Set(1500)
+	rxBytes.WithLabelValues("upstairs", "eth0").Set(20)
+	second := first.Add(time.Minute)
+	resources = encode(second)
+	for address, want := range map[string]time.Time{"192.168.1.1": start, "upstairs": first} {
+		point := otlpMetric(t, resources[address], "cpe_receive_bytes").GetSum().GetDataPoints()[0]
+		if point.GetStartTimeUnixNano() != uint64(want.UnixNano()) {
+			t.Errorf("%s starts at %d, want %d", address, point.GetStartTimeUnixNano(), want.UnixNano())
+		}
+	}
+	rxBytes.WithLabelValues("upstairs", "eth0").Set(80)
+	third := second.Add(time.Minute)
+	resources = encode(third)
+	if point := otlpMetric(t, resources["upstairs"], "cpe_receive_bytes").GetSum().GetDataPoints()[0]; point.GetStartTimeUnixNano() != uint64(first.UnixNano()) {
+		t.Errorf("the restarted series moved its start to %d", point.GetStartTimeUnixNano())
+	}
+
+	// a series that disappears is forgotten
+	rxBytes.DeleteLabelValues("upstairs", "eth0")
+	encode(third.Add(time.Minute))
+	if len(starts.series) != 2 {
+		t.Errorf("%d series tracked, want 2", len(starts.series))
+	}
+}
+
+// otlpDevice is the device information of the command line gateway
+func otlpDevice() (DeviceInfo, error) {
+	return DeviceInfo{Manufacturer: "Zhone", Model: "ZNID-GPON-2426A1", SerialNumber: "ZNTS12345678", SoftwareVersion: "S3.1.241"}, nil
+}
+
+// checkOTLPResources checks that only the resource of the command line gateway carries the device attributes
+func checkOTLPResources(t *testing.T, resources map[string]*metricspb.ResourceMetrics) {
+	t.Helper()
+	want := map[string]map[string]string{
+		"": {"service.name": "zhone-exporter"},
+		"192.168.1.1": {
+			"service.name":            "zhone-exporter",
+			"server.address":          "192.168.1.1",
+			"device.manufacturer":     "Zhone",
+			"device.model.identifier": "ZNID-GPON-2426A1",
+			"device.id":               "ZNTS12345678",
+			"device.software_version": "S3.1.241",
+		},
+		"upstairs": {"service.name": "zhone-exporter", "server.address": "upstairs"},
+	}
+	if len(resources) != len(want) {
+		t.Errorf("got %d resources, want %d", len(resources), len(want))
+	}
+	for address, attributes := range want {
+		if got := otlpAttributes(resources[address]); !reflect.DeepEqual(got, attributes) {
+			t.Errorf("resource %q has attributes %v, want %v", address, got, attributes)
+		}
+	}
+}
+
+func TestOTLPExportHTTP(t *testing.T) {
+	registry, _ := otlpGateways()
+	requests := make(chan map[string]*metricspb.ResourceMetrics, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" {
+			t.Errorf("path %s, want /v1/metrics", r.URL.Path)
+		}
+		if r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("Content-Type %q", r.Header.Get("Content-Type"))
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Authorization %q", r.Header.Get("Authorization"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		requests <- decodeOTLP(t, body)
+		if strings.Contains(r.URL.RawQuery, "fail") {
+			http.Error(w, "rejected", http.StatusBadRequest)
+		}
+	}))
+	defer collector.Close()
+
+	exporter, err := NewOTLPExporter(registry, collector.URL, "http/protobuf", "authorization=Bearer secret", "192.168.1.1", otlpDevice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exporter.Export(); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	checkOTLPResources(t, <-requests)
+
+	exporter.url += "?fail"
+	if err := exporter.Export(); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("export to a failing collector returned %v", err)
+	}
+	<-requests
+}
+
+func TestOTLPExportGRPC(t *testing.T) {
+	registry, _ := otlpGateways()
+	requests := make(chan map[string]*metricspb.ResourceMetrics, 1)
+	var status atomic.Value
+	status.Store("0")
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("protocol %s, want HTTP/2", r.Proto)
+		}
+		if r.URL.Path != otlpGRPCPath || r.Header.Get("Content-Type") != "application/grpc" || r.Header.Get("TE") != "trailers" {
+			t.Errorf("request to %s with headers %v", r.URL.Path, r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+			t.Errorf("bad gRPC frame of %d bytes", len(body))
+			return
+		}
+		requests <- decodeOTLP(t, body[5:])
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		response, _ := proto.Marshal(&colmetricspb.ExportMetricsServiceResponse{})
+		frame := make([]byte, 5, 5+len(response))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(response)))
+		w.Write(append(frame, response...))
+		w.Header().Set("Grpc-Status", status.Load().(string))
+		if status.Load() != "0" {
+			w.Header().Set("Grpc-Message", "invalid%20token")
+		}
+	})
+	collector := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer collector.Close()
+
+	exporter, err := NewOTLPExporter(registry, strings.TrimPrefix(collector.URL, "http://"), "grpc", "", "192.168.1.1", otlpDevice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exporter.Export(); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	checkOTLPResources(t, <-requests)
+
+	status.Store("16")
+	if err := exporter.Export(); err == nil || err.Error() != "gRPC status 16: invalid token" {
+		t.Errorf("export to a collector refusing the request returned %v", err)
+	}
+	<-requests
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	_ "embed"
+)
+
+// embeddedOUI is a snapshot of the IEEE MA-L registry, in the same CSV format as http://standards-oui.ieee.org/oui/oui.csv
+//
+//go:embed oui.csv
+var embeddedOUI []byte
+
+// OUIDatabase maps the 24 bit Organizationally Unique Identifier of a MAC address to the vendor it is assigned to
+type OUIDatabase struct {
+	vendors map[[3]byte]string
+}
+
+var (
+	embeddedDatabase     *OUIDatabase
+	embeddedDatabaseOnce sync.Once
+)
+
+// NewOUIDatabase returns the OUI database built into the exporter. It is parsed once and shared, as it is never modified
+func NewOUIDatabase() *OUIDatabase {
+	embeddedDatabaseOnce.Do(func() {
+		db, err := ParseOUIDatabase(bytes.NewReader(embeddedOUI))
+		if err != nil {
+			// the embedded copy is part of the source tree, so this can only be a packaging error
+			panic(err)
+		}
+		embeddedDatabase = db
+	})
+	return embeddedDatabase
+}
+
+// LoadOUIDatabase reads an OUI database from a local copy of the IEEE oui.csv or oui.txt file
+func LoadOUIDatabase(path string) (*OUIDatabase, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	db, err := ParseOUIDatabase(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+// ParseOUIDatabase parses either of the formats the IEEE publishes the registry in, the CSV export or the plain text listing
+func ParseOUIDatabase(r io.Reader) (*OUIDatabase, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len("Registry,"))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	db := &OUIDatabase{vendors: make(map[[3]byte]string)}
+	if string(header) == "Registry," {
+		err = db.parseCSV(br)
+	} else {
+		err = db.parseText(br)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(db.vendors) == 0 {
+		return nil, fmt.Errorf("no OUI assignments found")
+	}
+	return db, nil
+}
+
+func (db *OUIDatabase) parseCSV(r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return err
+	}
+	// records[0] is the header: Registry,Assignment,Organization Name,Organization Address
+	for _, record := range records[1:] {
+		if len(record) < 3 || record[0] != "MA-L" {
+			continue
+		}
+		db.add(record[1], record[2])
+	}
+	return nil
+}
+
+func (db *OUIDatabase) parseText(r io.Reader) error {
+	// e.g. "00-00-0C   (hex)\t\tCisco Systems, Inc"
+	lineRE := regexp.MustCompile(`^([0-9A-Fa-f]{2})-([0-9A-Fa-f]{2})-([0-9A-Fa-f]{2})\s+\(hex\)\s+(.+)$`)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		match := lineRE.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if match == nil {
+			continue
+		}
+		db.add(match[1]+match[2]+match[3], match[4])
+	}
+	return scanner.Err()
+}
+
+func (db *OUIDatabase) add(assignment string, vendor string) {
+	prefix, err := hex.DecodeString(assignment)
+	if err != nil || len(prefix) != 3 {
+		return
+	}
+	db.vendors[[3]byte{prefix[0], prefix[1], prefix[2]}] = strings.TrimSpace(vendor)
+}
+
+// Lookup returns the vendor registered for the MAC address, or an empty string if it is unknown
+func (db *OUIDatabase) Lookup(mac net.HardwareAddr) string {
+	if len(mac) < 3 {
+		return ""
+	}
+	return db.vendors[[3]byte{mac[0], mac[1], mac[2]}]
+}
+
+// IsRandomizedMAC reports whether the locally administered bit is set on the MAC address.
+// Phones and laptops set it when they use a per-network random address, in which case the OUI does not identify the vendor
+func IsRandomizedMAC(mac net.HardwareAddr) bool {
+	return len(mac) > 0 && mac[0]&0x02 != 0
+}
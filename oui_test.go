@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const ouiCSV = `Registry,Assignment,Organization Name,Organization Address
+MA-L,3C22FB,"Apple, Inc.",1 Infinite Loop Cupertino CA US 95014
+MA-L,001A2B,Ayecom Technology Co.,"No. 25, R&D Road 2 Hsinchu TW 300"
+MA-M,70B3D5123,Not A Full Assignment,Somewhere
+`
+
+const ouiText = `OUI/MA-L                                                    Organization
+company_id                                                  Organization
+                                                            Address
+
+3C-22-FB   (hex)		Apple, Inc.
+3C22FB     (base 16)		Apple, Inc.
+				1 Infinite Loop
+				Cupertino  CA  95014
+				US
+
+00-1A-2B   (hex)		Ayecom Technology Co.
+001A2B     (base 16)		Ayecom Technology Co.
+`
+
+func TestParseOUIDatabase(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		input string
+	}{
+		{"csv", ouiCSV},
+		{"text", ouiText},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			db, err := ParseOUIDatabase(strings.NewReader(test.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(db.vendors) != 2 {
+				t.Errorf("got %d assignments, want 2", len(db.vendors))
+			}
+			for mac, want := range map[string]string{
+				"3c:22:fb:00:00:09": "Apple, Inc.",
+				"00:1a:2b:aa:bb:cc": "Ayecom Technology Co.",
+				"70:b3:d5:12:34:56": "",
+				"00:00:00:00:00:01": "",
+			} {
+				hwaddr, _ := net.ParseMAC(mac)
+				if got := db.Lookup(hwaddr); got != want {
+					t.Errorf("Lookup(%s) = %q, want %q", mac, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseOUIDatabaseEmpty(t *testing.T) {
+	for _, input := range []string{"", "Registry,Assignment,Organization Name,Organization Address\n", "not an OUI listing\n"} {
+		if _, err := ParseOUIDatabase(strings.NewReader(input)); err == nil {
+			t.Errorf("ParseOUIDatabase(%q) succeeded, want an error", input)
+		}
+	}
+}
+
+func TestLoadOUIDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "oui.txt")
+	if err := os.WriteFile(path, []byte(ouiText), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := LoadOUIDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := db.Lookup(net.HardwareAddr{0x3c, 0x22, 0xfb, 0, 0, 1}); got != "Apple, Inc." {
+		t.Errorf("Lookup = %q, want Apple, Inc.", got)
+	}
+	if _, err := LoadOUIDatabase(filepath.Join(t.TempDir(), "missing.csv")); err == nil {
+		t.Error("LoadOUIDatabase of a missing file succeeded")
+	}
+}
+
+func TestEmbeddedOUIDatabase(t *testing.T) {
+	db := NewOUIDatabase()
+	if len(db.vendors) < 1000 {
+		t.Errorf("embedded database has %d assignments", len(db.vendors))
+	}
+	if NewOUIDatabase() != db || NewZhoneExporter("gateway", "user", "user").OUI != db {
+		t.Error("the embedded database is parsed again")
+	}
+}
+
+func TestIsRandomizedMAC(t *testing.T) {
+	for mac, want := range map[string]bool{
+		"3c:22:fb:00:00:09": false,
+		"da:a1:19:00:00:01": true,
+		"02:00:00:00:00:00": true,
+		"00:1a:2b:aa:bb:cc": false,
+	} {
+		hwaddr, _ := net.ParseMAC(mac)
+		if got := IsRandomizedMAC(hwaddr); got != want {
+			t.Errorf("IsRandomizedMAC(%s) = %v, want %v", mac, got, want)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// walMaxRecords bounds the remote_write WAL to a day of 30 second pushes, the oldest records are dropped beyond it
+const walMaxRecords = 2880
+
+// remoteWriteSeries is a time series of a remote_write request, with its labels sorted by name
+type remoteWriteSeries struct {
+	labels    [][2]string
+	value     float64
+	timestamp int64
+}
+
+// GatheredSeries flattens the metric families gathered from the registry into time series, adding the job label
+func GatheredSeries(families []*dto.MetricFamily, job string, timestamp time.Time) []remoteWriteSeries {
+	var series []remoteWriteSeries
+	now := timestamp.UnixNano() / int64(time.Millisecond)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := [][2]string{{"job", job}}
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "job" {
+					labels[0][1] = label.GetValue()
+					continue
+				}
+				labels = append(labels, [2]string{label.GetName(), label.GetValue()})
+			}
+			ts := now
+			if metric.TimestampMs != nil {
+				ts = metric.GetTimestampMs()
+			}
+			add := func(name string, value float64, extra ...[2]string) {
+				l := append([][2]string{{"__name__", name}}, labels...)
+				l = append(l, extra...)
+				sort.Slice(l, func(i, j int) bool { return l[i][0] < l[j][0] })
+				series = append(series, remoteWriteSeries{labels: l, value: value, timestamp: ts})
+			}
+			name := family.GetName()
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, metric.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, q := range summary.GetQuantile() {
+					add(name, q.GetValue(), [2]string{"quantile", strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64)})
+				}
+				add(name+"_sum", summary.GetSampleSum())
+				add(name+"_count", float64(summary.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				for _, b := range histogram.GetBucket() {
+					add(name+"_bucket", float64(b.GetCumulativeCount()), [2]string{"le", strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)})
+				}
+				add(name+"_bucket", float64(histogram.GetSampleCount()), [2]string{"le", "+Inf"})
+				add(name+"_sum", histogram.GetSampleSum())
+				add(name+"_count", float64(histogram.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+// EncodeWriteRequest marshals the series into a snappy compressed prometheus.WriteRequest protobuf
+func EncodeWriteRequest(series []remoteWriteSeries) []byte {
+	var req []byte
+	for _, s := range series {
+		var ts []byte
+		for _, label := range s.labels {
+			var l []byte
+			l = protowire.AppendTag(l, 1, protowire.BytesType)
+			l = protowire.AppendString(l, label[0])
+			l = protowire.AppendTag(l, 2, protowire.BytesType)
+			l = protowire.AppendString(l, label[1])
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, l)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return snappy.Encode(nil, req)
+}
+
+// errRejected marks a remote_write request the receiver will never accept
+var errRejected = errors.New("rejected")
+
+// RemoteWriter sends gathered samples with the Prometheus remote_write protocol, keeping them in a WAL while the receiver is unavailable
+type RemoteWriter struct {
+	url     string
+	client  *http.Client
+	walPath string
+	// records are the encoded requests not sent yet, oldest first
+	records [][]byte
+}
+
+// NewRemoteWriter builds a RemoteWriter, replaying the requests left in the WAL directory by a previous run
+func NewRemoteWriter(url string, walDir string) (*RemoteWriter, error) {
+	w := &RemoteWriter{url: url, client: &http.Client{Timeout: 30 * time.Second}}
+	if walDir == "" {
+		return w, nil
+	}
+	if err := os.MkdirAll(walDir, 0700); err != nil {
+		return nil, err
+	}
+	w.walPath = filepath.Join(walDir, "remote_write.wal")
+	records, err := readWAL(w.walPath)
+	if err != nil {
+		return nil, err
+	}
+	w.records = records
+	if len(records) > 0 {
+		log.Printf("remote_write: %d requests pending in %s", len(records), w.walPath)
+	}
+	return w, nil
+}
+
+// readWAL reads the records of a WAL file, ignoring a torn record at its end
+func readWAL(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var records [][]byte
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			break
+		}
+		record := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		if _, err := io.ReadFull(r, record); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(record) != binary.BigEndian.Uint32(header[4:8]) {
+			log.Printf("remote_write: corrupt record in %s, skipping the rest", path)
+			break
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// appendWAL appends a record to the WAL file
+func (w *RemoteWriter) appendWAL(record []byte) error {
+	f, err := os.OpenFile(w.walPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(record))
+	if _, err := f.Write(append(header[:], record...)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rewriteWAL replaces the WAL file with the pending records
+func (w *RemoteWriter) rewriteWAL() error {
+	tmp := w.walPath + ".tmp"
+	var buf bytes.Buffer
+	for _, record := range w.records {
+		var header [8]byte
+		binary.BigEndian.PutUint32(header[0:4], uint32(len(record)))
+		binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(record))
+		buf.Write(header[:])
+		buf.Write(record)
+	}
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.walPath)
+}
+
+// send posts an encoded request to the receiver
+func (w *RemoteWriter) send(record []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(record))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	if res.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(body))
+	if res.StatusCode/100 == 4 && res.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: %v", errRejected, err)
+	}
+	return err
+}
+
+// Write queues the series and sends the pending requests oldest first, stopping at the first failure
+func (w *RemoteWriter) Write(series []remoteWriteSeries) error {
+	record := EncodeWriteRequest(series)
+	pending := len(w.records)
+	w.records = append(w.records, record)
+	dropped := 0
+	if len(w.records) > walMaxRecords {
+		dropped = len(w.records) - walMaxRecords
+		w.records = w.records[dropped:]
+		log.Printf("remote_write: WAL full, dropped %d requests", dropped)
+	}
+	sent := 0
+	var err error
+	for _, pending := range w.records {
+		if err = w.send(pending); err != nil && !errors.Is(err, errRejected) {
+			break
+		}
+		if err != nil {
+			log.Printf("remote_write: dropping request: %v", err)
+			err = nil
+		}
+		sent++
+	}
+	w.records = w.records[sent:]
+	if w.walPath != "" {
+		var walErr error
+		switch {
+		case sent == 0 && dropped == 0:
+			walErr = w.appendWAL(record)
+		case pending == 0 && len(w.records) == 0:
+			// the WAL was empty and still is
+		default:
+			walErr = w.rewriteWAL()
+		}
+		if walErr != nil {
+			log.Printf("remote_write: WAL: %v", walErr)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%v, %d requests pending", err, len(w.records))
+	}
+	return nil
+}
+
+// Pusher runs the collection on an interval and pushes the samples to remote_write and/or a Pushgateway
+type Pusher struct {
+	gatherer       prometheus.Gatherer
+	job            string
+	remote         *RemoteWriter
+	pushgatewayURL string
+}
+
+// NewPusher builds a Pusher for the metrics of gatherer, remote and pushgatewayURL are optional
+func NewPusher(gatherer prometheus.Gatherer, job string, remote *RemoteWriter, pushgatewayURL string) *Pusher {
+	return &Pusher{gatherer: gatherer, job: job, remote: remote, pushgatewayURL: pushgatewayURL}
+}
+
+// Push collects the metrics once and sends them to every destination
+func (p *Pusher) Push() {
+	now := time.Now()
+	families, err := p.gatherer.Gather()
+	if p.remote != nil {
+		if err != nil {
+			log.Printf("remote_write: %v", err)
+		}
+		if err := p.remote.Write(GatheredSeries(families, p.job, now)); err != nil {
+			log.Printf("remote_write: %v", err)
+		}
+	}
+	// the Pushgateway only keeps the latest samples, so they are not buffered
+	if p.pushgatewayURL != "" {
+		gathered := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return families, err })
+		if err := push.New(p.pushgatewayURL, p.job).Gatherer(gathered).Push(); err != nil {
+			log.Printf("Pushgateway: %v", err)
+		}
+	}
+}
+
+// Run pushes the metrics every interval
+func (p *Pusher) Run(interval time.Duration) {
+	for {
+		p.Push()
+		time.Sleep(interval)
+	}
+}
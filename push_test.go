@@ -0,0 +1,223 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeWriteRequest decodes a snappy compressed prometheus.WriteRequest, as a remote_write receiver does
+func decodeWriteRequest(t *testing.T, body []byte) []remoteWriteSeries {
+	t.Helper()
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatalf("snappy: %v", err)
+	}
+	// fields calls f with every field of a protobuf message
+	fields := func(b []byte, f func(num protowire.Number, typ protowire.Type, value []byte)) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatalf("protobuf: %v", protowire.ParseError(n))
+			}
+			b = b[n:]
+			m := protowire.ConsumeFieldValue(num, typ, b)
+			if m < 0 {
+				t.Fatalf("protobuf: %v", protowire.ParseError(m))
+			}
+			f(num, typ, b[:m])
+			b = b[m:]
+		}
+	}
+	var series []remoteWriteSeries
+	fields(data, func(num protowire.Number, typ protowire.Type, value []byte) {
+		if num != 1 || typ != protowire.BytesType {
+			t.Fatalf("WriteRequest field %d of type %d", num, typ)
+		}
+		timeseries, _ := protowire.ConsumeBytes(value)
+		var s remoteWriteSeries
+		fields(timeseries, func(num protowire.Number, typ protowire.Type, value []byte) {
+			message, _ := protowire.ConsumeBytes(value)
+			switch num {
+			case 1:
+				var label [2]string
+				fields(message, func(num protowire.Number, typ protowire.Type, value []byte) {
+					s, _ := protowire.ConsumeString(value)
+					label[num-1] = s
+				})
+				s.labels = append(s.labels, label)
+			case 2:
+				fields(message, func(num protowire.Number, typ protowire.Type, value []byte) {
+					switch num {
+					case 1:
+						bits, _ := protowire.ConsumeFixed64(value)
+						s.value = math.Float64frombits(bits)
+					case 2:
+						ts, _ := protowire.ConsumeVarint(value)
+						s.timestamp = int64(ts)
+					}
+				})
+			}
+		})
+		series = append(series, s)
+	})
+	return series
+}
+
+// remoteWriteReceiver records the requests of a remote_write client, failing with status while it is not 200
+type remoteWriteReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	requests [][]remoteWriteSeries
+}
+
+func newRemoteWriteReceiver(t *testing.T) *remoteWriteReceiver {
+	r := &remoteWriteReceiver{status: http.StatusNoContent}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Encoding") != "snappy" || req.Header.Get("Content-Type") != "application/x-protobuf" ||
+			req.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+			t.Errorf("remote_write headers %v", req.Header)
+		}
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.status/100 == 2 {
+			r.requests = append(r.requests, decodeWriteRequest(t, body))
+		}
+		w.WriteHeader(r.status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func TestRemoteWrite(t *testing.T) {
+	receiver := newRemoteWriteReceiver(t)
+	registry := prometheus.NewPedanticRegistry()
+	up := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "cpe_up", Help: "up"}, []string{"instance"})
+	up.WithLabelValues("gateway").Set(1)
+	duration := prometheus.NewSummary(prometheus.SummaryOpts{Name: "scrape_seconds", Help: "duration"})
+	duration.Observe(0.25)
+	registry.MustRegister(up, duration)
+
+	remote, err := NewRemoteWriter(receiver.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.UnixMilli(1700000000123)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(GatheredSeries(families, "zhone", at)); err != nil {
+		t.Fatal(err)
+	}
+	want := []remoteWriteSeries{
+		{labels: [][2]string{{"__name__", "cpe_up"}, {"instance", "gateway"}, {"job", "zhone"}}, value: 1, timestamp: 1700000000123},
+		{labels: [][2]string{{"__name__", "scrape_seconds_sum"}, {"job", "zhone"}}, value: 0.25, timestamp: 1700000000123},
+		{labels: [][2]string{{"__name__", "scrape_seconds_count"}, {"job", "zhone"}}, value: 1, timestamp: 1700000000123},
+	}
+	if len(receiver.requests) != 1 || !reflect.DeepEqual(receiver.requests[0], want) {
+		t.Errorf("received %+v, want %+v", receiver.requests, want)
+	}
+}
+
+func TestRemoteWriteWAL(t *testing.T) {
+	receiver := newRemoteWriteReceiver(t)
+	receiver.status = http.StatusServiceUnavailable
+	dir := t.TempDir()
+	sample := func(value float64) []remoteWriteSeries {
+		return []remoteWriteSeries{{labels: [][2]string{{"__name__", "cpe_up"}, {"job", "zhone"}}, value: value, timestamp: 1000}}
+	}
+
+	remote, err := NewRemoteWriter(receiver.URL, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []float64{1, 2} {
+		if err := remote.Write(sample(value)); err == nil {
+			t.Error("write to an unavailable receiver succeeded")
+		}
+	}
+	// a record torn by a crash is ignored
+	f, err := os.OpenFile(filepath.Join(dir, "remote_write.wal"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 0xde, 0xad})
+	f.Close()
+
+	// after a restart the pending requests are sent first, oldest first
+	receiver.status = http.StatusNoContent
+	remote, err = NewRemoteWriter(receiver.URL, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remote.records) != 2 {
+		t.Fatalf("replayed %d requests, want 2", len(remote.records))
+	}
+	if err := remote.Write(sample(3)); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]remoteWriteSeries{sample(1), sample(2), sample(3)}
+	if !reflect.DeepEqual(receiver.requests, want) {
+		t.Errorf("received %+v, want %+v", receiver.requests, want)
+	}
+	if records, err := readWAL(filepath.Join(dir, "remote_write.wal")); err != nil || len(records) != 0 {
+		t.Errorf("WAL has %d records (%v) after the requests were sent, want none", len(records), err)
+	}
+
+	// a request the receiver rejects is dropped rather than retried forever
+	receiver.status = http.StatusBadRequest
+	if err := remote.Write(sample(4)); err != nil {
+		t.Errorf("rejected request: %v", err)
+	}
+	if len(remote.records) != 0 {
+		t.Errorf("%d requests pending after a rejection, want none", len(remote.records))
+	}
+}
+
+func TestPusherGathersOnce(t *testing.T) {
+	receiver := newRemoteWriteReceiver(t)
+	var pushed []string
+	pushgateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushed = append(pushed, r.Method+" "+r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer pushgateway.Close()
+
+	gathered := 0
+	up := prometheus.NewGauge(prometheus.GaugeOpts{Name: "cpe_up", Help: "up"})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(up)
+	gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		gathered++
+		return registry.Gather()
+	})
+	remote, err := NewRemoteWriter(receiver.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewPusher(gatherer, "zhone", remote, pushgateway.URL).Push()
+	if gathered != 1 {
+		t.Errorf("gathered %d times for remote_write and the Pushgateway, want once", gathered)
+	}
+	if len(receiver.requests) != 1 {
+		t.Errorf("got %d remote_write requests, want 1", len(receiver.requests))
+	}
+	if want := []string{"PUT /metrics/job/zhone"}; !reflect.DeepEqual(pushed, want) {
+		t.Errorf("Pushgateway requests %v, want %v", pushed, want)
+	}
+}
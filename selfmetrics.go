@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics about the exporter itself, telling a slow gateway from a slow exporter
+var (
+	scrapeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cpe",
+		Subsystem: "exporter",
+		Name:      "scrape_duration_seconds",
+		Help:      "Time taken to retrieve and parse a snapshot of the gateway.",
+		Buckets:   []float64{.25, .5, 1, 2.5, 5, 10, 20, 30},
+	})
+	pageFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cpe",
+		Subsystem: "exporter",
+		Name:      "page_fetch_seconds",
+		Help:      "Time taken to retrieve a page of the gateway's web interface.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"page"})
+	pageResponseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cpe",
+		Subsystem: "exporter",
+		Name:      "page_response_size_bytes",
+		Help:      "Size of the pages of the gateway's web interface.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 2, 8),
+	}, []string{"page"})
+	pageRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cpe",
+		Subsystem: "exporter",
+		Name:      "page_requests_total",
+		Help:      "Requests to the gateway's web interface by HTTP status code, error when no response was received.",
+	}, []string{"page", "code"})
+	parseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cpe",
+		Subsystem: "exporter",
+		Name:      "parse_errors_total",
+		Help:      "Pages or command outputs the parser function couldn't make sense of.",
+	}, []string{"parser"})
+	wifiRadiosSeen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cpe",
+		Subsystem: "exporter",
+		Name:      "wifi_radios",
+		Help:      "Number of wifi radios found in the last snapshot.",
+	})
+	wifiClientsSeen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cpe",
+		Subsystem: "exporter",
+		Name:      "wifi_clients",
+		Help:      "Number of wifi clients found in the last snapshot.",
+	})
+	configReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cpe",
+		Subsystem: "exporter",
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last configuration reload attempt was successful.",
+	})
+	configReloadSuccessTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cpe",
+		Subsystem: "exporter",
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful configuration reload.",
+	})
+)
+
+// registerSelfMetrics registers the metrics about the exporter, the default registry already holding the Go and process collectors
+func registerSelfMetrics(registerer prometheus.Registerer) {
+	registerer.MustRegister(scrapeDuration, pageFetchDuration, pageResponseSize, pageRequests, parseErrors, wifiRadiosSeen, wifiClientsSeen,
+		configReloadSuccessful, configReloadSuccessTime)
+}
+
+// observePage records a request to a page, code being 0 when no response was received
+func observePage(page string, code int, seconds float64, size int) {
+	pageFetchDuration.WithLabelValues(page).Observe(seconds)
+	if code == 0 {
+		pageRequests.WithLabelValues(page, "error").Inc()
+		return
+	}
+	pageRequests.WithLabelValues(page, strconv.Itoa(code)).Inc()
+	pageResponseSize.WithLabelValues(page).Observe(float64(size))
+}
+
+// observeSnapshot records the size of the wifi network found in a snapshot
+func observeSnapshot(snapshot *Snapshot) {
+	wifiRadiosSeen.Set(float64(len(wlanRadios(snapshot.Interfaces))))
+	wifiClientsSeen.Set(float64(len(snapshot.WifiClients)))
+}
+
+// observeReload records the outcome of loading the configuration, at startup or on a reload
+func observeReload(err error) {
+	if err != nil {
+		configReloadSuccessful.Set(0)
+		return
+	}
+	configReloadSuccessful.Set(1)
+	configReloadSuccessTime.SetToCurrentTime()
+}
+
+// parse runs the parser function named name, turning a panic on unexpected markup into an error counted in cpe_exporter_parse_errors_total
+func parse(name string, parser func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			parseErrors.WithLabelValues(name).Inc()
+			err = fmt.Errorf("%s: %v", name, r)
+		}
+	}()
+	parser()
+	return nil
+}
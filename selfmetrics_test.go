@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseRecovers(t *testing.T) {
+	before := testutil.ToFloat64(parseErrors.WithLabelValues("ParseTest"))
+	var ports map[string]EthernetPort
+	err := parse("ParseTest", func() { ports["eth1"] = EthernetPort{} })
+	if err == nil || !strings.HasPrefix(err.Error(), "ParseTest: ") {
+		t.Errorf("parse = %v, want the panic as an error", err)
+	}
+	if got := testutil.ToFloat64(parseErrors.WithLabelValues("ParseTest")); got != before+1 {
+		t.Errorf("cpe_exporter_parse_errors_total = %v, want %v", got, before+1)
+	}
+	if err := parse("ParseTest", func() {}); err != nil {
+		t.Errorf("parse = %v, want no error", err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Tag is a label of a Point, kept in order so paths built from them are stable
+type Tag struct {
+	Key, Value string
+}
+
+// Field is a value of a Point
+type Field struct {
+	Key   string
+	Value float64
+}
+
+// Point is a measurement of the gateway at a point in time, as written to the output sinks
+type Point struct {
+	Measurement string
+	Tags        []Tag
+	Fields      []Field
+	Time        time.Time
+}
+
+// Sink writes batches of points to a time series database
+type Sink interface {
+	Write(points []Point) error
+}
+
+// errPermanent marks a write the sink will never accept, which is dropped rather than retried
+var errPermanent = errors.New("permanent sink error")
+
+// SnapshotPoints converts the interface, GPON and wifi client data of a snapshot into points
+func SnapshotPoints(instance string, snapshot *Snapshot) []Point {
+	var points []Point
+	for _, Interface := range snapshot.Interfaces {
+		points = append(points, Point{
+			Measurement: "interface",
+			Tags:        []Tag{{"instance", instance}, {"interface", Interface.ID}, {"interface_name", Interface.Name}},
+			Fields: []Field{
+				{"status", Interface.Status},
+				{"speed", Interface.IfSpeed},
+				{"rx_bytes", Interface.rxBytes},
+				{"tx_bytes", Interface.txBytes},
+				{"rx_frames", Interface.rxFrames},
+				{"tx_frames", Interface.txFrames},
+				{"rx_drops", Interface.rxDrops},
+				{"tx_drops", Interface.txDrops},
+				{"rx_errors", Interface.rxErrs},
+				{"tx_errors", Interface.txErrs},
+			},
+			Time: snapshot.Time,
+		})
+	}
+	points = append(points, Point{
+		Measurement: "gpon",
+		Tags:        []Tag{{"instance", instance}, {"interface", snapshot.GPON.ID}, {"interface_name", snapshot.GPON.Name}},
+		Fields: []Field{
+			{"status", snapshot.GPON.Status},
+			{"rx_power", snapshot.GPON.RXPower},
+			{"tx_power", snapshot.GPON.TXPower},
+			{"transitions", snapshot.GPON.Transitions},
+		},
+		Time: snapshot.Time,
+	})
+	for _, client := range snapshot.WifiClients {
+		points = append(points, Point{
+			Measurement: "wifi",
+			Tags:        []Tag{{"instance", instance}, {"wlan_interface", client.Interface}, {"client_mac", client.MAC}},
+			Fields: []Field{
+				{"associated_time", client.AssociatedTime},
+				{"tx_frames", client.txFrames},
+				{"tx_unicast_frames", client.TXUnicastFrames},
+				{"tx_errors", client.txErrs},
+				{"tx_retries", client.TXRetries},
+				{"tx_rate", client.TXRate},
+				{"tx_retry_rate", client.TxRetryRate},
+				{"rx_unicast_frames", client.RXUnicastFrames},
+				{"rx_broadcast_frames", client.RXBcastFrames},
+				{"rx_rate", client.RXRate},
+				{"rssi", client.RSSI},
+				{"noise", client.Noise},
+				{"snr", client.SNR},
+				{"quality", client.Quality},
+			},
+			Time: snapshot.Time,
+		})
+	}
+	return points
+}
+
+// SinkWriter buffers points and writes them to a sink in batches, retrying while the sink is unavailable
+type SinkWriter struct {
+	name          string
+	sink          Sink
+	batchSize     int
+	bufferSize    int
+	flushInterval time.Duration
+	retries       int
+
+	mutex   sync.Mutex
+	buffer  []Point
+	dropped int
+	// trimmed counts the points dropped from the front of the buffer while a batch is written
+	trimmed int
+	flush   chan struct{}
+}
+
+// NewSinkWriter builds a SinkWriter keeping at most bufferSize points while the sink is unavailable
+func NewSinkWriter(name string, sink Sink, batchSize int, bufferSize int, flushInterval time.Duration) *SinkWriter {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if bufferSize < batchSize {
+		bufferSize = batchSize
+	}
+	return &SinkWriter{
+		name:          name,
+		sink:          sink,
+		batchSize:     batchSize,
+		bufferSize:    bufferSize,
+		flushInterval: flushInterval,
+		retries:       3,
+		flush:         make(chan struct{}, 1),
+	}
+}
+
+// Add queues points for writing, dropping the oldest ones when the buffer is full
+func (w *SinkWriter) Add(points []Point) {
+	w.mutex.Lock()
+	w.buffer = append(w.buffer, points...)
+	if overflow := len(w.buffer) - w.bufferSize; overflow > 0 {
+		w.buffer = append([]Point(nil), w.buffer[overflow:]...)
+		w.dropped += overflow
+		w.trimmed += overflow
+	}
+	full := len(w.buffer) >= w.batchSize
+	w.mutex.Unlock()
+	if full {
+		select {
+		case w.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run writes the buffered points every flush interval, or as soon as a batch is full
+func (w *SinkWriter) Run() {
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.flush:
+		}
+		w.Flush()
+	}
+}
+
+// Flush writes the buffered points in batches, leaving them buffered if the sink stays unavailable
+func (w *SinkWriter) Flush() {
+	for {
+		w.mutex.Lock()
+		if w.dropped > 0 {
+			log.Printf("%s: buffer full, dropped %d points", w.name, w.dropped)
+			w.dropped = 0
+		}
+		n := len(w.buffer)
+		if n > w.batchSize {
+			n = w.batchSize
+		}
+		batch := w.buffer[:n:n]
+		w.trimmed = 0
+		w.mutex.Unlock()
+		if n == 0 {
+			return
+		}
+		err := w.write(batch)
+		if err != nil && !errors.Is(err, errPermanent) {
+			log.Printf("%s: %v, %d points buffered", w.name, err, w.buffered())
+			return
+		}
+		if err != nil {
+			log.Printf("%s: %v, dropping %d points", w.name, err, n)
+		}
+		w.mutex.Lock()
+		if sent := n - w.trimmed; sent > 0 {
+			w.buffer = w.buffer[sent:]
+		}
+		w.mutex.Unlock()
+	}
+}
+
+// write sends a batch, retrying with exponential backoff
+func (w *SinkWriter) write(batch []Point) error {
+	backoff := time.Second
+	var err error
+	for attempt := 0; attempt < w.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = w.sink.Write(batch); err == nil || errors.Is(err, errPermanent) {
+			return err
+		}
+	}
+	return err
+}
+
+// buffered returns the number of points waiting to be written
+func (w *SinkWriter) buffered() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.buffer)
+}
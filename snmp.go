@@ -0,0 +1,443 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// The exporter has no IANA Private Enterprise Number of its own, so the GPON subtree lives under the
+// arc reserved for documentation and examples (RFC 5612)
+const snmpEnterpriseOID = ".1.3.6.1.4.1.32473.2726"
+
+const (
+	sysDescrOID             = ".1.3.6.1.2.1.1.1.0"
+	sysObjectIDOID          = ".1.3.6.1.2.1.1.2.0"
+	sysUpTimeOID            = ".1.3.6.1.2.1.1.3.0"
+	sysNameOID              = ".1.3.6.1.2.1.1.5.0"
+	ifNumberOID             = ".1.3.6.1.2.1.2.1.0"
+	ifEntryOID              = ".1.3.6.1.2.1.2.2.1"
+	ifXEntryOID             = ".1.3.6.1.2.1.31.1.1.1"
+	gponOID                 = snmpEnterpriseOID + ".1"
+	usmUnsupportedSecLevels = ".1.3.6.1.6.3.15.1.1.1.0"
+	usmUnknownEngine        = ".1.3.6.1.6.3.15.1.1.4.0"
+)
+
+// IANAifType values for the interfaces of the ZNID
+const (
+	ifTypeEthernet = 6
+	ifTypeWifi     = 71
+	ifTypeGPON     = 250
+)
+
+// authDigestLengths holds the length of the truncated HMAC of each authentication protocol, RFC 3414 and RFC 7860
+var authDigestLengths = map[gosnmp.SnmpV3AuthProtocol]int{
+	gosnmp.MD5: 12, gosnmp.SHA: 12, gosnmp.SHA224: 16,
+	gosnmp.SHA256: 24, gosnmp.SHA384: 32, gosnmp.SHA512: 48,
+}
+
+// snmpVar is a single object in the MIB view served by the agent
+type snmpVar struct {
+	oid []int
+	pdu gosnmp.SnmpPDU
+}
+
+// SNMPAgent answers SNMP requests with the interface and GPON data scraped from the gateway,
+// so the ZNID can be polled like any device with an IF-MIB
+type SNMPAgent struct {
+	exporter  *ZhoneExporter
+	community string
+	// usm holds the SNMPv3 user, SNMPv3 is disabled when nil
+	usm      *gosnmp.UsmSecurityParameters
+	engineID string
+	started  time.Time
+	// CacheTTL bounds how often a walk of the agent results in a scrape of the gateway
+	CacheTTL time.Duration
+
+	mu                   sync.Mutex
+	view                 []snmpVar
+	refreshed            time.Time
+	unknownEngineIDs     uint32
+	unsupportedSecLevels uint32
+	// ifIndexes holds the ifIndex given to interfaces without one derived from their name
+	ifIndexes   map[string]int
+	nextIfIndex int
+}
+
+// NewSNMPAgent builds an SNMPv2c agent for the exporter's gateway, answering to the given community.
+// An empty community disables SNMPv1 and SNMPv2c, for an agent only answering SNMPv3
+func NewSNMPAgent(exporter *ZhoneExporter, community string) *SNMPAgent {
+	return &SNMPAgent{
+		exporter:  exporter,
+		community: community,
+		// RFC 3411 engine ID: enterprise number, format 4 (text), text
+		engineID: string([]byte{0x80, 0x00, 0x7e, 0xd9, 0x04}) + "zhone-exporter",
+		started:  time.Now(),
+		CacheTTL: 15 * time.Second,
+	}
+}
+
+// EnableV3 accepts SNMPv3 requests from a single USM user. The protocols are named as in net-snmp, e.g. SHA and AES;
+// an empty privacy protocol selects authNoPriv
+func (a *SNMPAgent) EnableV3(user string, authProtocol string, authPassword string, privProtocol string, privPassword string) error {
+	auth := map[string]gosnmp.SnmpV3AuthProtocol{
+		"MD5": gosnmp.MD5, "SHA": gosnmp.SHA, "SHA224": gosnmp.SHA224,
+		"SHA256": gosnmp.SHA256, "SHA384": gosnmp.SHA384, "SHA512": gosnmp.SHA512,
+	}
+	priv := map[string]gosnmp.SnmpV3PrivProtocol{
+		"": gosnmp.NoPriv, "DES": gosnmp.DES, "AES": gosnmp.AES,
+		"AES192": gosnmp.AES192, "AES256": gosnmp.AES256,
+	}
+	authProto, ok := auth[strings.ToUpper(authProtocol)]
+	if !ok {
+		return fmt.Errorf("unknown SNMPv3 authentication protocol %q", authProtocol)
+	}
+	privProto, ok := priv[strings.ToUpper(privProtocol)]
+	if !ok {
+		return fmt.Errorf("unknown SNMPv3 privacy protocol %q", privProtocol)
+	}
+	if len(authPassword) < 8 || (privProto != gosnmp.NoPriv && len(privPassword) < 8) {
+		return fmt.Errorf("SNMPv3 passwords must be at least 8 characters")
+	}
+	a.usm = &gosnmp.UsmSecurityParameters{
+		AuthoritativeEngineID:    a.engineID,
+		AuthoritativeEngineBoots: 1,
+		UserName:                 user,
+		AuthenticationProtocol:   authProto,
+		AuthenticationPassphrase: authPassword,
+		PrivacyProtocol:          privProto,
+		PrivacyPassphrase:        privPassword,
+	}
+	return a.usm.InitSecurityKeys()
+}
+
+// ListenUDP serves SNMP requests on the given address
+func (a *SNMPAgent) ListenUDP(address string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	go a.Serve(conn)
+	return nil
+}
+
+// Serve answers the SNMP requests received on conn, until it is closed
+func (a *SNMPAgent) Serve(conn net.PacketConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, remote, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("SNMP agent stopped: %v", err)
+			return
+		}
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+		response, err := a.Handle(msg)
+		if err != nil {
+			log.Printf("SNMP request from %s: %v", remote, err)
+			continue
+		}
+		if response == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(response, remote); err != nil {
+			log.Printf("SNMP response to %s: %v", remote, err)
+		}
+	}
+}
+
+// Handle decodes a request and returns the encoded response, or nil if the request is to be dropped
+func (a *SNMPAgent) Handle(msg []byte) ([]byte, error) {
+	decoder := &gosnmp.GoSNMP{Logger: gosnmp.NewLogger(nil)}
+	if a.usm != nil {
+		decoder.Version = gosnmp.Version3
+		decoder.SecurityModel = gosnmp.UserSecurityModel
+		decoder.SecurityParameters = a.engineParameters()
+	}
+	// verify the digest and decrypt according to the flags of the request, the security level is checked below
+	req, err := decoder.UnmarshalTrap(msg, true)
+	if err != nil {
+		return nil, err
+	}
+	resp := &gosnmp.SnmpPacket{
+		Version:   req.Version,
+		Community: req.Community,
+		PDUType:   gosnmp.GetResponse,
+		MsgID:     req.MsgID,
+		RequestID: req.RequestID,
+		Logger:    gosnmp.NewLogger(nil),
+	}
+	switch req.Version {
+	case gosnmp.Version1, gosnmp.Version2c:
+		if a.community == "" || req.Community != a.community {
+			return nil, nil
+		}
+	case gosnmp.Version3:
+		if a.usm == nil {
+			return nil, nil
+		}
+		usm, ok := req.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+		if !ok {
+			return nil, fmt.Errorf("unsupported security model")
+		}
+		resp.SecurityModel = gosnmp.UserSecurityModel
+		resp.SecurityParameters = a.engineParameters()
+		resp.ContextEngineID = a.engineID
+		resp.ContextName = req.ContextName
+		resp.MsgMaxSize = 65507
+		resp.MsgFlags = req.MsgFlags & gosnmp.AuthPriv
+		if usm.AuthoritativeEngineID != a.engineID {
+			// engine ID discovery, RFC 3414 section 4
+			return a.report(resp, usmUnknownEngine, &a.unknownEngineIDs)
+		}
+		if usm.UserName != a.usm.UserName {
+			return nil, nil
+		}
+		// a client can't drop below the security level configured for the user, RFC 3414 section 3.2
+		level := gosnmp.AuthNoPriv
+		if a.usm.PrivacyProtocol != gosnmp.NoPriv {
+			level = gosnmp.AuthPriv
+		}
+		if req.MsgFlags&level != level {
+			return a.report(resp, usmUnsupportedSecLevels, &a.unsupportedSecLevels)
+		}
+		// gosnmp takes an empty digest as authentic
+		if len(usm.AuthenticationParameters) != authDigestLengths[a.usm.AuthenticationProtocol] {
+			return nil, fmt.Errorf("incoming packet has no authentication digest, discarding")
+		}
+	default:
+		return nil, nil
+	}
+	view, err := a.currentView()
+	if err != nil {
+		log.Printf("Unable to collect from %s: %v", a.exporter.URL, err)
+		resp.Error = gosnmp.GenErr
+		resp.ErrorIndex = 1
+		resp.Variables = req.Variables
+		return resp.MarshalMsg()
+	}
+	switch req.PDUType {
+	case gosnmp.GetRequest:
+		for _, v := range req.Variables {
+			resp.Variables = append(resp.Variables, view.get(v.Name))
+		}
+	case gosnmp.GetNextRequest:
+		for _, v := range req.Variables {
+			resp.Variables = append(resp.Variables, view.next(v.Name))
+		}
+	case gosnmp.GetBulkRequest:
+		nonRepeaters := int(req.NonRepeaters)
+		for i, v := range req.Variables {
+			if i < nonRepeaters {
+				resp.Variables = append(resp.Variables, view.next(v.Name))
+				continue
+			}
+			name := v.Name
+			for j := uint32(0); j < req.MaxRepetitions && len(resp.Variables) < 1000; j++ {
+				pdu := view.next(name)
+				resp.Variables = append(resp.Variables, pdu)
+				if pdu.Type == gosnmp.EndOfMibView {
+					break
+				}
+				name = pdu.Name
+			}
+		}
+	default:
+		// the agent is read-only
+		resp.Error = gosnmp.ReadOnly
+		resp.ErrorIndex = 1
+		resp.Variables = req.Variables
+	}
+	if req.Version == gosnmp.Version1 {
+		// SNMPv1 has no exceptions, they become a noSuchName error
+		for i, v := range resp.Variables {
+			if v.Type == gosnmp.NoSuchObject || v.Type == gosnmp.NoSuchInstance || v.Type == gosnmp.EndOfMibView {
+				resp.Error = gosnmp.NoSuchName
+				resp.ErrorIndex = uint8(i + 1)
+				resp.Variables = req.Variables
+				break
+			}
+		}
+	}
+	return resp.MarshalMsg()
+}
+
+// report turns resp into an unauthenticated Report PDU of the USM statistic oid, incrementing its counter
+func (a *SNMPAgent) report(resp *gosnmp.SnmpPacket, oid string, counter *uint32) ([]byte, error) {
+	a.mu.Lock()
+	*counter++
+	count := *counter
+	a.mu.Unlock()
+	resp.PDUType = gosnmp.Report
+	resp.MsgFlags = gosnmp.NoAuthNoPriv
+	resp.Variables = []gosnmp.SnmpPDU{{Name: oid, Type: gosnmp.Counter32, Value: count}}
+	return resp.MarshalMsg()
+}
+
+// engineParameters returns the USM parameters of the agent, with an up to date engine time
+func (a *SNMPAgent) engineParameters() *gosnmp.UsmSecurityParameters {
+	usm := a.usm.Copy().(*gosnmp.UsmSecurityParameters)
+	usm.AuthoritativeEngineTime = uint32(time.Since(a.started).Seconds())
+	return usm
+}
+
+// snmpView is the sorted list of objects served by the agent
+type snmpView []snmpVar
+
+func (v snmpView) get(name string) gosnmp.SnmpPDU {
+	oid := parseOID(name)
+	i := sort.Search(len(v), func(i int) bool { return compareOID(v[i].oid, oid) >= 0 })
+	if i < len(v) && compareOID(v[i].oid, oid) == 0 {
+		return v[i].pdu
+	}
+	return gosnmp.SnmpPDU{Name: name, Type: gosnmp.NoSuchObject}
+}
+
+func (v snmpView) next(name string) gosnmp.SnmpPDU {
+	oid := parseOID(name)
+	i := sort.Search(len(v), func(i int) bool { return compareOID(v[i].oid, oid) > 0 })
+	if i < len(v) {
+		return v[i].pdu
+	}
+	return gosnmp.SnmpPDU{Name: name, Type: gosnmp.EndOfMibView}
+}
+
+func parseOID(name string) []int {
+	var oid []int
+	for _, part := range strings.Split(strings.Trim(name, "."), ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			break
+		}
+		oid = append(oid, n)
+	}
+	return oid
+}
+
+func compareOID(a []int, b []int) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// currentView returns the MIB view, scraping the gateway again once the cached view has expired
+func (a *SNMPAgent) currentView() (snmpView, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.view == nil || time.Since(a.refreshed) > a.CacheTTL {
+		snapshot, err := a.exporter.Scrape()
+		if err != nil {
+			return nil, err
+		}
+		a.view = a.buildView(snapshot.Interfaces, snapshot.GPON)
+		a.refreshed = time.Now()
+	}
+	return a.view, nil
+}
+
+// ifIndexRE matches the interface names an ifIndex is derived from
+var ifIndexRE = regexp.MustCompile(`^(eth|wl)(\d+)(?:\.(\d))?$`)
+
+// ifIndex returns the ifIndex of an interface, derived from its name so it doesn't change as interfaces come and go:
+// ethN is N+1, wlN and its virtual interfaces wlN.M are 101+10N+M. Other interfaces are numbered from 1001
+// in the order they are first seen
+func (a *SNMPAgent) ifIndex(name string) int {
+	if match := ifIndexRE.FindStringSubmatch(name); match != nil {
+		n, _ := strconv.Atoi(match[2])
+		m, _ := strconv.Atoi(match[3])
+		if match[1] == "eth" && match[3] == "" && n < 100 {
+			return n + 1
+		}
+		if match[1] == "wl" && n < 90 {
+			return 101 + 10*n + m
+		}
+	}
+	if a.ifIndexes == nil {
+		a.ifIndexes = make(map[string]int)
+		a.nextIfIndex = 1001
+	}
+	index, ok := a.ifIndexes[name]
+	if !ok {
+		index = a.nextIfIndex
+		a.ifIndexes[name] = index
+		a.nextIfIndex++
+	}
+	return index
+}
+
+// buildView lays out the system group, IF-MIB ifTable and ifXTable, and the GPON optical levels
+func (a *SNMPAgent) buildView(interfaces []InterfaceData, gpon GPONData) snmpView {
+	var view snmpView
+	add := func(name string, asnType gosnmp.Asn1BER, value interface{}) {
+		view = append(view, snmpVar{oid: parseOID(name), pdu: gosnmp.SnmpPDU{Name: name, Type: asnType, Value: value}})
+	}
+	counter32 := func(f float64) uint32 { return uint32(uint64(f) & math.MaxUint32) }
+	gauge32 := func(f float64) uint { return uint(math.Min(f, math.MaxUint32)) }
+	add(sysDescrOID, gosnmp.OctetString, "Zhone ZNID-GPON-2726A1-UK, via zhone-exporter")
+	add(sysObjectIDOID, gosnmp.ObjectIdentifier, snmpEnterpriseOID)
+	add(sysUpTimeOID, gosnmp.TimeTicks, uint32(time.Since(a.started)/(10*time.Millisecond)))
+	add(sysNameOID, gosnmp.OctetString, a.exporter.URL)
+	add(ifNumberOID, gosnmp.Integer, len(interfaces))
+	for _, iface := range interfaces {
+		index := a.ifIndex(iface.ID)
+		col := func(entry string, column int) string {
+			return fmt.Sprintf("%s.%d.%d", entry, column, index)
+		}
+		ifType := ifTypeEthernet
+		if strings.HasPrefix(iface.ID, "wl") {
+			ifType = ifTypeWifi
+		}
+		status := iface.Status
+		if iface.ID == "eth0" {
+			ifType = ifTypeGPON
+			status = gpon.Status
+		}
+		operStatus := 2
+		if status == 1 {
+			operStatus = 1
+		}
+		add(col(ifEntryOID, 1), gosnmp.Integer, index)
+		add(col(ifEntryOID, 2), gosnmp.OctetString, iface.ID)
+		add(col(ifEntryOID, 3), gosnmp.Integer, ifType)
+		add(col(ifEntryOID, 5), gosnmp.Gauge32, gauge32(iface.IfSpeed*1e6))
+		add(col(ifEntryOID, 7), gosnmp.Integer, 1)
+		add(col(ifEntryOID, 8), gosnmp.Integer, operStatus)
+		add(col(ifEntryOID, 10), gosnmp.Counter32, counter32(iface.rxBytes))
+		add(col(ifEntryOID, 11), gosnmp.Counter32, counter32(iface.rxFrames))
+		add(col(ifEntryOID, 13), gosnmp.Counter32, counter32(iface.rxDrops))
+		add(col(ifEntryOID, 14), gosnmp.Counter32, counter32(iface.rxErrs))
+		add(col(ifEntryOID, 16), gosnmp.Counter32, counter32(iface.txBytes))
+		add(col(ifEntryOID, 17), gosnmp.Counter32, counter32(iface.txFrames))
+		add(col(ifEntryOID, 19), gosnmp.Counter32, counter32(iface.txDrops))
+		add(col(ifEntryOID, 20), gosnmp.Counter32, counter32(iface.txErrs))
+		add(col(ifXEntryOID, 1), gosnmp.OctetString, iface.ID)
+		add(col(ifXEntryOID, 6), gosnmp.Counter64, uint64(iface.rxBytes))
+		add(col(ifXEntryOID, 7), gosnmp.Counter64, uint64(iface.rxFrames))
+		add(col(ifXEntryOID, 10), gosnmp.Counter64, uint64(iface.txBytes))
+		add(col(ifXEntryOID, 11), gosnmp.Counter64, uint64(iface.txFrames))
+		add(col(ifXEntryOID, 15), gosnmp.Gauge32, gauge32(iface.IfSpeed))
+		add(col(ifXEntryOID, 18), gosnmp.OctetString, iface.Name)
+	}
+	// optical levels are in hundredths of a dBm, as SNMP has no floating point type
+	add(gponOID+".1.0", gosnmp.Integer, int(math.Round(gpon.RXPower*100)))
+	add(gponOID+".2.0", gosnmp.Integer, int(math.Round(gpon.TXPower*100)))
+	add(gponOID+".3.0", gosnmp.Integer, int(gpon.Status))
+	add(gponOID+".4.0", gosnmp.Counter32, counter32(gpon.Transitions))
+	sort.Slice(view, func(i, j int) bool { return compareOID(view[i].oid, view[j].oid) < 0 })
+	return view
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// scrapePages are the pages of a scrape of the web interface
+var scrapePages = map[string]string{
+	"/statsifc.html":          "statsifc.html",
+	"/zhnethernetstatus.html": "zhnethernetstatus.html",
+	"/zhngponstatus.html":     "zhngponstatus.html",
+	"/zhnwlstatus.cmd":        "zhnwlstatus.cmd.html",
+	"/zhnwlinfo.cmd":          "zhnwlinfo.cmd.html",
+}
+
+// testAgent serves the SNMP agent for a gateway replaying the captured scrape pages on a loopback port, with SNMPv3
+// enabled for the user monitor and SNMPv2c for community
+func testAgent(t *testing.T, community string) (*SNMPAgent, uint16) {
+	t.Helper()
+	exporter := testGateway(t, scrapePages)
+	agent := NewSNMPAgent(exporter, community)
+	if err := agent.EnableV3("monitor", "SHA", "authpassword", "AES", "privpassword"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go agent.Serve(conn)
+	return agent, uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// testClient connects a gosnmp client to the agent, giving up quickly on requests the agent drops
+func testClient(t *testing.T, port uint16, configure func(*gosnmp.GoSNMP)) *gosnmp.GoSNMP {
+	t.Helper()
+	client := &gosnmp.GoSNMP{
+		Target:    "127.0.0.1",
+		Port:      port,
+		Community: "public",
+		Version:   gosnmp.Version2c,
+		Timeout:   time.Second,
+		Retries:   0,
+		MaxOids:   gosnmp.MaxOids,
+	}
+	if configure != nil {
+		configure(client)
+	}
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Conn.Close() })
+	return client
+}
+
+// walk returns the values of a subtree by OID, with strings and numbers as strings
+func walk(t *testing.T, client *gosnmp.GoSNMP, root string) map[string]string {
+	t.Helper()
+	values := make(map[string]string)
+	err := client.BulkWalk(root, func(pdu gosnmp.SnmpPDU) error {
+		switch value := pdu.Value.(type) {
+		case []byte:
+			values[pdu.Name] = string(value)
+		default:
+			values[pdu.Name] = gosnmp.ToBigInt(value).String()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk of %s: %v", root, err)
+	}
+	return values
+}
+
+// v3Client configures a client as the agent's SNMPv3 user, at the given security level
+func v3Client(flags gosnmp.SnmpV3MsgFlags, authPassword string) func(*gosnmp.GoSNMP) {
+	return func(client *gosnmp.GoSNMP) {
+		client.Version = gosnmp.Version3
+		client.SecurityModel = gosnmp.UserSecurityModel
+		client.MsgFlags = flags
+		client.SecurityParameters = &gosnmp.UsmSecurityParameters{
+			UserName:                 "monitor",
+			AuthenticationProtocol:   gosnmp.SHA,
+			AuthenticationPassphrase: authPassword,
+			PrivacyProtocol:          gosnmp.AES,
+			PrivacyPassphrase:        "privpassword",
+		}
+		if flags&gosnmp.AuthPriv != gosnmp.AuthPriv {
+			client.SecurityParameters.(*gosnmp.UsmSecurityParameters).PrivacyProtocol = gosnmp.NoPriv
+		}
+	}
+}
+
+func TestSNMPAgentWalk(t *testing.T) {
+	_, port := testAgent(t, "public")
+	for _, test := range []struct {
+		name      string
+		configure func(*gosnmp.GoSNMP)
+	}{
+		{"v2c", nil},
+		{"v3", v3Client(gosnmp.AuthPriv, "authpassword")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client := testClient(t, port, test.configure)
+
+			ifTable := walk(t, client, ".1.3.6.1.2.1.2.2")
+			for oid, want := range map[string]string{
+				ifEntryOID + ".1.1":    "1",
+				ifEntryOID + ".2.1":    "eth0",
+				ifEntryOID + ".3.1":    strconv.Itoa(ifTypeGPON),
+				ifEntryOID + ".8.1":    "1",
+				ifEntryOID + ".10.1":   strconv.FormatUint(98765432100&0xffffffff, 10),
+				ifEntryOID + ".2.5":    "eth4",
+				ifEntryOID + ".16.5":   "800",
+				ifEntryOID + ".2.101":  "wl0",
+				ifEntryOID + ".3.101":  strconv.Itoa(ifTypeWifi),
+				ifEntryOID + ".20.101": "5",
+			} {
+				if got := ifTable[oid]; got != want {
+					t.Errorf("%s = %q, want %q", oid, got, want)
+				}
+			}
+			ifXTable := walk(t, client, ".1.3.6.1.2.1.31.1.1")
+			for oid, want := range map[string]string{
+				ifXEntryOID + ".1.1":    "eth0",
+				ifXEntryOID + ".6.1":    "98765432100",
+				ifXEntryOID + ".18.1":   "GPON",
+				ifXEntryOID + ".18.102": "Guest",
+			} {
+				if got := ifXTable[oid]; got != want {
+					t.Errorf("%s = %q, want %q", oid, got, want)
+				}
+			}
+			gpon := walk(t, client, gponOID)
+			want := map[string]string{
+				gponOID + ".1.0": "-1951",
+				gponOID + ".2.0": "210",
+				gponOID + ".3.0": "1",
+				gponOID + ".4.0": "3",
+			}
+			for oid, value := range want {
+				if gpon[oid] != value {
+					t.Errorf("%s = %q, want %q", oid, gpon[oid], value)
+				}
+			}
+
+			result, err := client.Get([]string{sysNameOID, gponOID + ".1.0"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name := string(result.Variables[0].Value.([]byte)); !strings.HasPrefix(name, "127.0.0.1:") {
+				t.Errorf("sysName = %q, want the gateway address", name)
+			}
+			if level := gosnmp.ToBigInt(result.Variables[1].Value).Int64(); level != -1951 {
+				t.Errorf("receive level = %d, want -1951", level)
+			}
+		})
+	}
+}
+
+func TestSNMPAgentRejects(t *testing.T) {
+	agent, port := testAgent(t, "public")
+	for _, test := range []struct {
+		name      string
+		configure func(*gosnmp.GoSNMP)
+		// want is the error reported to the client, nil when the request is dropped
+		want error
+	}{
+		{"wrong community", func(client *gosnmp.GoSNMP) { client.Community = "private" }, nil},
+		{"wrong password", v3Client(gosnmp.AuthPriv, "wrongpassword"), nil},
+		{"authNoPriv with a privacy password set", v3Client(gosnmp.AuthNoPriv, "authpassword"), gosnmp.ErrUnknownSecurityLevel},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client := testClient(t, port, test.configure)
+			client.Timeout = 200 * time.Millisecond
+			_, err := client.Get([]string{sysNameOID})
+			if err == nil {
+				t.Fatal("request was answered")
+			}
+			if test.want != nil && err != test.want {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+			if test.want == nil && !strings.Contains(err.Error(), "timeout") {
+				t.Errorf("got %v, want the request to be dropped", err)
+			}
+		})
+	}
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if agent.unsupportedSecLevels != 1 {
+		t.Errorf("usmStatsUnsupportedSecLevels = %d, want 1", agent.unsupportedSecLevels)
+	}
+}
+
+func TestSNMPAgentV3Only(t *testing.T) {
+	_, port := testAgent(t, "")
+	for _, version := range []gosnmp.SnmpVersion{gosnmp.Version1, gosnmp.Version2c} {
+		for _, community := range []string{"public", ""} {
+			client := testClient(t, port, func(client *gosnmp.GoSNMP) {
+				client.Version = version
+				client.Community = community
+			})
+			client.Timeout = 200 * time.Millisecond
+			if _, err := client.Get([]string{sysNameOID}); err == nil || !strings.Contains(err.Error(), "timeout") {
+				t.Errorf("%v request for community %q got %v, want it dropped", version, community, err)
+			}
+		}
+	}
+	client := testClient(t, port, v3Client(gosnmp.AuthPriv, "authpassword"))
+	if _, err := client.Get([]string{sysNameOID}); err != nil {
+		t.Errorf("SNMPv3 request: %v", err)
+	}
+}
+
+// ifIndex mustn't change when an interface comes or goes, or a poller attributes the counters to the wrong one
+func TestSNMPIfIndex(t *testing.T) {
+	agent := NewSNMPAgent(NewZhoneExporter("gateway", "user", "user"), "public")
+	for _, test := range []struct {
+		name string
+		want int
+	}{
+		{"eth0", 1},
+		{"eth4", 5},
+		{"wl0", 101},
+		{"wl0.1", 102},
+		{"wl1", 111},
+		{"wl1.3", 114},
+		{"br0", 1001},
+		{"eth0.10", 1002},
+		{"br0", 1001},
+		{"ppp0.1", 1003},
+		{"eth0.10", 1002},
+	} {
+		if got := agent.ifIndex(test.name); got != test.want {
+			t.Errorf("ifIndex(%q) = %d, want %d", test.name, got, test.want)
+		}
+	}
+	// the same interfaces in a different order, with one missing, keep their index
+	view := agent.buildView([]InterfaceData{{ID: "wl0"}, {ID: "eth4"}}, GPONData{})
+	want := map[string]bool{ifEntryOID + ".1.5": true, ifEntryOID + ".1.101": true}
+	for _, v := range view {
+		if strings.HasPrefix(v.pdu.Name, ifEntryOID+".1.") && !want[v.pdu.Name] {
+			t.Errorf("unexpected ifIndex %s", v.pdu.Name)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	syslogFacilities = []string{
+		"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+		"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "clock",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+	}
+	syslogSeverities = []string{
+		"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+	}
+)
+
+// syslogEvent is a log message from the gateway that is counted separately
+type syslogEvent struct {
+	name    string
+	help    string
+	pattern *regexp.Regexp
+}
+
+// syslogEvents lists the GPON, DHCP, wifi and authentication messages logged by the ZNID firmware
+var syslogEvents = []syslogEvent{
+	{"gpon_link_down", "GPON link down and loss of signal events.", regexp.MustCompile(`(?i)(gpon|pon|optical).*link.*down|loss of (signal|frame)|\bLO[SF]\b`)},
+	{"onu_deregistrations", "ONU deregistrations from the OLT.", regexp.MustCompile(`(?i)de-?regist`)},
+	{"dhcp_leases", "DHCP leases handed out on the LAN.", regexp.MustCompile(`(?i)DHCPACK|dhcpd?.*lease.*(granted|assigned|offered)`)},
+	{"wifi_associations", "Wifi client associations.", regexp.MustCompile(`(?i)\bassoc(iated|iation)?\b`)},
+	{"wifi_disassociations", "Wifi client disassociations and deauthentications.", regexp.MustCompile(`(?i)disassoc|deauth`)},
+	{"login_failures", "Failed logins on the web interface, telnet or SSH.", regexp.MustCompile(`(?i)(login|authentication|auth) fail|invalid (user|password|login)|bad password`)},
+}
+
+// SyslogMessage is a parsed RFC 3164 or RFC 5424 message
+type SyslogMessage struct {
+	Facility string
+	Severity string
+	Hostname string
+	Message  string
+}
+
+var (
+	rfc5424RE = regexp.MustCompile(`^<(\d{1,3})>1 (\S+) (\S+) (\S+) (\S+) (\S+) (-|\[.*?\](?:\[.*?\])*) ?(.*)$`)
+	rfc3164RE = regexp.MustCompile(`^<(\d{1,3})>(?:[A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d (\S+) )?(.*)$`)
+)
+
+// ParseSyslogMessage decodes the priority, hostname and message text of a syslog line. It returns false if there is no valid priority
+func ParseSyslogMessage(line string) (SyslogMessage, bool) {
+	var msg SyslogMessage
+	var pri string
+	line = strings.TrimRight(line, "\r\n\x00")
+	if match := rfc5424RE.FindStringSubmatch(line); match != nil {
+		pri, msg.Hostname, msg.Message = match[1], match[3], match[8]
+		// an UTF-8 BOM may precede the message
+		msg.Message = strings.TrimPrefix(msg.Message, "\ufeff")
+	} else if match := rfc3164RE.FindStringSubmatch(line); match != nil {
+		pri, msg.Hostname, msg.Message = match[1], match[2], match[3]
+	} else {
+		return msg, false
+	}
+	priority, err := strconv.Atoi(pri)
+	if err != nil || priority > 191 {
+		return msg, false
+	}
+	msg.Facility = syslogFacilities[priority/8]
+	msg.Severity = syslogSeverities[priority%8]
+	return msg, true
+}
+
+// SyslogReceiver listens for the log messages forwarded by the gateway and counts them
+type SyslogReceiver struct {
+	target   string
+	messages *prometheus.CounterVec
+	invalid  *prometheus.CounterVec
+	events   []*prometheus.CounterVec
+}
+
+// NewSyslogReceiver builds a SyslogReceiver, labelling its metrics with the target the messages originate from
+func NewSyslogReceiver(target string) *SyslogReceiver {
+	r := &SyslogReceiver{
+		target: target,
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cpe",
+			Subsystem: "syslog",
+			Name:      "messages_total",
+			Help:      "Syslog messages received, by facility and severity.",
+		}, []string{"instance", "facility", "severity"}),
+		invalid: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cpe",
+			Subsystem: "syslog",
+			Name:      "invalid_messages_total",
+			Help:      "Syslog messages received without a valid priority.",
+		}, []string{"instance"}),
+	}
+	for _, event := range syslogEvents {
+		r.events = append(r.events, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cpe",
+			Subsystem: "syslog",
+			Name:      event.name + "_total",
+			Help:      event.help,
+		}, []string{"instance"}))
+	}
+	return r
+}
+
+// Describe provides the descriptors of the syslog counters
+func (r *SyslogReceiver) Describe(ch chan<- *prometheus.Desc) {
+	r.messages.Describe(ch)
+	r.invalid.Describe(ch)
+	for _, event := range r.events {
+		event.Describe(ch)
+	}
+}
+
+// Collect presents the syslog counters
+func (r *SyslogReceiver) Collect(ch chan<- prometheus.Metric) {
+	r.messages.Collect(ch)
+	r.invalid.Collect(ch)
+	for _, event := range r.events {
+		event.Collect(ch)
+	}
+}
+
+// Handle counts a single syslog line
+func (r *SyslogReceiver) Handle(line string) {
+	msg, ok := ParseSyslogMessage(line)
+	if !ok {
+		r.invalid.WithLabelValues(r.target).Inc()
+		return
+	}
+	r.messages.WithLabelValues(r.target, msg.Facility, msg.Severity).Inc()
+	for i, event := range syslogEvents {
+		if event.pattern.MatchString(msg.Message) {
+			r.events[i].WithLabelValues(r.target).Inc()
+		}
+	}
+}
+
+// ListenUDP receives syslog datagrams, one message per datagram
+func (r *SyslogReceiver) ListenUDP(address string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				log.Printf("Syslog receiver stopped: %v", err)
+				return
+			}
+			r.Handle(string(buf[:n]))
+		}
+	}()
+	return nil
+}
+
+// ListenTCP accepts syslog streams, framed either by octet counting or by newlines (RFC 6587)
+func (r *SyslogReceiver) ListenTCP(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("Syslog receiver stopped: %v", err)
+				return
+			}
+			go r.handleStream(conn)
+		}
+	}()
+	return nil
+}
+
+func (r *SyslogReceiver) handleStream(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		first, err := reader.Peek(1)
+		if err != nil {
+			return
+		}
+		if first[0] >= '1' && first[0] <= '9' {
+			// octet counting: "<length> <message>"
+			length, err := reader.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(length))
+			if err != nil || n <= 0 || n > 1<<20 {
+				log.Printf("Invalid syslog frame length from %s", conn.RemoteAddr())
+				return
+			}
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(reader, buf); err != nil {
+				return
+			}
+			r.Handle(string(buf))
+			continue
+		}
+		line, err := reader.ReadString('\n')
+		if len(strings.TrimSpace(line)) > 0 {
+			r.Handle(line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
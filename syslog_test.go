@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseSyslogMessage(t *testing.T) {
+	for _, test := range []struct {
+		line string
+		ok   bool
+		want SyslogMessage
+	}{
+		{
+			line: "<30>Jan  1 00:01:02 ZNID dhcpd: DHCPACK on 192.168.1.10 to aa:bb:cc:00:11:33",
+			ok:   true,
+			want: SyslogMessage{Facility: "daemon", Severity: "info", Hostname: "ZNID", Message: "dhcpd: DHCPACK on 192.168.1.10 to aa:bb:cc:00:11:33"},
+		},
+		{
+			line: "<3>Oct 18 12:00:00 znid kernel: GPON link down\n",
+			ok:   true,
+			want: SyslogMessage{Facility: "kern", Severity: "err", Hostname: "znid", Message: "kernel: GPON link down"},
+		},
+		{
+			// BusyBox without the timestamp and hostname
+			line: "<86>dropbear[512]: Bad password attempt for 'admin' from 192.168.1.50:51234",
+			ok:   true,
+			want: SyslogMessage{Facility: "authpriv", Severity: "info", Message: "dropbear[512]: Bad password attempt for 'admin' from 192.168.1.50:51234"},
+		},
+		{
+			line: "<165>1 2026-10-18T12:00:00.000Z znid.lan wlmngr 1234 ID47 [exampleSDID@32473 iut=\"3\"] \ufeffwl0: associated aa:bb:cc:00:11:22",
+			ok:   true,
+			want: SyslogMessage{Facility: "local4", Severity: "notice", Hostname: "znid.lan", Message: "wl0: associated aa:bb:cc:00:11:22"},
+		},
+		{
+			line: "<14>1 2026-10-18T12:00:00Z znid omci - - - ONU deregistered by OLT\r\n",
+			ok:   true,
+			want: SyslogMessage{Facility: "user", Severity: "info", Hostname: "znid", Message: "ONU deregistered by OLT"},
+		},
+		{line: "no priority", ok: false},
+		{line: "<192>Jan  1 00:01:02 ZNID out of range", ok: false},
+		{line: "<x>1 2026-10-18T12:00:00Z znid app - - - bad priority", ok: false},
+	} {
+		got, ok := ParseSyslogMessage(test.line)
+		if ok != test.ok {
+			t.Errorf("ParseSyslogMessage(%q) ok = %v, want %v", test.line, ok, test.ok)
+			continue
+		}
+		if ok && got != test.want {
+			t.Errorf("ParseSyslogMessage(%q) = %+v, want %+v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestSyslogReceiverEvents(t *testing.T) {
+	r := NewSyslogReceiver("gateway")
+	for _, line := range []string{
+		"<3>Oct 18 12:00:00 znid kernel: GPON link down",
+		"<4>Oct 18 12:00:01 znid omci: LOS detected",
+		"<4>Oct 18 12:00:02 znid omci: ONU deregistered",
+		"<30>Oct 18 12:00:03 znid dhcpd: DHCPACK on 192.168.1.10 to aa:bb:cc:00:11:33",
+		"<30>Oct 18 12:00:04 znid wlmngr: wl0: associated aa:bb:cc:00:11:22",
+		"<30>Oct 18 12:00:05 znid wlmngr: wl0: disassociated aa:bb:cc:00:11:22",
+		"<86>Oct 18 12:00:06 znid httpd: login failure for user admin",
+		"garbage",
+	} {
+		r.Handle(line)
+	}
+	want := map[string]float64{
+		"gpon_link_down":       2,
+		"onu_deregistrations":  1,
+		"dhcp_leases":          1,
+		"wifi_associations":    1,
+		"wifi_disassociations": 1,
+		"login_failures":       1,
+	}
+	for i, event := range syslogEvents {
+		if got := testutil.ToFloat64(r.events[i].WithLabelValues("gateway")); got != want[event.name] {
+			t.Errorf("%s = %v, want %v", event.name, got, want[event.name])
+		}
+	}
+	if got := testutil.ToFloat64(r.invalid.WithLabelValues("gateway")); got != 1 {
+		t.Errorf("invalid messages = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(r.messages.WithLabelValues("gateway", "kern", "err")); got != 1 {
+		t.Errorf("kern.err messages = %v, want 1", got)
+	}
+}
+
+func TestSyslogStreamFraming(t *testing.T) {
+	r := NewSyslogReceiver("gateway")
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		r.handleStream(server)
+		close(done)
+	}()
+	// an octet counted frame, followed by newline framed messages
+	frame := "<30>Oct 18 12:00:00 znid wlmngr: wl0: associated aa:bb:cc:00:11:22"
+	fmt.Fprintf(client, "%d %s", len(frame), frame)
+	client.Write([]byte("<30>Oct 18 12:00:01 znid dhcpd: DHCPACK on 192.168.1.10\n<30>Oct 18 12:00:02 znid dhcpd: DHCPACK on 192.168.1.11"))
+	client.Close()
+	<-done
+	if got := testutil.ToFloat64(r.messages.WithLabelValues("gateway", "daemon", "info")); got != 3 {
+		t.Errorf("messages = %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(r.invalid.WithLabelValues("gateway")); got != 0 {
+		t.Errorf("invalid messages = %v, want 0", got)
+	}
+}
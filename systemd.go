@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state change to systemd, when the service runs with Type=notify
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	// an address starting with @ is in the abstract namespace
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval systemd expects watchdog keep-alives within, 0 when the watchdog is disabled
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog sends keep-alives to systemd every half interval, and stops when a scrape of exporter hangs
+// for longer than interval so systemd restarts the exporter. exporter is nil without a gateway to query
+func runWatchdog(interval time.Duration, exporter *ZhoneExporter) {
+	hung := false
+	for range time.Tick(interval / 2) {
+		if exporter != nil && exporter.Hung(interval) {
+			if !hung {
+				log.Printf("A scrape of %s has been in progress for over %s, stopping the watchdog keep-alives", exporter.URL, interval)
+			}
+			hung = true
+			continue
+		}
+		hung = false
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("Unable to notify the watchdog: %v", err)
+		}
+	}
+}
+
+// activatedListener returns the listening socket passed by systemd socket activation, nil when the exporter wasn't socket activated
+func activatedListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	if fds > 1 {
+		return nil, fmt.Errorf("%d sockets passed by systemd, a single one is expected", fds)
+	}
+	// not passed on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	// the passed file descriptors start after stdin, stdout and stderr
+	file := os.NewFile(3, "LISTEN_FD_3")
+	defer file.Close()
+	return net.FileListener(file)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSDNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify without NOTIFY_SOCKET: %v", err)
+	}
+
+	for _, name := range []string{
+		filepath.Join(t.TempDir(), "notify"),
+		fmt.Sprintf("@zhone-exporter-test-%d", os.Getpid()),
+	} {
+		address := name
+		if address[0] == '@' {
+			address = "\x00" + address[1:]
+		}
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: address, Net: "unixgram"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		t.Setenv("NOTIFY_SOCKET", name)
+		if err := sdNotify("READY=1"); err != nil {
+			t.Fatalf("sdNotify to %s: %v", name, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := string(buf[:n]); got != "READY=1" {
+			t.Errorf("%s received %q, want READY=1", name, got)
+		}
+	}
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing"))
+	if err := sdNotify("READY=1"); err == nil {
+		t.Error("sdNotify to a missing socket succeeded")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	for _, test := range []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"", "", 0},
+		{"30000000", "", 30 * time.Second},
+		{"30000000", pid, 30 * time.Second},
+		// the watchdog was set up for another process, e.g. the shell script starting the exporter
+		{"30000000", strconv.Itoa(os.Getpid() + 1), 0},
+		{"0", pid, 0},
+		{"-5", pid, 0},
+		{"soon", pid, 0},
+	} {
+		t.Setenv("WATCHDOG_USEC", test.usec)
+		t.Setenv("WATCHDOG_PID", test.pid)
+		if got := watchdogInterval(); got != test.want {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: %s, want %s", test.usec, test.pid, got, test.want)
+		}
+	}
+}
+
+func TestActivatedListener(t *testing.T) {
+	if os.Getenv("ZHONE_EXPORTER_TEST_ACTIVATED") == "1" {
+		activatedProcess()
+		return
+	}
+	pid := strconv.Itoa(os.Getpid())
+	for _, test := range []struct {
+		pid, fds string
+		err      bool
+	}{
+		{"", "", false},
+		{strconv.Itoa(os.Getpid() + 1), "1", false},
+		{pid, "0", false},
+		{pid, "2", true},
+	} {
+		t.Setenv("LISTEN_PID", test.pid)
+		t.Setenv("LISTEN_FDS", test.fds)
+		listener, err := activatedListener()
+		if listener != nil || (err != nil) != test.err {
+			t.Errorf("LISTEN_PID=%q LISTEN_FDS=%q: %v, %v", test.pid, test.fds, listener, err)
+		}
+	}
+
+	// systemd passes the socket as file descriptor 3 to the process it starts
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestActivatedListener$")
+	cmd.Env = append(os.Environ(), "ZHONE_EXPORTER_TEST_ACTIVATED=1", "LISTEN_FDS=1", "LISTEN_FDNAMES=web")
+	cmd.ExtraFiles = []*os.File{file}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("activated process: %v", err)
+	}
+	if string(reply) != "activated" {
+		t.Errorf("activated process replied %q", reply)
+	}
+}
+
+// activatedProcess serves a connection on the socket passed as by systemd, in the process TestActivatedListener starts
+func activatedProcess() {
+	// the process ID is only known once started, as systemd sets it after forking
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	listener, err := activatedListener()
+	if err != nil || listener == nil {
+		fmt.Fprintf(os.Stderr, "activatedListener: %v, %v\n", listener, err)
+		os.Exit(1)
+	}
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if value, ok := os.LookupEnv(name); ok {
+			fmt.Fprintf(os.Stderr, "%s=%s passed on to child processes\n", name, value)
+			os.Exit(1)
+		}
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	conn.Write([]byte("activated"))
+	conn.Close()
+	listener.Close()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TargetSet collects the gateway given on the command line and the targets of the configuration file in parallel,
+// along with the devices of the ACS
+type TargetSet struct {
+	// gateway is the gateway given on the command line, nil if there is none
+	gateway *ZhoneExporter
+	// transport is the transport of the default module, selected by the flags
+	transport TransportConfig
+	oui       *OUIDatabase
+	// ACS, when set, contributes the interface, GPON and wifi client metrics of the devices informing it
+	ACS *ACS
+
+	mu      sync.Mutex
+	targets []target
+}
+
+// target is a gateway of the configuration file, with the settings its exporter was built from
+type target struct {
+	config    TargetConfig
+	transport TransportConfig
+	exporter  *ZhoneExporter
+}
+
+// NewTargetSet builds a TargetSet around the gateway given on the command line, reaching the targets of the default module
+// with transport. The OUI database is shared by all the targets
+func NewTargetSet(gateway *ZhoneExporter, transport TransportConfig, oui *OUIDatabase) *TargetSet {
+	return &TargetSet{gateway: gateway, transport: transport, oui: oui}
+}
+
+// Configure replaces the targets with those of config. Targets whose address and transport are unchanged keep their
+// exporter, and with it their state, taking the new credentials
+func (s *TargetSet) Configure(config Config) error {
+	s.mu.Lock()
+	current := make(map[string]target)
+	for _, t := range s.targets {
+		current[t.config.instance()] = t
+	}
+	s.mu.Unlock()
+
+	var targets []target
+	var credentials []func()
+	for _, entry := range config.Targets {
+		instance := entry.instance()
+		if s.gateway != nil && instance == s.gateway.Instance {
+			return fmt.Errorf("target %s has the instance label of the gateway given on the command line", instance)
+		}
+		module, username, password := s.module(entry, config)
+		if existing, ok := current[instance]; ok && existing.config.Address == entry.Address && existing.transport == module.TransportConfig {
+			existing.config = entry
+			targets = append(targets, existing)
+			credentials = append(credentials, func() { existing.exporter.SetCredentials(username, password) })
+			continue
+		}
+		exporter, err := s.newTarget(entry, module.TransportConfig, username, password)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, target{config: entry, transport: module.TransportConfig, exporter: exporter})
+	}
+	// nothing changes until every target could be built
+	for _, apply := range credentials {
+		apply()
+	}
+	s.mu.Lock()
+	s.targets = targets
+	s.mu.Unlock()
+	return nil
+}
+
+// module returns the module of a target and the credentials it logs in with, those of the module or else the top level ones
+func (s *TargetSet) module(entry TargetConfig, config Config) (ModuleConfig, string, string) {
+	module, ok := config.Modules[entry.Module]
+	if !ok {
+		module = ModuleConfig{TransportConfig: s.transport}
+	}
+	if module.Username != "" {
+		return module, module.Username, module.Password
+	}
+	return module, config.Username, config.Password
+}
+
+// newTarget builds the exporter of a target
+func (s *TargetSet) newTarget(entry TargetConfig, transport TransportConfig, username string, password string) (*ZhoneExporter, error) {
+	exporter := NewZhoneExporter(entry.Address, username, password)
+	exporter.Instance = entry.instance()
+	exporter.OUI = s.oui
+	if err := exporter.SetTransport(transport); err != nil {
+		return nil, fmt.Errorf("target %s: %w", entry.instance(), err)
+	}
+	return exporter, nil
+}
+
+// exporters returns the gateway given on the command line followed by the targets
+func (s *TargetSet) exporters() []*ZhoneExporter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var exporters []*ZhoneExporter
+	if s.gateway != nil {
+		exporters = append(exporters, s.gateway)
+	}
+	for _, t := range s.targets {
+		exporters = append(exporters, t.exporter)
+	}
+	return exporters
+}
+
+// Describe provides the descriptors of the gateway metrics, the same for every target
+func (s *TargetSet) Describe(ch chan<- *prometheus.Desc) {
+	(&ZhoneExporter{}).Describe(ch)
+}
+
+// Collect collects every target at once, so a slow gateway doesn't hold up the others
+func (s *TargetSet) Collect(ch chan<- prometheus.Metric) {
+	var wg sync.WaitGroup
+	for _, exporter := range s.exporters() {
+		wg.Add(1)
+		go func(exporter *ZhoneExporter) {
+			defer wg.Done()
+			exporter.Collect(ch)
+		}(exporter)
+	}
+	if s.ACS != nil {
+		s.ACS.collectDevices(ch)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTargetSet(t *testing.T) {
+	gateway := testGateway(t, scrapePages)
+	config := Config{
+		Username: "user",
+		Password: "user",
+		Modules: map[string]ModuleConfig{
+			"bench": {TransportConfig: TransportConfig{Transport: "telnet", CLIAddress: fakeTelnet(t, "admin", "secret")}, Username: "admin", Password: "secret"},
+		},
+		Targets: []TargetConfig{
+			{Address: gateway.URL, Alias: "upstairs"},
+			{Address: "192.0.2.1", Module: "bench"},
+		},
+	}
+	set := NewTargetSet(gateway, TransportConfig{Transport: "web"}, NewOUIDatabase())
+	if err := set.Configure(config); err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(set)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := make(map[string]float64)
+	rx := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			switch family.GetName() {
+			case "cpe_up":
+				up[label(metric, "instance")] = metric.GetGauge().GetValue()
+			case "cpe_receive_bytes":
+				if label(metric, "interface") == "eth0" {
+					rx[label(metric, "instance")] = metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	wantUp := map[string]float64{gateway.URL: 1, "upstairs": 1, "192.0.2.1": 1}
+	if !reflect.DeepEqual(up, wantUp) {
+		t.Errorf("cpe_up = %v, want %v", up, wantUp)
+	}
+	wantRX := map[string]float64{gateway.URL: 98765432100, "upstairs": 98765432100, "192.0.2.1": 98765432100}
+	if !reflect.DeepEqual(rx, wantRX) {
+		t.Errorf("eth0 cpe_receive_bytes = %v, want %v", rx, wantRX)
+	}
+
+	config.Targets = []TargetConfig{{Address: "192.0.2.2", Alias: gateway.URL}}
+	if err := set.Configure(config); err == nil {
+		t.Error("Configure accepted a target with the instance label of the gateway on the command line")
+	}
+}
+
+func TestLoadConfigTargets(t *testing.T) {
+	defaults := Config{Username: "user", EventOpticalThreshold: 1, Notify: NotifyConfig{RepeatInterval: 1}}
+	for _, test := range []struct {
+		name string
+		file string
+		// err is part of the expected error, empty when the file is valid
+		err string
+	}{
+		{
+			name: "valid",
+			file: `
+modules:
+  locked_down: {transport: ssh, ssh_known_hosts: /etc/zhone-exporter/known_hosts, username: admin, password: secret}
+  bench: {transport: telnet, cli_address: "192.168.10.1:2323"}
+targets:
+  - {address: 192.168.2.1, alias: upstairs}
+  - {address: 192.168.3.1, module: locked_down}
+  - {address: 192.168.10.1, module: bench}
+  - {address: 192.168.10.1, alias: bench2, module: default}
+`,
+		},
+		{name: "default redefined", file: "modules:\n  default: {transport: web}\n", err: "can't be redefined"},
+		{name: "unknown transport", file: "modules:\n  bench: {transport: serial}\n", err: "transport must be web, telnet or ssh"},
+		{name: "no transport", file: "modules:\n  bench: {username: admin}\n", err: "transport must be web, telnet or ssh"},
+		{name: "unverified ssh", file: "modules:\n  bench: {transport: ssh}\n", err: "needs ssh_known_hosts"},
+		{name: "unknown module", file: "targets:\n  - {address: 192.168.2.1, module: bench}\n", err: "unknown module"},
+		{name: "no address", file: "targets:\n  - {alias: upstairs}\n", err: "no address"},
+		{name: "duplicate address", file: "targets:\n  - {address: 192.168.2.1}\n  - {address: 192.168.2.1}\n", err: "listed twice"},
+		{name: "duplicate alias", file: "targets:\n  - {address: 192.168.2.1, alias: a}\n  - {address: 192.168.3.1, alias: a}\n", err: "listed twice"},
+		{name: "unknown field", file: "targets:\n  - {address: 192.168.2.1, instance: a}\n", err: "not found"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "zhone-exporter.yml")
+			if err := os.WriteFile(path, []byte(test.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadConfig(path, defaults)
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("LoadConfig: %v", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("LoadConfig error = %v, want it to contain %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestReloadTargets(t *testing.T) {
+	gateway := NewZhoneExporter("gateway", "user", "user")
+	set := NewTargetSet(gateway, TransportConfig{Transport: "web"}, NewOUIDatabase())
+	path := filepath.Join(t.TempDir(), "zhone-exporter.yml")
+	write := func(file string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defaults := Config{Username: "user", EventOpticalThreshold: 1, Notify: NotifyConfig{RepeatInterval: 1}}
+	reloader := NewReloader(path, defaults, gateway, set, nil, nil)
+	targets := func() map[string]*ZhoneExporter {
+		set.mu.Lock()
+		defer set.mu.Unlock()
+		exporters := make(map[string]*ZhoneExporter)
+		for _, target := range set.targets {
+			exporters[target.exporter.Instance] = target.exporter
+		}
+		return exporters
+	}
+
+	write(`
+password: first
+targets:
+  - {address: 192.168.2.1, alias: upstairs}
+  - {address: 192.168.3.1, alias: shed}
+`)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	before := targets()
+	if len(before) != 2 {
+		t.Fatalf("got targets %v, want upstairs and shed", before)
+	}
+
+	// an unchanged target keeps its exporter and takes the new credentials, a moved one is rebuilt
+	write(`
+password: second
+modules:
+  bench: {transport: telnet, cli_address: "192.168.10.1:2323", username: admin, password: secret}
+targets:
+  - {address: 192.168.2.1, alias: upstairs}
+  - {address: 192.168.4.1, alias: shed}
+  - {address: 192.168.10.1, module: bench}
+`)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	after := targets()
+	if after["upstairs"] != before["upstairs"] {
+		t.Error("the unchanged target got a new exporter")
+	}
+	if after["shed"] == before["shed"] || after["shed"].URL != "192.168.4.1" {
+		t.Errorf("the moved target still reaches %s", after["shed"].URL)
+	}
+	if _, password := after["upstairs"].Credentials(); password != "second" {
+		t.Errorf("upstairs password = %q, want the reloaded one", password)
+	}
+	if username, _ := after["192.168.10.1"].Credentials(); username != "admin" {
+		t.Errorf("bench username = %q, want the module's", username)
+	}
+	if _, password := gateway.Credentials(); password != "second" {
+		t.Errorf("gateway password = %q, want the reloaded one", password)
+	}
+
+	// a rejected file leaves the targets and credentials as they were
+	for _, file := range []string{
+		"password: third\ntargets:\n  - {address: 192.168.2.1, module: missing}\n",
+		"password: third\ntargets:\n  - {address: 192.168.5.1, alias: gateway}\n",
+		"password: third\nmodules:\n  locked_down: {transport: ssh, ssh_known_hosts: /nonexistent/known_hosts}\ntargets:\n  - {address: 192.168.5.1, module: locked_down}\n",
+	} {
+		write(file)
+		if err := reloader.Reload(); err == nil {
+			t.Errorf("reloaded %q", file)
+		}
+		if got := targets(); !reflect.DeepEqual(got, after) {
+			t.Errorf("targets after a rejected reload = %v, want %v", got, after)
+		}
+		if _, password := after["upstairs"].Credentials(); password != "second" {
+			t.Errorf("upstairs password = %q after a rejected reload", password)
+		}
+		if _, password := gateway.Credentials(); password != "second" {
+			t.Errorf("gateway password = %q after a rejected reload", password)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// ANSI escape sequences used by the top subcommand
+const (
+	ansiReset      = "\x1b[0m"
+	ansiBold       = "\x1b[1m"
+	ansiReverse    = "\x1b[7m"
+	ansiRed        = "\x1b[31m"
+	ansiGreen      = "\x1b[32m"
+	ansiYellow     = "\x1b[33m"
+	ansiHome       = "\x1b[H"
+	ansiEraseLine  = "\x1b[K"
+	ansiEraseBelow = "\x1b[J"
+	ansiAltScreen  = "\x1b[?1049h\x1b[?25l"
+	ansiMainScreen = "\x1b[?25h\x1b[?1049l"
+)
+
+// topMinimumHeight is the terminal height assumed when it can't be determined or is too small
+const topMinimumHeight = 24
+
+// topSortColumns are the columns the wifi client table can be sorted by, in the order the s key cycles through them
+var topSortColumns = []string{"rssi", "snr", "quality", "tx rate", "rx rate", "associated", "mac"}
+
+// topResult is the outcome of a scrape for the top subcommand
+type topResult struct {
+	snapshot *Snapshot
+	err      error
+}
+
+// topView holds the state of the top subcommand's screen
+type topView struct {
+	exporter *ZhoneExporter
+	interval time.Duration
+	// rx and tx are the warning and critical ranges of the optical levels
+	rx, tx [2]nagiosRange
+
+	previous, current *Snapshot
+	err               error
+	errAt             time.Time
+	sortBy            int
+	reverse           bool
+}
+
+// update records the result of a scrape, keeping the last snapshot when it failed
+func (v *topView) update(result topResult) {
+	if result.err != nil {
+		v.err = result.err
+		v.errAt = time.Now()
+		return
+	}
+	v.err = nil
+	v.previous, v.current = v.current, result.snapshot
+}
+
+// colour wraps text in the colour of the state of value against the warning and critical ranges
+func colour(text string, value float64, ranges [2]nagiosRange) string {
+	switch {
+	case ranges[1].alert(value):
+		return ansiRed + text + ansiReset
+	case ranges[0].alert(value):
+		return ansiYellow + text + ansiReset
+	}
+	return ansiGreen + text + ansiReset
+}
+
+// formatBitRate formats a throughput with a decimal unit
+func formatBitRate(bps float64) string {
+	units := []string{"bit/s", "kbit/s", "Mbit/s", "Gbit/s"}
+	i := 0
+	for bps >= 1000 && i < len(units)-1 {
+		bps /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", bps, units[i])
+}
+
+// throughput returns the receive and transmit rates of an interface since the previous snapshot, false on the first sample or after a counter reset
+func (v *topView) throughput(Interface InterfaceData) (float64, float64, bool) {
+	if v.previous == nil {
+		return 0, 0, false
+	}
+	seconds := v.current.Time.Sub(v.previous.Time).Seconds()
+	if seconds <= 0 {
+		return 0, 0, false
+	}
+	for _, previous := range v.previous.Interfaces {
+		if previous.ID != Interface.ID {
+			continue
+		}
+		if Interface.rxBytes < previous.rxBytes || Interface.txBytes < previous.txBytes {
+			return 0, 0, false
+		}
+		return (Interface.rxBytes - previous.rxBytes) * 8 / seconds, (Interface.txBytes - previous.txBytes) * 8 / seconds, true
+	}
+	return 0, 0, false
+}
+
+// sortedClients returns the wifi clients in the selected order
+func (v *topView) sortedClients() []apiWifiClient {
+	clients := apiWifiClients(v.exporter, v.current)
+	less := func(a, b apiWifiClient) bool {
+		switch topSortColumns[v.sortBy] {
+		case "rssi":
+			return a.RSSI > b.RSSI
+		case "snr":
+			return a.SNR > b.SNR
+		case "quality":
+			return a.Quality > b.Quality
+		case "tx rate":
+			return a.TXRate > b.TXRate
+		case "rx rate":
+			return a.RXRate > b.RXRate
+		case "associated":
+			return a.AssociatedTime > b.AssociatedTime
+		}
+		return a.MAC < b.MAC
+	}
+	sort.SliceStable(clients, func(i, j int) bool {
+		if v.reverse {
+			return less(clients[j], clients[i])
+		}
+		return less(clients[i], clients[j])
+	})
+	return clients
+}
+
+// render draws the screen for a terminal of the given height
+func (v *topView) render(height int) string {
+	var lines []string
+	line := func(format string, a ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, a...))
+	}
+	header := fmt.Sprintf("zhone-exporter top - %s - every %s", v.exporter.URL, v.interval)
+	if v.current != nil {
+		header += " - updated " + v.current.Time.Format("15:04:05")
+	}
+	line("%s%s%s", ansiBold, header, ansiReset)
+	if v.err != nil {
+		line("%sScrape failed at %s: %v%s", ansiRed, v.errAt.Format("15:04:05"), v.err, ansiReset)
+	}
+	if v.current == nil {
+		if v.err == nil {
+			line("Collecting from %s...", v.exporter.URL)
+		}
+		return draw(lines)
+	}
+	line("")
+
+	gpon := v.current.GPON
+	status := ansiGreen + "up" + ansiReset
+	if gpon.Status != 1 {
+		status = ansiRed + "down" + ansiReset
+	}
+	line("GPON %s   RX %s   TX %s   transitions %.0f", status,
+		colour(fmt.Sprintf("%.2f dBm", gpon.RXPower), gpon.RXPower, v.rx),
+		colour(fmt.Sprintf("%.2f dBm", gpon.TXPower), gpon.TXPower, v.tx),
+		gpon.Transitions)
+	line("")
+
+	line("%s%-10s %-12s %-6s %14s %14s %10s %10s%s", ansiReverse, "INTERFACE", "NAME", "STATUS", "RX", "TX", "DROPS", "ERRORS", ansiReset)
+	for _, Interface := range v.current.Interfaces {
+		rx, tx := "-", "-"
+		if rxRate, txRate, ok := v.throughput(Interface); ok {
+			rx, tx = formatBitRate(rxRate), formatBitRate(txRate)
+		}
+		line("%-10s %-12s %-6s %14s %14s %10.0f %10.0f", Interface.ID, Interface.Name, linkState(Interface.Status),
+			rx, tx, Interface.rxDrops+Interface.txDrops, Interface.rxErrs+Interface.txErrs)
+	}
+	line("")
+
+	clients := v.sortedClients()
+	order := "descending"
+	if v.reverse != (topSortColumns[v.sortBy] == "mac") {
+		order = "ascending"
+	}
+	line("%d wifi clients, sorted by %s, %s", len(clients), topSortColumns[v.sortBy], order)
+	line("%s%-6s %-17s %-24s %6s %5s %7s %8s %8s %10s%s", ansiReverse, "RADIO", "MAC", "VENDOR", "RSSI", "SNR", "QUALITY", "TX RATE", "RX RATE", "ASSOCIATED", ansiReset)
+	// keep the key help visible on small terminals
+	room := height - len(lines) - 2
+	for i, client := range clients {
+		if i >= room {
+			line("... %d more", len(clients)-i)
+			break
+		}
+		vendor := client.Vendor
+		if client.Randomized {
+			vendor = "(randomized)"
+		}
+		if len(vendor) > 24 {
+			vendor = vendor[:24]
+		}
+		line("%-6s %-17s %-24s %6.0f %5.0f %6.0f%% %8.0f %8.0f %10s", client.Interface, client.MAC, vendor,
+			client.RSSI, client.SNR, client.Quality, client.TXRate, client.RXRate,
+			time.Duration(client.AssociatedTime)*time.Second)
+	}
+	for len(lines) < height-1 {
+		line("")
+	}
+	line("%sq%s quit  %ss%s sort by %s  %sr%s reverse", ansiBold, ansiReset, ansiBold, ansiReset,
+		topSortColumns[(v.sortBy+1)%len(topSortColumns)], ansiBold, ansiReset)
+	return draw(lines)
+}
+
+// draw overwrites the screen with lines, without clearing it first to avoid flickering
+func draw(lines []string) string {
+	return ansiHome + strings.Join(lines, ansiEraseLine+"\r\n") + ansiEraseLine + ansiEraseBelow
+}
+
+// runTop implements the top subcommand, a live view of the gateway in the terminal
+func runTop(args []string) int {
+	flags := newSubcommand("top")
+	gateway := addGatewayFlags(flags)
+	interval := flags.Duration("interval", 2*time.Second, "Interval between collections")
+	rxWarning := flags.String("rx-warning", defaultRXWarning, "Warning range of the GPON receive power, in dBm")
+	rxCritical := flags.String("rx-critical", defaultRXCritical, "Critical range of the GPON receive power, in dBm")
+	txWarning := flags.String("tx-warning", defaultTXWarning, "Warning range of the GPON transmit power, in dBm")
+	txCritical := flags.String("tx-critical", defaultTXCritical, "Critical range of the GPON transmit power, in dBm")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	exporter, err := gateway.exporter(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	view := &topView{exporter: exporter, interval: *interval}
+	for i, spec := range []string{*rxWarning, *rxCritical, *txWarning, *txCritical} {
+		r, err := parseNagiosRange(spec)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if i < 2 {
+			view.rx[i] = r
+		} else {
+			view.tx[i-2] = r
+		}
+	}
+
+	stdin, stdout := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if !term.IsTerminal(stdin) || !term.IsTerminal(stdout) {
+		fmt.Fprintln(os.Stderr, "top needs a terminal, use status to print the state of the gateway")
+		return 1
+	}
+	state, err := term.MakeRaw(stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Print(ansiAltScreen)
+	defer func() {
+		fmt.Print(ansiMainScreen)
+		term.Restore(stdin, state)
+	}()
+
+	keys := make(chan byte)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(buf); err != nil {
+				close(keys)
+				return
+			}
+			keys <- buf[0]
+		}
+	}()
+	results := make(chan topResult)
+	go func() {
+		for {
+			snapshot, err := exporter.Scrape()
+			results <- topResult{snapshot, err}
+			time.Sleep(*interval)
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	// the terminal size is checked every second, to follow resizes
+	redraw := time.NewTicker(time.Second)
+	defer redraw.Stop()
+
+	for {
+		_, height, err := term.GetSize(stdout)
+		if err != nil || height < 10 {
+			height = topMinimumHeight
+		}
+		fmt.Print(view.render(height))
+		select {
+		case key, ok := <-keys:
+			if !ok {
+				return 0
+			}
+			switch key {
+			case 'q', 'Q', 3, 4:
+				// Ctrl-C and Ctrl-D arrive as keys in raw mode
+				return 0
+			case 's':
+				view.sortBy = (view.sortBy + 1) % len(topSortColumns)
+			case 'r':
+				view.reverse = !view.reverse
+			}
+		case result := <-results:
+			view.update(result)
+		case <-signals:
+			return 0
+		case <-redraw.C:
+		}
+	}
+}
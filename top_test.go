@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopThroughput(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	eth0 := InterfaceData{ID: "eth0", rxBytes: 10000, txBytes: 5000}
+	view := &topView{}
+	view.update(topResult{snapshot: &Snapshot{Time: start, Interfaces: []InterfaceData{eth0}}})
+	if _, _, ok := view.throughput(eth0); ok {
+		t.Error("throughput on the first sample")
+	}
+
+	for _, test := range []struct {
+		name    string
+		elapsed time.Duration
+		current InterfaceData
+		rx, tx  float64
+		ok      bool
+	}{
+		{"rates", 10 * time.Second, InterfaceData{ID: "eth0", rxBytes: 22500, txBytes: 6000}, 10000, 800, true},
+		{"idle", 10 * time.Second, eth0, 0, 0, true},
+		{"receive counter reset", 10 * time.Second, InterfaceData{ID: "eth0", rxBytes: 100, txBytes: 6000}, 0, 0, false},
+		{"transmit counter reset", 10 * time.Second, InterfaceData{ID: "eth0", rxBytes: 22500, txBytes: 100}, 0, 0, false},
+		{"new interface", 10 * time.Second, InterfaceData{ID: "eth1", rxBytes: 22500, txBytes: 6000}, 0, 0, false},
+		{"same time", 0, InterfaceData{ID: "eth0", rxBytes: 22500, txBytes: 6000}, 0, 0, false},
+	} {
+		view := &topView{
+			previous: &Snapshot{Time: start, Interfaces: []InterfaceData{eth0}},
+			current:  &Snapshot{Time: start.Add(test.elapsed), Interfaces: []InterfaceData{test.current}},
+		}
+		rx, tx, ok := view.throughput(test.current)
+		if rx != test.rx || tx != test.tx || ok != test.ok {
+			t.Errorf("%s: throughput = %v, %v, %v, want %v, %v, %v", test.name, rx, tx, ok, test.rx, test.tx, test.ok)
+		}
+	}
+
+	// a failed scrape keeps the last snapshot, the rate then spans the failure
+	view.update(topResult{err: errors.New("timeout")})
+	view.update(topResult{snapshot: &Snapshot{Time: start.Add(20 * time.Second), Interfaces: []InterfaceData{{ID: "eth0", rxBytes: 12500, txBytes: 5000}}}})
+	if rx, _, ok := view.throughput(view.current.Interfaces[0]); !ok || rx != 1000 || view.err != nil {
+		t.Errorf("throughput after a failed scrape = %v, %v with error %v", rx, ok, view.err)
+	}
+}
+
+func TestTopSortedClients(t *testing.T) {
+	view := &topView{
+		exporter: NewZhoneExporter("gateway", "user", "user"),
+		current: &Snapshot{WifiClients: []WifiClient{
+			{Interface: "wl0", MAC: "3c:22:fb:00:00:09", RSSI: -70, SNR: 20, TXRate: 866, AssociatedTime: 30},
+			{Interface: "wl0", MAC: "00:a0:c8:00:00:02", RSSI: -40, SNR: 50, TXRate: 144, AssociatedTime: 10},
+			{Interface: "wl1", MAC: "da:a1:19:00:00:01", RSSI: -60, SNR: 30, TXRate: 1200, AssociatedTime: 20},
+		}},
+	}
+	column := func(name string) int {
+		for i, c := range topSortColumns {
+			if c == name {
+				return i
+			}
+		}
+		t.Fatalf("no %s column", name)
+		return 0
+	}
+	for _, test := range []struct {
+		sortBy  string
+		reverse bool
+		want    []string
+	}{
+		{"rssi", false, []string{"00:a0:c8:00:00:02", "da:a1:19:00:00:01", "3c:22:fb:00:00:09"}},
+		{"rssi", true, []string{"3c:22:fb:00:00:09", "da:a1:19:00:00:01", "00:a0:c8:00:00:02"}},
+		{"tx rate", false, []string{"da:a1:19:00:00:01", "3c:22:fb:00:00:09", "00:a0:c8:00:00:02"}},
+		{"associated", false, []string{"3c:22:fb:00:00:09", "da:a1:19:00:00:01", "00:a0:c8:00:00:02"}},
+		{"mac", false, []string{"00:a0:c8:00:00:02", "3c:22:fb:00:00:09", "da:a1:19:00:00:01"}},
+		{"mac", true, []string{"da:a1:19:00:00:01", "3c:22:fb:00:00:09", "00:a0:c8:00:00:02"}},
+	} {
+		view.sortBy, view.reverse = column(test.sortBy), test.reverse
+		var got []string
+		for _, client := range view.sortedClients() {
+			got = append(got, client.MAC)
+		}
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("sorted by %s, reverse %v: %v, want %v", test.sortBy, test.reverse, got, test.want)
+		}
+	}
+}
+
+func TestTopRender(t *testing.T) {
+	view := &topView{exporter: NewZhoneExporter("gateway", "user", "user"), interval: 2 * time.Second}
+	lines := func(screen string) []string {
+		if !strings.HasPrefix(screen, ansiHome) || !strings.HasSuffix(screen, ansiEraseLine+ansiEraseBelow) {
+			t.Errorf("screen isn't drawn over the previous one: %q", screen)
+		}
+		screen = strings.TrimSuffix(strings.TrimPrefix(screen, ansiHome), ansiEraseLine+ansiEraseBelow)
+		return strings.Split(screen, ansiEraseLine+"\r\n")
+	}
+	if screen := lines(view.render(topMinimumHeight)); len(screen) != 2 || !strings.Contains(screen[1], "Collecting from gateway") {
+		t.Errorf("screen before the first scrape: %q", screen)
+	}
+
+	snapshot := &Snapshot{
+		Time:       time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		Interfaces: []InterfaceData{{ID: "eth0", Name: "GPON", Status: 1}},
+		GPON:       GPONData{Status: 1, RXPower: -19.51, TXPower: 2.1},
+	}
+	for i := 0; i < 30; i++ {
+		snapshot.WifiClients = append(snapshot.WifiClients, WifiClient{Interface: "wl0", MAC: fmt.Sprintf("3c:22:fb:00:00:%02x", i), RSSI: float64(-40 - i)})
+	}
+	view.update(topResult{snapshot: snapshot})
+	view.update(topResult{err: errors.New("connection refused")})
+	screen := lines(view.render(topMinimumHeight))
+	if len(screen) != topMinimumHeight {
+		t.Fatalf("%d lines on a %d line terminal", len(screen), topMinimumHeight)
+	}
+	text := strings.Join(screen, "\n")
+	for _, want := range []string{
+		"updated 12:00:00",
+		"connection refused",
+		"-19.51 dBm",
+		"30 wifi clients, sorted by rssi, descending",
+		"3c:22:fb:00:00:00",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("screen misses %q:\n%s", want, text)
+		}
+	}
+	// the first sample has no throughput yet
+	if eth0 := strings.Fields(screen[6]); len(eth0) != 7 || eth0[0] != "eth0" || eth0[3] != "-" || eth0[4] != "-" {
+		t.Errorf("eth0 line %q, want no throughput", screen[6])
+	}
+	// the key help stays on the last line, after the clients that fit
+	shown := strings.Count(text, "3c:22:fb:00:00:")
+	if more := fmt.Sprintf("... %d more", 30-shown); screen[len(screen)-2] != more {
+		t.Errorf("line before the help %q, want %q", screen[len(screen)-2], more)
+	}
+	if help := screen[len(screen)-1]; !strings.Contains(help, "quit") || !strings.Contains(help, "sort by snr") {
+		t.Errorf("last line %q, want the key help", help)
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// acsParameterNames are the TR-181 objects requested from the gateway after every Inform
+var acsParameterNames = []string{
+	"Device.DeviceInfo.",
+	"Device.Ethernet.Interface.",
+	"Device.Optical.Interface.",
+	"Device.WiFi.SSID.",
+	"Device.WiFi.AccessPoint.",
+}
+
+const acsSessionCookie = "cwmpsession"
+
+// acsMaxSerialLength is the length of the DeviceId SerialNumber in TR-069
+const acsMaxSerialLength = 64
+
+var (
+	tr069LastInform = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "tr069", "last_inform_timestamp_seconds"), "Time of the last TR-069 Inform from the device.", []string{
+			"instance",
+		}, nil)
+	tr069DeviceInfo = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "tr069", "device_info"), "Device identification sent in the TR-069 Inform.", []string{
+			"instance",
+			"manufacturer",
+			"oui",
+			"product_class",
+			"software_version",
+		}, nil)
+)
+
+// cwmpEnvelope is the subset of a CWMP SOAP message sent by the CPE that the ACS understands
+type cwmpEnvelope struct {
+	XMLName xml.Name `xml:"Envelope"`
+	ID      string   `xml:"Header>ID"`
+	Body    struct {
+		Inform                     *cwmpInform `xml:"Inform"`
+		GetParameterValuesResponse *struct {
+			Parameters []cwmpParameter `xml:"ParameterList>ParameterValueStruct"`
+		} `xml:"GetParameterValuesResponse"`
+		Fault *struct {
+			Code    string `xml:"detail>Fault>FaultCode"`
+			Message string `xml:"detail>Fault>FaultString"`
+		} `xml:"Fault"`
+	} `xml:"Body"`
+}
+
+type cwmpInform struct {
+	Manufacturer string          `xml:"DeviceId>Manufacturer"`
+	OUI          string          `xml:"DeviceId>OUI"`
+	ProductClass string          `xml:"DeviceId>ProductClass"`
+	SerialNumber string          `xml:"DeviceId>SerialNumber"`
+	Events       []string        `xml:"Event>EventStruct>EventCode"`
+	Parameters   []cwmpParameter `xml:"ParameterList>ParameterValueStruct"`
+}
+
+type cwmpParameter struct {
+	Name  string `xml:"Name"`
+	Value string `xml:"Value"`
+}
+
+// acsDevice holds the last known parameter values of a CPE
+type acsDevice struct {
+	inform     cwmpInform
+	lastInform time.Time
+	parameters map[string]string
+}
+
+// acsSession tracks a CWMP session between the Inform and the end of the session
+type acsSession struct {
+	serial    string
+	requested bool
+	started   time.Time
+}
+
+// ACS is a minimal TR-069 Auto Configuration Server. It accepts Informs, reads the TR-181 interface and optical
+// parameters of the device with GetParameterValues, and exposes them as the usual cpe_* metrics keyed by serial number
+type ACS struct {
+	username, password string
+	// MaxDevices is the number of devices the ACS keeps, the Informs of further devices are refused
+	MaxDevices int
+	// Expiry is how long a device that stopped informing is kept
+	Expiry time.Duration
+
+	mu       sync.Mutex
+	devices  map[string]*acsDevice
+	sessions map[string]*acsSession
+}
+
+// NewACS builds an ACS. When username is not empty, the CPE must authenticate with these basic auth credentials
+func NewACS(username string, password string) *ACS {
+	return &ACS{
+		username:   username,
+		password:   password,
+		MaxDevices: 100,
+		Expiry:     24 * time.Hour,
+		devices:    make(map[string]*acsDevice),
+		sessions:   make(map[string]*acsSession),
+	}
+}
+
+// ServeHTTP handles a single HTTP POST of a CWMP session
+func (a *ACS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.username != "" {
+		user, pass, ok := r.BasicAuth()
+		userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(a.username))
+		passMatch := subtle.ConstantTimeCompare([]byte(pass), []byte(a.password))
+		if !ok || userMatch&passMatch != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="zhone-exporter ACS"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 4<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	session := a.session(r)
+	if len(strings.TrimSpace(string(body))) == 0 {
+		// an empty POST hands control to the ACS
+		if session == nil || session.requested {
+			a.endSession(w, r)
+			return
+		}
+		session.requested = true
+		a.writeEnvelope(w, newSessionID(), getParameterValues(acsParameterNames))
+		return
+	}
+	var envelope cwmpEnvelope
+	if err := xml.Unmarshal(body, &envelope); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case envelope.Body.Inform != nil:
+		a.handleInform(w, envelope.ID, envelope.Body.Inform)
+	case envelope.Body.GetParameterValuesResponse != nil && session != nil:
+		a.storeParameters(session.serial, acsParameterNames, envelope.Body.GetParameterValuesResponse.Parameters)
+		a.endSession(w, r)
+	case envelope.Body.Fault != nil:
+		log.Printf("TR-069 fault from %s: %s %s", r.RemoteAddr, envelope.Body.Fault.Code, envelope.Body.Fault.Message)
+		a.endSession(w, r)
+	default:
+		// methods the ACS does not implement, e.g. TransferComplete, are not acknowledged
+		a.endSession(w, r)
+	}
+}
+
+func (a *ACS) handleInform(w http.ResponseWriter, id string, inform *cwmpInform) {
+	if inform.SerialNumber == "" || len(inform.SerialNumber) > acsMaxSerialLength {
+		http.Error(w, "Inform without a valid serial number", http.StatusBadRequest)
+		return
+	}
+	sessionID := newSessionID()
+	a.mu.Lock()
+	for serial, device := range a.devices {
+		if time.Since(device.lastInform) > a.Expiry {
+			delete(a.devices, serial)
+		}
+	}
+	device, ok := a.devices[inform.SerialNumber]
+	if !ok {
+		if len(a.devices) >= a.MaxDevices {
+			a.mu.Unlock()
+			log.Printf("TR-069: refusing the Inform of %q, the ACS already keeps %d devices", inform.SerialNumber, a.MaxDevices)
+			http.Error(w, "Too many devices", http.StatusServiceUnavailable)
+			return
+		}
+		device = &acsDevice{parameters: make(map[string]string)}
+		a.devices[inform.SerialNumber] = device
+	}
+	device.inform = *inform
+	device.lastInform = time.Now()
+	for _, parameter := range inform.Parameters {
+		device.parameters[parameter.Name] = parameter.Value
+	}
+	// sessions that were never completed are dropped after a while, or when the device starts another one
+	for key, session := range a.sessions {
+		if session.serial == inform.SerialNumber || time.Since(session.started) > 5*time.Minute {
+			delete(a.sessions, key)
+		}
+	}
+	a.sessions[sessionID] = &acsSession{serial: inform.SerialNumber, started: time.Now()}
+	a.mu.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: acsSessionCookie, Value: sessionID, Path: "/"})
+	a.writeEnvelope(w, id, `<cwmp:InformResponse><MaxEnvelopes>1</MaxEnvelopes></cwmp:InformResponse>`)
+}
+
+// storeParameters replaces the requested subtrees with the parameters of the response, so objects the device
+// no longer has, such as the AssociatedDevice of a client that left, go away
+func (a *ACS) storeParameters(serial string, requested []string, parameters []cwmpParameter) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	device, ok := a.devices[serial]
+	if !ok {
+		return
+	}
+	for name := range device.parameters {
+		for _, prefix := range requested {
+			if strings.HasPrefix(name, prefix) {
+				delete(device.parameters, name)
+				break
+			}
+		}
+	}
+	for _, parameter := range parameters {
+		device.parameters[parameter.Name] = parameter.Value
+	}
+}
+
+func (a *ACS) session(r *http.Request) *acsSession {
+	cookie, err := r.Cookie(acsSessionCookie)
+	if err != nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.sessions[cookie.Value]
+}
+
+// endSession answers with an empty response, which closes the CWMP session
+func (a *ACS) endSession(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(acsSessionCookie); err == nil {
+		a.mu.Lock()
+		delete(a.sessions, cookie.Value)
+		a.mu.Unlock()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *ACS) writeEnvelope(w http.ResponseWriter, id string, body string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:soapenc="http://schemas.xmlsoap.org/soap/encoding/" xmlns:xsd="http://www.w3.org/2001/XMLSchema" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xmlns:cwmp="urn:dslforum-org:cwmp-1-0">
+<soapenv:Header><cwmp:ID soapenv:mustUnderstand="1">%s</cwmp:ID></soapenv:Header>
+<soapenv:Body>%s</soapenv:Body>
+</soapenv:Envelope>`, xmlEscape(id), body)
+}
+
+func getParameterValues(names []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<cwmp:GetParameterValues><ParameterNames soapenc:arrayType="xsd:string[%d]">`, len(names))
+	for _, name := range names {
+		fmt.Fprintf(&b, "<string>%s</string>", xmlEscape(name))
+	}
+	b.WriteString("</ParameterNames></cwmp:GetParameterValues>")
+	return b.String()
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func newSessionID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Describe provides the descriptors of the TR-069 metrics. The interface, GPON and wifi metrics of the devices
+// are those of ZhoneExporter, so they are collected through the TargetSet describing them
+func (a *ACS) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tr069LastInform
+	ch <- tr069DeviceInfo
+}
+
+// Collect presents when every device that informed the ACS last did so, and its identification
+func (a *ACS) Collect(ch chan<- prometheus.Metric) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for serial, device := range a.devices {
+		ch <- prometheus.MustNewConstMetric(
+			tr069LastInform, prometheus.GaugeValue, float64(device.lastInform.Unix()), serial,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			tr069DeviceInfo, prometheus.GaugeValue, 1, serial, device.inform.Manufacturer, device.inform.OUI,
+			device.inform.ProductClass, device.parameters["Device.DeviceInfo.SoftwareVersion"],
+		)
+	}
+}
+
+// collectDevices presents the last known interface, GPON and wifi client values of every device, keyed by serial number
+func (a *ACS) collectDevices(ch chan<- prometheus.Metric) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for serial, device := range a.devices {
+		snapshot := ParseTR181(device.parameters)
+		for _, Interface := range snapshot.Interfaces {
+			values := []struct {
+				desc  *prometheus.Desc
+				value float64
+			}{
+				{rxBytes, Interface.rxBytes}, {txBytes, Interface.txBytes},
+				{rxFrames, Interface.rxFrames}, {txFrames, Interface.txFrames},
+				{rxErrs, Interface.rxErrs}, {txErrs, Interface.txErrs},
+				{rxDrops, Interface.rxDrops}, {txDrops, Interface.txDrops},
+				{interfaceSpeed, Interface.IfSpeed}, {interfaceStatus, Interface.Status},
+			}
+			for _, v := range values {
+				ch <- prometheus.MustNewConstMetric(v.desc, prometheus.GaugeValue, v.value, serial, Interface.ID, Interface.Name)
+			}
+		}
+		if snapshot.GPON.ID != "" {
+			gpon := snapshot.GPON
+			ch <- prometheus.MustNewConstMetric(gponRX, prometheus.GaugeValue, gpon.RXPower, serial, gpon.ID, gpon.Name)
+			ch <- prometheus.MustNewConstMetric(gponTX, prometheus.GaugeValue, gpon.TXPower, serial, gpon.ID, gpon.Name)
+		}
+		for _, wlan := range snapshot.WifiClients {
+			ch <- prometheus.MustNewConstMetric(wifiRSSI, prometheus.GaugeValue, wlan.RSSI, serial, wlan.Interface, wlan.MAC)
+			ch <- prometheus.MustNewConstMetric(wifiTXRate, prometheus.GaugeValue, wlan.TXRate, serial, wlan.Interface, wlan.MAC)
+			ch <- prometheus.MustNewConstMetric(wifiRXRate, prometheus.GaugeValue, wlan.RXRate, serial, wlan.Interface, wlan.MAC)
+		}
+	}
+}
+
+// tr181Objects groups the parameters below prefix by instance number, e.g. Device.Ethernet.Interface.{i}.
+func tr181Objects(parameters map[string]string, prefix string) map[string]map[string]string {
+	objects := make(map[string]map[string]string)
+	instanceRE := regexp.MustCompile(`^` + regexp.QuoteMeta(prefix) + `(\d+)\.(.+)$`)
+	for name, value := range parameters {
+		match := instanceRE.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		if objects[match[1]] == nil {
+			objects[match[1]] = make(map[string]string)
+		}
+		objects[match[1]][match[2]] = value
+	}
+	return objects
+}
+
+// sortedInstances returns the instance numbers of objects in numeric order
+func sortedInstances(objects map[string]map[string]string) []string {
+	var instances []string
+	for instance := range objects {
+		instances = append(instances, instance)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		a, _ := strconv.Atoi(instances[i])
+		b, _ := strconv.Atoi(instances[j])
+		return a < b
+	})
+	return instances
+}
+
+// ParseTR181 maps the TR-181 Device.* parameters onto the same structures the web interface is parsed into
+func ParseTR181(parameters map[string]string) *Snapshot {
+	snapshot := &Snapshot{}
+	toFloat := func(s string) float64 {
+		f, _ := strconv.ParseFloat(s, 64)
+		return f
+	}
+	// the Name labels the interface, the path of the object stands in when it is empty or taken by another interface
+	seen := make(map[string]bool)
+	interfaceID := func(object map[string]string, path string) string {
+		id := object["Name"]
+		if id == "" || seen[id] {
+			id = path
+		}
+		seen[id] = true
+		return id
+	}
+	interfaceData := func(object map[string]string, id string) InterfaceData {
+		Interface := InterfaceData{
+			ID:       id,
+			Name:     object["Alias"],
+			rxBytes:  toFloat(object["Stats.BytesReceived"]),
+			txBytes:  toFloat(object["Stats.BytesSent"]),
+			rxFrames: toFloat(object["Stats.PacketsReceived"]),
+			txFrames: toFloat(object["Stats.PacketsSent"]),
+			rxErrs:   toFloat(object["Stats.ErrorsReceived"]),
+			txErrs:   toFloat(object["Stats.ErrorsSent"]),
+			rxDrops:  toFloat(object["Stats.DiscardPacketsReceived"]),
+			txDrops:  toFloat(object["Stats.DiscardPacketsSent"]),
+			IfSpeed:  toFloat(object["CurrentBitRate"]),
+		}
+		if Interface.Name == "" {
+			Interface.Name = Interface.ID
+		}
+		if object["Status"] == "Up" {
+			Interface.Status = 1
+		}
+		return Interface
+	}
+	ethernet := tr181Objects(parameters, "Device.Ethernet.Interface.")
+	for _, instance := range sortedInstances(ethernet) {
+		id := interfaceID(ethernet[instance], "Device.Ethernet.Interface."+instance)
+		snapshot.Interfaces = append(snapshot.Interfaces, interfaceData(ethernet[instance], id))
+	}
+	ssids := tr181Objects(parameters, "Device.WiFi.SSID.")
+	// radios maps the SSID instances to their interface, for the access points referring to them
+	radios := make(map[string]string)
+	for _, instance := range sortedInstances(ssids) {
+		radios[instance] = interfaceID(ssids[instance], "Device.WiFi.SSID."+instance)
+		snapshot.Interfaces = append(snapshot.Interfaces, interfaceData(ssids[instance], radios[instance]))
+	}
+	optical := tr181Objects(parameters, "Device.Optical.Interface.")
+	for _, instance := range sortedInstances(optical) {
+		object := optical[instance]
+		// optical levels are expressed in thousandths of a dBm
+		snapshot.GPON = GPONData{
+			ID:      object["Name"],
+			Name:    object["Alias"],
+			RXPower: toFloat(object["OpticalSignalLevel"]) / 1000,
+			TXPower: toFloat(object["TransmitOpticalLevel"]) / 1000,
+		}
+		if snapshot.GPON.ID == "" {
+			snapshot.GPON.ID = "Device.Optical.Interface." + instance
+		}
+		if snapshot.GPON.Name == "" {
+			snapshot.GPON.Name = snapshot.GPON.ID
+		}
+		if object["Status"] == "Up" {
+			snapshot.GPON.Status = 1
+		}
+		break
+	}
+	accessPoints := tr181Objects(parameters, "Device.WiFi.AccessPoint.")
+	associated := make(map[string]bool)
+	for _, instance := range sortedInstances(accessPoints) {
+		radio := radios[strings.TrimSuffix(strings.TrimPrefix(accessPoints[instance]["SSIDReference"], "Device.WiFi.SSID."), ".")]
+		clients := tr181Objects(accessPoints[instance], "AssociatedDevice.")
+		for _, client := range sortedInstances(clients) {
+			object := clients[client]
+			mac := normalizeMAC(object["MACAddress"])
+			if mac == "" || associated[radio+" "+mac] {
+				continue
+			}
+			associated[radio+" "+mac] = true
+			// data rates are expressed in kbps
+			snapshot.WifiClients = append(snapshot.WifiClients, WifiClient{
+				Interface: radio,
+				MAC:       mac,
+				RSSI:      toFloat(object["SignalStrength"]),
+				TXRate:    toFloat(object["LastDataDownlinkRate"]) / 1000,
+				RXRate:    toFloat(object["LastDataUplinkRate"]) / 1000,
+			})
+		}
+	}
+	return snapshot
+}
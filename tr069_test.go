@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseTR181(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		parameters map[string]string
+		want       *Snapshot
+	}{
+		{
+			name: "interfaces, optical and wifi clients",
+			parameters: map[string]string{
+				"Device.Ethernet.Interface.1.Name":                                  "eth0",
+				"Device.Ethernet.Interface.1.Alias":                                 "GPON",
+				"Device.Ethernet.Interface.1.Status":                                "Up",
+				"Device.Ethernet.Interface.1.CurrentBitRate":                        "2500",
+				"Device.Ethernet.Interface.1.Stats.BytesReceived":                   "1000",
+				"Device.Ethernet.Interface.1.Stats.BytesSent":                       "2000",
+				"Device.Ethernet.Interface.1.Stats.PacketsReceived":                 "10",
+				"Device.Ethernet.Interface.1.Stats.PacketsSent":                     "20",
+				"Device.Ethernet.Interface.1.Stats.ErrorsReceived":                  "1",
+				"Device.Ethernet.Interface.1.Stats.ErrorsSent":                      "2",
+				"Device.Ethernet.Interface.1.Stats.DiscardPacketsReceived":          "3",
+				"Device.Ethernet.Interface.1.Stats.DiscardPacketsSent":              "4",
+				"Device.Ethernet.Interface.10.Name":                                 "eth1",
+				"Device.Ethernet.Interface.10.Status":                               "Down",
+				"Device.WiFi.SSID.1.Name":                                           "wl0",
+				"Device.WiFi.SSID.1.Status":                                         "Up",
+				"Device.Optical.Interface.1.Name":                                   "veip0",
+				"Device.Optical.Interface.1.Alias":                                  "GPON",
+				"Device.Optical.Interface.1.Status":                                 "Up",
+				"Device.Optical.Interface.1.OpticalSignalLevel":                     "-19510",
+				"Device.Optical.Interface.1.TransmitOpticalLevel":                   "2100",
+				"Device.WiFi.AccessPoint.1.SSIDReference":                           "Device.WiFi.SSID.1.",
+				"Device.WiFi.AccessPoint.1.AssociatedDevice.1.MACAddress":           "3C:22:FB:00:00:09",
+				"Device.WiFi.AccessPoint.1.AssociatedDevice.1.SignalStrength":       "-50",
+				"Device.WiFi.AccessPoint.1.AssociatedDevice.1.LastDataDownlinkRate": "866700",
+				"Device.WiFi.AccessPoint.1.AssociatedDevice.1.LastDataUplinkRate":   "780000",
+				"Device.DeviceInfo.SoftwareVersion":                                 "S3.1.241",
+			},
+			want: &Snapshot{
+				Interfaces: []InterfaceData{
+					{ID: "eth0", Name: "GPON", Status: 1, IfSpeed: 2500, rxBytes: 1000, txBytes: 2000, rxFrames: 10, txFrames: 20, rxErrs: 1, txErrs: 2, rxDrops: 3, txDrops: 4},
+					{ID: "eth1", Name: "eth1"},
+					{ID: "wl0", Name: "wl0", Status: 1},
+				},
+				GPON:        GPONData{ID: "veip0", Name: "GPON", Status: 1, RXPower: -19.51, TXPower: 2.1},
+				WifiClients: []WifiClient{{Interface: "wl0", MAC: "3c:22:fb:00:00:09", RSSI: -50, TXRate: 866.7, RXRate: 780}},
+			},
+		},
+		{
+			name: "missing and duplicate names",
+			parameters: map[string]string{
+				"Device.Ethernet.Interface.1.Name":                        "eth1",
+				"Device.Ethernet.Interface.2.Name":                        "eth1",
+				"Device.Ethernet.Interface.3.Status":                      "Up",
+				"Device.WiFi.SSID.1.Name":                                 "eth1",
+				"Device.WiFi.SSID.2.Alias":                                "Guest",
+				"Device.Optical.Interface.1.Status":                       "Down",
+				"Device.WiFi.AccessPoint.1.SSIDReference":                 "Device.WiFi.SSID.2.",
+				"Device.WiFi.AccessPoint.1.AssociatedDevice.1.MACAddress": "da:a1:19:00:00:01",
+				"Device.WiFi.AccessPoint.1.AssociatedDevice.2.MACAddress": "not a MAC",
+				"Device.WiFi.AccessPoint.1.AssociatedDevice.3.MACAddress": "DA:A1:19:00:00:01",
+			},
+			want: &Snapshot{
+				Interfaces: []InterfaceData{
+					{ID: "eth1", Name: "eth1"},
+					{ID: "Device.Ethernet.Interface.2", Name: "Device.Ethernet.Interface.2"},
+					{ID: "Device.Ethernet.Interface.3", Name: "Device.Ethernet.Interface.3", Status: 1},
+					{ID: "Device.WiFi.SSID.1", Name: "Device.WiFi.SSID.1"},
+					{ID: "Device.WiFi.SSID.2", Name: "Guest"},
+				},
+				GPON:        GPONData{ID: "Device.Optical.Interface.1", Name: "Device.Optical.Interface.1"},
+				WifiClients: []WifiClient{{Interface: "Device.WiFi.SSID.2", MAC: "da:a1:19:00:00:01"}},
+			},
+		},
+		{
+			name:       "empty",
+			parameters: map[string]string{},
+			want:       &Snapshot{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ParseTR181(test.parameters); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseTR181 =\n%+v\nwant\n%+v", got, test.want)
+			}
+		})
+	}
+}
+
+const cwmpInformXML = `<?xml version="1.0" encoding="UTF-8"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:cwmp="urn:dslforum-org:cwmp-1-0">
+<soap:Header><cwmp:ID soap:mustUnderstand="1">1</cwmp:ID></soap:Header>
+<soap:Body><cwmp:Inform>
+<DeviceId><Manufacturer>Zhone</Manufacturer><OUI>00A0C8</OUI><ProductClass>ZNID-GPON-2726A1-UK</ProductClass><SerialNumber>ZNTS01234567</SerialNumber></DeviceId>
+<Event><EventStruct><EventCode>2 PERIODIC</EventCode></EventStruct></Event>
+<ParameterList><ParameterValueStruct><Name>Device.DeviceInfo.SoftwareVersion</Name><Value>S3.1.241</Value></ParameterValueStruct></ParameterList>
+</cwmp:Inform></soap:Body>
+</soap:Envelope>`
+
+// cwmpResponse is a GetParameterValuesResponse listing parameters
+func cwmpResponse(parameters map[string]string) string {
+	var list strings.Builder
+	for name, value := range parameters {
+		fmt.Fprintf(&list, "<ParameterValueStruct><Name>%s</Name><Value>%s</Value></ParameterValueStruct>", name, value)
+	}
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:cwmp="urn:dslforum-org:cwmp-1-0">
+<soap:Header><cwmp:ID soap:mustUnderstand="1">2</cwmp:ID></soap:Header>
+<soap:Body><cwmp:GetParameterValuesResponse><ParameterList>` + list.String() + `</ParameterList></cwmp:GetParameterValuesResponse></soap:Body>
+</soap:Envelope>`
+}
+
+// informACS runs a CWMP session as the gateway does: Inform, an empty POST, then the answer to GetParameterValues
+func informACS(t *testing.T, url string, parameters map[string]string) {
+	t.Helper()
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	for i, body := range []string{cwmpInformXML, "", cwmpResponse(parameters)} {
+		res, err := client.Post(url, "text/xml", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		want := []string{"InformResponse", "GetParameterValues", ""}[i]
+		if res.StatusCode >= 300 || !strings.Contains(string(out), want) {
+			t.Fatalf("step %d: HTTP %d %q, want %q", i, res.StatusCode, out, want)
+		}
+	}
+}
+
+func TestACSSession(t *testing.T) {
+	acs := NewACS("", "")
+	server := httptest.NewServer(acs)
+	defer server.Close()
+	targets := NewTargetSet(nil, TransportConfig{}, NewOUIDatabase())
+	targets.ACS = acs
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(acs, targets)
+
+	clients := func() map[string]bool {
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		macs := make(map[string]bool)
+		for _, family := range families {
+			if family.GetName() == "cpe_wifi_rssi" {
+				for _, metric := range family.GetMetric() {
+					macs[label(metric, "client_mac")] = true
+				}
+			}
+		}
+		return macs
+	}
+	parameters := map[string]string{
+		"Device.DeviceInfo.SoftwareVersion":                       "S3.1.241",
+		"Device.WiFi.SSID.1.Name":                                 "wl0",
+		"Device.WiFi.AccessPoint.1.SSIDReference":                 "Device.WiFi.SSID.1",
+		"Device.WiFi.AccessPoint.1.AssociatedDevice.1.MACAddress": "3c:22:fb:00:00:09",
+		"Device.WiFi.AccessPoint.1.AssociatedDevice.2.MACAddress": "da:a1:19:00:00:01",
+	}
+	informACS(t, server.URL, parameters)
+	if got, want := clients(), map[string]bool{"3c:22:fb:00:00:09": true, "da:a1:19:00:00:01": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("wifi clients = %v, want %v", got, want)
+	}
+	// the client that left is no longer in the next response
+	delete(parameters, "Device.WiFi.AccessPoint.1.AssociatedDevice.2.MACAddress")
+	informACS(t, server.URL, parameters)
+	if got, want := clients(), map[string]bool{"3c:22:fb:00:00:09": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("wifi clients = %v, want %v", got, want)
+	}
+	acs.mu.Lock()
+	version := acs.devices["ZNTS01234567"].parameters["Device.DeviceInfo.SoftwareVersion"]
+	acs.mu.Unlock()
+	if version != "S3.1.241" {
+		t.Errorf("software version = %q, want the one of the response", version)
+	}
+}
+
+func TestACSLimits(t *testing.T) {
+	acs := NewACS("acs", "secret")
+	acs.MaxDevices = 2
+	inform := func(serial string, username string, password string) int {
+		body := strings.Replace(cwmpInformXML, "ZNTS01234567", serial, 1)
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.SetBasicAuth(username, password)
+		w := httptest.NewRecorder()
+		acs.ServeHTTP(w, req)
+		return w.Code
+	}
+	for _, test := range []struct {
+		name, serial, username, password string
+		want                             int
+	}{
+		{"wrong password", "ZNTS00000001", "acs", "guess", http.StatusUnauthorized},
+		{"wrong username", "ZNTS00000001", "admin", "secret", http.StatusUnauthorized},
+		{"first device", "ZNTS00000001", "acs", "secret", http.StatusOK},
+		{"second device", "ZNTS00000002", "acs", "secret", http.StatusOK},
+		{"known device", "ZNTS00000001", "acs", "secret", http.StatusOK},
+		{"one device too many", "ZNTS00000003", "acs", "secret", http.StatusServiceUnavailable},
+		{"serial too long", strings.Repeat("Z", acsMaxSerialLength+1), "acs", "secret", http.StatusBadRequest},
+	} {
+		if code := inform(test.serial, test.username, test.password); code != test.want {
+			t.Errorf("%s: HTTP %d, want %d", test.name, code, test.want)
+		}
+	}
+	acs.mu.Lock()
+	sessions := len(acs.sessions)
+	acs.devices["ZNTS00000002"].lastInform = time.Now().Add(-25 * time.Hour)
+	acs.mu.Unlock()
+	// the sessions the devices never completed are replaced by their next one
+	if sessions != 2 {
+		t.Errorf("%d sessions, want one per device", sessions)
+	}
+
+	// a device that stopped informing makes room for a new one
+	if code := inform("ZNTS00000003", "acs", "secret"); code != http.StatusOK {
+		t.Errorf("HTTP %d after a device expired", code)
+	}
+	acs.mu.Lock()
+	defer acs.mu.Unlock()
+	if _, ok := acs.devices["ZNTS00000002"]; ok || len(acs.devices) != 2 {
+		t.Errorf("devices after the expiry: %v", acs.devices)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"regexp"
+	"time"
+)
+
+// Snapshot holds the data retrieved from the gateway in a single scrape
+type Snapshot struct {
+	Time       time.Time
+	Interfaces []InterfaceData
+	// Ports holds the ethernet port details, when the transport provides them
+	Ports       map[string]EthernetPort
+	GPON        GPONData
+	WifiClients []WifiClient
+}
+
+// Transport retrieves the interface, GPON and wifi client data from the gateway
+type Transport interface {
+	Fetch() (*Snapshot, error)
+}
+
+// TransportConfig selects how the gateway is reached
+type TransportConfig struct {
+	// Transport is web, telnet or ssh
+	Transport string `yaml:"transport"`
+	// CLIAddress is the telnet or SSH server, the gateway on the standard port if empty
+	CLIAddress string `yaml:"cli_address"`
+	// SSHKnownHosts is the known_hosts file the gateway's SSH host key is verified against
+	SSHKnownHosts string `yaml:"ssh_known_hosts"`
+	// SSHInsecure accepts any SSH host key when there is no known_hosts file
+	SSHInsecure bool `yaml:"ssh_insecure"`
+}
+
+// wlanRE matches the WLAN interfaces, capturing the radio number
+var wlanRE = regexp.MustCompile(`wl(\d+)$`)
+
+// wlanRadios returns the numbers of the radios among the interfaces, as the wireless pages expect them
+func wlanRadios(interfaces []InterfaceData) []string {
+	var radios []string
+	for _, Interface := range interfaces {
+		wlanMatch := wlanRE.FindStringSubmatch(Interface.ID)
+		if wlanMatch != nil {
+			radios = append(radios, wlanMatch[1])
+		}
+	}
+	return radios
+}
+
+// WebTransport scrapes the Zhone Web Interface
+type WebTransport struct {
+	exporter *ZhoneExporter
+}
+
+// Fetch executes the web scrapes and parses the pages into a Snapshot
+func (t *WebTransport) Fetch() (*Snapshot, error) {
+	statsdata, status, gpondata, err := t.exporter.FetchData()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{}
+	if err := parse("ParseEthernetStatus", func() { snapshot.Ports = ParseEthernetStatus(status) }); err != nil {
+		return nil, err
+	}
+	if err := parse("ParseInterfaceData", func() { snapshot.Interfaces = ParseInterfaceData(statsdata, status) }); err != nil {
+		return nil, err
+	}
+	if err := parse("ParseGPONData", func() { snapshot.GPON = ParseGPONData(gpondata) }); err != nil {
+		return nil, err
+	}
+	wifi, err := t.exporter.FetchWirelessData(wlanRadios(snapshot.Interfaces))
+	if err != nil {
+		return nil, err
+	}
+	if err := parse("ParseWirelessData", func() { snapshot.WifiClients = ParseWirelessData(wifi) }); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	ssdpAddress       = "239.255.255.250:1900"
+	igdDeviceType     = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	wanCommonIfConfig = "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1"
+)
+
+var (
+	upnpUp = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "upnp", "up"), "Whether the UPnP IGD service of the gateway could be queried.", []string{
+			"instance",
+		}, nil)
+	upnpRXBytes = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "upnp", "receive_bytes"), "WAN received bytes reported by UPnP IGD. The gateway reports a 32 bit counter.", []string{
+			"instance",
+		}, nil)
+	upnpTXBytes = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "upnp", "transmit_bytes"), "WAN transmitted bytes reported by UPnP IGD. The gateway reports a 32 bit counter.", []string{
+			"instance",
+		}, nil)
+	upnpRXPackets = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "upnp", "receive_packets"), "WAN received packets reported by UPnP IGD.", []string{
+			"instance",
+		}, nil)
+	upnpTXPackets = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "upnp", "transmit_packets"), "WAN transmitted packets reported by UPnP IGD.", []string{
+			"instance",
+		}, nil)
+	upnpLinkUp = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "upnp", "link_up"), "WAN physical link status reported by UPnP IGD.", []string{
+			"instance",
+			"access_type",
+		}, nil)
+	upnpUpstream = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "upnp", "upstream_max_bits_per_second"), "WAN maximum upstream bit rate reported by UPnP IGD.", []string{
+			"instance",
+		}, nil)
+	upnpDownstream = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "upnp", "downstream_max_bits_per_second"), "WAN maximum downstream bit rate reported by UPnP IGD.", []string{
+			"instance",
+		}, nil)
+	upnpDifference = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "upnp", "web_difference_bytes"), "IGD WAN byte counter minus the low 32 bits of the web interface counter of the GPON interface, as of the latest scrape of the web interface. Traffic between the two reads gives small differences, a large one means either source is wrong.", []string{
+			"instance",
+			"direction",
+		}, nil)
+)
+
+// IGDLinkData contains the WAN counters and link properties of a UPnP Internet Gateway Device
+type IGDLinkData struct {
+	AccessType        string
+	LinkUp            float64
+	UpstreamMaxRate   float64
+	DownstreamMaxRate float64
+	rxBytes           float64
+	txBytes           float64
+	rxPackets         float64
+	txPackets         float64
+}
+
+// UPnPCollector reads the WAN counters from the UPnP IGD WANCommonInterfaceConfig service of the gateway,
+// as an alternative to scraping the web interface
+type UPnPCollector struct {
+	target string
+	// Location is the URL of the IGD device description. When empty it is discovered through SSDP
+	Location string
+	client   *http.Client
+
+	mu         sync.Mutex
+	controlURL string
+	// web holds the received and transmitted bytes of the GPON interface from the latest web scrape, for the cross-check
+	web      [2]float64
+	webValid bool
+}
+
+// NewUPnPCollector builds a UPnPCollector for the gateway at target
+func NewUPnPCollector(target string, location string) *UPnPCollector {
+	return &UPnPCollector{
+		target:   target,
+		Location: location,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// CrossCheck compares the IGD byte counters with the GPON interface counters of every snapshot the exporter scrapes
+func (u *UPnPCollector) CrossCheck(exporter *ZhoneExporter) {
+	exporter.Subscribe(func(snapshot *Snapshot) {
+		for _, iface := range snapshot.Interfaces {
+			if iface.ID == "eth0" {
+				u.mu.Lock()
+				u.web = [2]float64{iface.rxBytes, iface.txBytes}
+				u.webValid = true
+				u.mu.Unlock()
+			}
+		}
+	})
+}
+
+// counterDifference returns igd - web on the 32 bit counters of the IGD, so a wrap of either one isn't a difference
+func counterDifference(igd float64, web float64) float64 {
+	return float64(int32(uint32(uint64(igd)) - uint32(uint64(web))))
+}
+
+// Describe provides the descriptors of the UPnP metrics
+func (u *UPnPCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- upnpUp
+	ch <- upnpRXBytes
+	ch <- upnpTXBytes
+	ch <- upnpRXPackets
+	ch <- upnpTXPackets
+	ch <- upnpLinkUp
+	ch <- upnpUpstream
+	ch <- upnpDownstream
+	ch <- upnpDifference
+}
+
+// Collect queries the IGD and presents the WAN counters
+func (u *UPnPCollector) Collect(ch chan<- prometheus.Metric) {
+	link, err := u.FetchLinkData()
+	if err != nil {
+		log.Printf("Unable to query UPnP IGD: %v", err)
+		ch <- prometheus.MustNewConstMetric(upnpUp, prometheus.GaugeValue, 0, u.target)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(upnpUp, prometheus.GaugeValue, 1, u.target)
+	ch <- prometheus.MustNewConstMetric(upnpRXBytes, prometheus.GaugeValue, link.rxBytes, u.target)
+	ch <- prometheus.MustNewConstMetric(upnpTXBytes, prometheus.GaugeValue, link.txBytes, u.target)
+	ch <- prometheus.MustNewConstMetric(upnpRXPackets, prometheus.GaugeValue, link.rxPackets, u.target)
+	ch <- prometheus.MustNewConstMetric(upnpTXPackets, prometheus.GaugeValue, link.txPackets, u.target)
+	ch <- prometheus.MustNewConstMetric(upnpLinkUp, prometheus.GaugeValue, link.LinkUp, u.target, link.AccessType)
+	ch <- prometheus.MustNewConstMetric(upnpUpstream, prometheus.GaugeValue, link.UpstreamMaxRate, u.target)
+	ch <- prometheus.MustNewConstMetric(upnpDownstream, prometheus.GaugeValue, link.DownstreamMaxRate, u.target)
+	u.mu.Lock()
+	web, valid := u.web, u.webValid
+	u.mu.Unlock()
+	if valid {
+		ch <- prometheus.MustNewConstMetric(upnpDifference, prometheus.GaugeValue, counterDifference(link.rxBytes, web[0]), u.target, "receive")
+		ch <- prometheus.MustNewConstMetric(upnpDifference, prometheus.GaugeValue, counterDifference(link.txBytes, web[1]), u.target, "transmit")
+	}
+}
+
+// FetchLinkData performs the SOAP actions of the WANCommonInterfaceConfig service
+func (u *UPnPCollector) FetchLinkData() (IGDLinkData, error) {
+	var link IGDLinkData
+	controlURL, err := u.control()
+	if err != nil {
+		return link, err
+	}
+	counters := []struct {
+		action, argument string
+		value            *float64
+	}{
+		{"GetTotalBytesReceived", "NewTotalBytesReceived", &link.rxBytes},
+		{"GetTotalBytesSent", "NewTotalBytesSent", &link.txBytes},
+		{"GetTotalPacketsReceived", "NewTotalPacketsReceived", &link.rxPackets},
+		{"GetTotalPacketsSent", "NewTotalPacketsSent", &link.txPackets},
+	}
+	for _, counter := range counters {
+		values, err := u.soapCall(controlURL, counter.action)
+		if err != nil {
+			return link, err
+		}
+		*counter.value, err = strconv.ParseFloat(values[counter.argument], 64)
+		if err != nil {
+			return link, fmt.Errorf("%s: %w", counter.action, err)
+		}
+	}
+	values, err := u.soapCall(controlURL, "GetCommonLinkProperties")
+	if err != nil {
+		return link, err
+	}
+	link.AccessType = values["NewWANAccessType"]
+	link.UpstreamMaxRate, _ = strconv.ParseFloat(values["NewLayer1UpstreamMaxBitRate"], 64)
+	link.DownstreamMaxRate, _ = strconv.ParseFloat(values["NewLayer1DownstreamMaxBitRate"], 64)
+	if values["NewPhysicalLinkStatus"] == "Up" {
+		link.LinkUp = 1
+	}
+	return link, nil
+}
+
+// control returns the control URL of the WANCommonInterfaceConfig service, discovering it on first use.
+// The discovery runs without the lock, which the cross-check takes on every web scrape
+func (u *UPnPCollector) control() (string, error) {
+	u.mu.Lock()
+	controlURL := u.controlURL
+	u.mu.Unlock()
+	if controlURL != "" {
+		return controlURL, nil
+	}
+	location := u.Location
+	if location == "" {
+		var err error
+		location, err = DiscoverIGD(u.target, 3*time.Second)
+		if err != nil {
+			return "", err
+		}
+	}
+	controlURL, err := u.describe(location)
+	if err != nil {
+		return "", err
+	}
+	u.mu.Lock()
+	u.controlURL = controlURL
+	u.mu.Unlock()
+	return controlURL, nil
+}
+
+// igdDescription is the subset of the UPnP device description needed to locate the WAN services
+type igdDescription struct {
+	URLBase string    `xml:"URLBase"`
+	Device  igdDevice `xml:"device"`
+}
+
+type igdDevice struct {
+	DeviceType string       `xml:"deviceType"`
+	Services   []igdService `xml:"serviceList>service"`
+	Devices    []igdDevice  `xml:"deviceList>device"`
+}
+
+type igdService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// findService searches the device tree, the WAN services live in embedded WANDevice and WANConnectionDevice devices
+func (d igdDevice) findService(serviceType string) (igdService, bool) {
+	for _, service := range d.Services {
+		if service.ServiceType == serviceType {
+			return service, true
+		}
+	}
+	for _, device := range d.Devices {
+		if service, ok := device.findService(serviceType); ok {
+			return service, true
+		}
+	}
+	return igdService{}, false
+}
+
+// describe fetches the device description and resolves the control URL of the WANCommonInterfaceConfig service
+func (u *UPnPCollector) describe(location string) (string, error) {
+	res, err := u.client.Get(location)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("Status code: %d %s: %s", res.StatusCode, res.Status, location)
+	}
+	var description igdDescription
+	if err := xml.NewDecoder(res.Body).Decode(&description); err != nil {
+		return "", fmt.Errorf("%s: %w", location, err)
+	}
+	service, ok := description.Device.findService(wanCommonIfConfig)
+	if !ok {
+		return "", fmt.Errorf("%s: no %s service", location, wanCommonIfConfig)
+	}
+	base := location
+	if description.URLBase != "" {
+		base = description.URLBase
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	controlURL, err := baseURL.Parse(service.ControlURL)
+	if err != nil {
+		return "", err
+	}
+	return controlURL.String(), nil
+}
+
+// soapCall invokes an action without arguments and returns the output arguments of the response
+func (u *UPnPCollector) soapCall(controlURL string, action string) (map[string]string, error) {
+	body := fmt.Sprintf(`<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:%s xmlns:u="%s"/></s:Body>
+</s:Envelope>`, action, wanCommonIfConfig)
+	req, err := http.NewRequest("POST", controlURL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, wanCommonIfConfig, action))
+	res, err := u.client.Do(req)
+	if err != nil {
+		u.forget()
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		u.forget()
+		return nil, fmt.Errorf("%s: Status code: %d %s", action, res.StatusCode, res.Status)
+	}
+	// the output arguments are the children of the <u:ActionResponse> element
+	values := make(map[string]string)
+	decoder := xml.NewDecoder(res.Body)
+	depth := 0
+	var name string
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			name = t.Name.Local
+		case xml.CharData:
+			// Envelope > Body > ActionResponse > argument
+			if depth == 4 {
+				values[name] = strings.TrimSpace(string(t))
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return values, nil
+}
+
+// forget drops the cached control URL, so the IGD is discovered again after the gateway restarts
+func (u *UPnPCollector) forget() {
+	u.mu.Lock()
+	u.controlURL = ""
+	u.mu.Unlock()
+}
+
+// DiscoverIGD sends an SSDP M-SEARCH for Internet Gateway Devices and returns the description URL announced by target
+func DiscoverIGD(target string, timeout time.Duration) (string, error) {
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return "", err
+	}
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	ssdp, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		return "", err
+	}
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddress + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: " + igdDeviceType + "\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), ssdp); err != nil {
+		return "", err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 2048)
+	for {
+		n, remote, err := conn.ReadFrom(buf)
+		if err != nil {
+			return "", fmt.Errorf("no UPnP IGD answered from %s: %w", host, err)
+		}
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		res.Body.Close()
+		location := res.Header.Get("Location")
+		remoteHost, _, _ := net.SplitHostPort(remote.String())
+		for _, addr := range addrs {
+			if addr == remoteHost && location != "" {
+				return location, nil
+			}
+		}
+	}
+}
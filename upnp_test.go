@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const igdDescriptionXML = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<friendlyName>ZNID-GPON-2726A1-UK</friendlyName>
+<serviceList>
+<service><serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType><controlURL>/l3f</controlURL></service>
+</serviceList>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<serviceList>
+<service><serviceType>urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1</serviceType><controlURL>ctl/wancic</controlURL></service>
+</serviceList>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList>
+<service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType><controlURL>/ctl/wanip</controlURL></service>
+</serviceList>
+</device>
+</deviceList>
+</device>
+</deviceList>
+</device>
+</root>`
+
+// fakeIGD is an Internet Gateway Device answering the WANCommonInterfaceConfig actions
+type fakeIGD struct {
+	*httptest.Server
+	mu           sync.Mutex
+	values       map[string]string
+	descriptions int
+	fail         bool
+}
+
+func newFakeIGD(t *testing.T) *fakeIGD {
+	igd := &fakeIGD{values: map[string]string{
+		"GetTotalBytesReceived":   "4000000000",
+		"GetTotalBytesSent":       "1000",
+		"GetTotalPacketsReceived": "3000000",
+		"GetTotalPacketsSent":     "20000",
+	}}
+	igd.Server = httptest.NewServer(http.HandlerFunc(igd.serve))
+	t.Cleanup(igd.Close)
+	return igd
+}
+
+func (igd *fakeIGD) serve(w http.ResponseWriter, r *http.Request) {
+	igd.mu.Lock()
+	defer igd.mu.Unlock()
+	switch r.URL.Path {
+	case "/rootDesc.xml":
+		igd.descriptions++
+		fmt.Fprint(w, igdDescriptionXML)
+		return
+	case "/ctl/wancic":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	action := strings.TrimSuffix(strings.TrimPrefix(r.Header.Get("SOAPAction"), `"`+wanCommonIfConfig+"#"), `"`)
+	if igd.fail || r.Method != "POST" || !strings.Contains(string(body), "<u:"+action+" ") {
+		http.Error(w, "UPnPError", http.StatusInternalServerError)
+		return
+	}
+	var arguments string
+	switch action {
+	case "GetCommonLinkProperties":
+		arguments = `<NewWANAccessType>Ethernet</NewWANAccessType>
+<NewLayer1UpstreamMaxBitRate>1244160000</NewLayer1UpstreamMaxBitRate>
+<NewLayer1DownstreamMaxBitRate>2488320000</NewLayer1DownstreamMaxBitRate>
+<NewPhysicalLinkStatus>Up</NewPhysicalLinkStatus>`
+	default:
+		value, ok := igd.values[action]
+		if !ok {
+			http.Error(w, "UPnPError", http.StatusInternalServerError)
+			return
+		}
+		arguments = fmt.Sprintf("<New%s>%s</New%s>", strings.TrimPrefix(action, "Get"), value, strings.TrimPrefix(action, "Get"))
+	}
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:%sResponse xmlns:u="%s">
+%s
+</u:%sResponse></s:Body>
+</s:Envelope>`, action, wanCommonIfConfig, arguments, action)
+}
+
+func TestUPnPFetchLinkData(t *testing.T) {
+	igd := newFakeIGD(t)
+	collector := NewUPnPCollector("gateway", igd.URL+"/rootDesc.xml")
+	link, err := collector.FetchLinkData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := IGDLinkData{
+		AccessType:        "Ethernet",
+		LinkUp:            1,
+		UpstreamMaxRate:   1244160000,
+		DownstreamMaxRate: 2488320000,
+		rxBytes:           4000000000,
+		txBytes:           1000,
+		rxPackets:         3000000,
+		txPackets:         20000,
+	}
+	if link != want {
+		t.Errorf("FetchLinkData = %+v, want %+v", link, want)
+	}
+	if collector.controlURL != igd.URL+"/ctl/wancic" {
+		t.Errorf("control URL = %q, want it resolved against the description URL", collector.controlURL)
+	}
+
+	// a failing action drops the control URL, so the description is fetched again once the IGD is back
+	igd.mu.Lock()
+	igd.fail = true
+	igd.mu.Unlock()
+	if _, err := collector.FetchLinkData(); err == nil {
+		t.Fatal("FetchLinkData succeeded on a failing IGD")
+	}
+	igd.mu.Lock()
+	igd.fail = false
+	igd.mu.Unlock()
+	if _, err := collector.FetchLinkData(); err != nil {
+		t.Fatal(err)
+	}
+	if igd.descriptions != 2 {
+		t.Errorf("description fetched %d times, want 2", igd.descriptions)
+	}
+}
+
+func TestUPnPCrossCheck(t *testing.T) {
+	igd := newFakeIGD(t)
+	collector := NewUPnPCollector("gateway", igd.URL+"/rootDesc.xml")
+	exporter := NewZhoneExporter("gateway", "user", "user")
+	exporter.Transport = transportFunc(func() (*Snapshot, error) {
+		return &Snapshot{Interfaces: []InterfaceData{
+			// 4294967296+4000000000-1500 bytes, the IGD counter has wrapped once and saw 1500 bytes more
+			{ID: "eth0", rxBytes: 8294965796, txBytes: 1200},
+			{ID: "eth1", rxBytes: 1, txBytes: 1},
+		}}, nil
+	})
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collector)
+	if n := testutil.CollectAndCount(collector, "cpe_upnp_web_difference_bytes"); n != 0 {
+		t.Errorf("got %d cross-check series before a web scrape, want none", n)
+	}
+	collector.CrossCheck(exporter)
+	if _, err := exporter.Scrape(); err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+# HELP cpe_upnp_web_difference_bytes IGD WAN byte counter minus the low 32 bits of the web interface counter of the GPON interface, as of the latest scrape of the web interface. Traffic between the two reads gives small differences, a large one means either source is wrong.
+# TYPE cpe_upnp_web_difference_bytes gauge
+cpe_upnp_web_difference_bytes{direction="receive",instance="gateway"} 1500
+cpe_upnp_web_difference_bytes{direction="transmit",instance="gateway"} -200
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "cpe_upnp_web_difference_bytes"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUPnPDiscoveryDoesNotBlockCrossCheck(t *testing.T) {
+	igd := newFakeIGD(t)
+	requested := make(chan bool)
+	release := make(chan bool)
+	// a description server slow to answer, as a gateway busy rebooting
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- true
+		<-release
+		fmt.Fprint(w, strings.Replace(igdDescriptionXML, "ctl/wancic", igd.URL+"/ctl/wancic", 1))
+	}))
+	defer slow.Close()
+	collector := NewUPnPCollector("gateway", slow.URL+"/rootDesc.xml")
+	exporter := NewZhoneExporter("gateway", "user", "user")
+	exporter.Transport = transportFunc(func() (*Snapshot, error) {
+		return &Snapshot{Interfaces: []InterfaceData{{ID: "eth0", rxBytes: 1000, txBytes: 1000}}}, nil
+	})
+	collector.CrossCheck(exporter)
+
+	fetched := make(chan error)
+	go func() {
+		_, err := collector.FetchLinkData()
+		fetched <- err
+	}()
+	<-requested
+	scraped := make(chan error)
+	go func() {
+		_, err := exporter.Scrape()
+		scraped <- err
+	}()
+	select {
+	case err := <-scraped:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the web scrape waited for the IGD discovery")
+	}
+	close(release)
+	if err := <-fetched; err != nil {
+		t.Fatal(err)
+	}
+	if collector.controlURL != igd.URL+"/ctl/wancic" {
+		t.Errorf("control URL = %q after the discovery", collector.controlURL)
+	}
+}
+
+func TestUPnPCollectDown(t *testing.T) {
+	igd := newFakeIGD(t)
+	igd.fail = true
+	collector := NewUPnPCollector("gateway", igd.URL+"/rootDesc.xml")
+	expected := `
+# HELP cpe_upnp_up Whether the UPnP IGD service of the gateway could be queried.
+# TYPE cpe_upnp_up gauge
+cpe_upnp_up{instance="gateway"} 0
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+// transportFunc serves snapshots from a function, in place of the gateway
+type transportFunc func() (*Snapshot, error)
+
+func (f transportFunc) Fetch() (*Snapshot, error) {
+	return f()
+}
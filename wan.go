@@ -0,0 +1,182 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WANService contains the state of a single WAN service configured on the gateway
+type WANService struct {
+	Service    string
+	Interface  string
+	VLAN       string
+	Protocol   string
+	IPv4       string
+	IPv6Prefix string
+	Gateway    string
+	DNS        string
+	Up         float64
+	// Uptime is the session uptime in seconds, or -1 if the gateway does not report it
+	Uptime float64
+}
+
+var (
+	wanInfo = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "wan", "info"), "WAN service configuration and addressing.", []string{
+			"instance",
+			"interface",
+			"service",
+			"vlan",
+			"protocol",
+			"ipv4",
+			"ipv6_prefix",
+			"gateway",
+			"dns",
+		}, nil)
+	wanUp = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "wan", "connection_up"), "WAN service connection status.", []string{
+			"instance",
+			"interface",
+			"service",
+		}, nil)
+	wanUptime = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "wan", "uptime_seconds"), "WAN service session uptime.", []string{
+			"instance",
+			"interface",
+			"service",
+		}, nil)
+)
+
+// labelValues collects the rows of the form "label | value" on a page, as used by the device and GPON information pages
+func labelValues(data *goquery.Document) map[string]string {
+	values := make(map[string]string)
+	data.Find("tr").Each(func(_ int, row *goquery.Selection) {
+		columns := row.Find("td")
+		if columns.Length() != 2 {
+			return
+		}
+		label := strings.TrimSuffix(strings.TrimSpace(columns.Eq(0).Text()), ":")
+		values[label] = strings.TrimSpace(columns.Eq(1).Text())
+	})
+	return values
+}
+
+// uptimeUnitRE matches the parts of an uptime such as "1D 2H 3M 4S"
+var uptimeUnitRE = regexp.MustCompile(`(\d+)\s*([DdHhMmSs])`)
+
+// parseUptime converts the uptimes shown by the gateway, either "1D 2H 3M 4S" or "01:02:03", into seconds
+func parseUptime(s string) float64 {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return -1
+	}
+	if strings.Contains(s, ":") {
+		var seconds float64
+		for _, part := range strings.Split(s, ":") {
+			value, err := strconv.ParseFloat(part, 64)
+			if err != nil {
+				return -1
+			}
+			seconds = seconds*60 + value
+		}
+		return seconds
+	}
+	matches := uptimeUnitRE.FindAllStringSubmatch(s, -1)
+	if matches == nil {
+		return -1
+	}
+	units := map[string]float64{"d": 86400, "h": 3600, "m": 60, "s": 1}
+	var seconds float64
+	for _, match := range matches {
+		value, _ := strconv.ParseFloat(match[1], 64)
+		seconds += value * units[strings.ToLower(match[2])]
+	}
+	return seconds
+}
+
+// ParseWANData parses the WAN service summary, completed with the default gateway and DNS servers from the device information page
+func ParseWANData(data *goquery.Document, infodata *goquery.Document) []WANService {
+	var services []WANService
+	info := labelValues(infodata)
+	var dns []string
+	for _, label := range []string{"Primary DNS Server", "Secondary DNS Server"} {
+		if info[label] != "" && info[label] != "0.0.0.0" {
+			dns = append(dns, info[label])
+		}
+	}
+	for _, row := range tableColumns(data, "VlanMuxId") {
+		service := WANService{
+			Service:    row["description"],
+			Interface:  row["interface"],
+			VLAN:       row["vlanmuxid"],
+			Protocol:   row["type"],
+			IPv4:       row["ipv4 address"],
+			IPv6Prefix: row["ipv6 prefix"],
+			Uptime:     parseUptime(row["uptime"]),
+		}
+		if service.Service == "" {
+			service.Service = service.Interface
+		}
+		if service.VLAN == "-1" {
+			service.VLAN = ""
+		}
+		status := strings.ToLower(row["status"])
+		if status == "connected" || status == "up" {
+			service.Up = 1
+			// the gateway has a single routing table, so the default route and resolvers belong to the connected services
+			service.Gateway = info["Default Gateway"]
+			service.DNS = strings.Join(dns, ",")
+		}
+		services = append(services, service)
+	}
+	return services
+}
+
+// FetchWANData executes the web scrapes for the WAN service summary and the device information page
+func (e *ZhoneExporter) FetchWANData() (*goquery.Document, *goquery.Document, error) {
+	wandata, err := e.fetchPage("wancfg.cmd", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	infodata, err := e.fetchPage("info.html", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return wandata, infodata, nil
+}
+
+// collectWAN exports one series per configured WAN service. Services are told apart by their interface,
+// as several can share a description
+func (e *ZhoneExporter) collectWAN(ch chan<- prometheus.Metric) {
+	wandata, infodata, err := e.FetchWANData()
+	if err != nil {
+		log.Printf("Unable to fetch WAN services: %v", err)
+		return
+	}
+	var services []WANService
+	if err := parse("ParseWANData", func() { services = ParseWANData(wandata, infodata) }); err != nil {
+		log.Printf("Unable to parse WAN services: %v", err)
+		return
+	}
+	for _, wan := range services {
+		ch <- prometheus.MustNewConstMetric(
+			wanInfo, prometheus.GaugeValue, 1, e.Instance, wan.Interface, wan.Service, wan.VLAN, wan.Protocol, wan.IPv4, wan.IPv6Prefix, wan.Gateway, wan.DNS,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			wanUp, prometheus.GaugeValue, wan.Up, e.Instance, wan.Interface, wan.Service,
+		)
+		if wan.Uptime >= 0 {
+			ch <- prometheus.MustNewConstMetric(
+				wanUptime, prometheus.GaugeValue, wan.Uptime, e.Instance, wan.Interface, wan.Service,
+			)
+		}
+	}
+}
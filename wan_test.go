@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// testGateway serves captured pages from testdata as the gateway's web interface, pages mapping a path to a file
+func testGateway(t *testing.T, pages map[string]string) *ZhoneExporter {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join("testdata", file))
+	}))
+	t.Cleanup(server.Close)
+	return NewZhoneExporter(strings.TrimPrefix(server.URL, "http://"), "user", "user")
+}
+
+func TestParseUptime(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		want  float64
+	}{
+		{"1D 2H 3M 4S", 93784},
+		{"2h 0m 5s", 7205},
+		{"45S", 45},
+		{"01:02:03", 3723},
+		{"3:04", 184},
+		{"", -1},
+		{"  ", -1},
+		{"N/A", -1},
+		{"01:xx:03", -1},
+	} {
+		if got := parseUptime(test.input); got != test.want {
+			t.Errorf("parseUptime(%q) = %v, want %v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestParseWANData(t *testing.T) {
+	got := ParseWANData(readPage(t, "wancfg.cmd.html"), readPage(t, "info.html"))
+	want := []WANService{
+		{Service: "internet", Interface: "ppp0.1", VLAN: "10", Protocol: "PPPoE", IPv4: "81.2.3.4", IPv6Prefix: "2a02:8010:1234::/48", Gateway: "81.2.3.1", DNS: "81.2.3.53", Up: 1, Uptime: 93784},
+		{Service: "internet", Interface: "veip0.2", Protocol: "IPoE", Uptime: -1},
+		{Service: "veip0.3", Interface: "veip0.3", VLAN: "101", Protocol: "Bridge", Gateway: "81.2.3.1", DNS: "81.2.3.53", Up: 1, Uptime: 605},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseWANData =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+// two services sharing a description must not produce duplicate series, which fail the whole scrape
+func TestCollectWANSharedDescription(t *testing.T) {
+	exporter := testGateway(t, map[string]string{"/wancfg.cmd": "wancfg.cmd.html", "/info.html": "info.html"})
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collectorFunc(exporter.collectWAN))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for _, family := range families {
+		counts[family.GetName()] = len(family.GetMetric())
+	}
+	want := map[string]int{"cpe_wan_info": 3, "cpe_wan_connection_up": 3, "cpe_wan_uptime_seconds": 2}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("got series %v, want %v", counts, want)
+	}
+}
+
+// collectorFunc registers a single collect function of the exporter, describing the metrics as it collects them
+type collectorFunc func(chan<- prometheus.Metric)
+
+func (f collectorFunc) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(f, ch)
+}
+
+func (f collectorFunc) Collect(ch chan<- prometheus.Metric) {
+	f(ch)
+}
@@ -3,21 +3,32 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
+	kitlog "github.com/go-kit/log"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 // InterfaceData is a struct providing a container for all relevant interface metrics available on the Zhone CPE platform
@@ -67,6 +78,11 @@ type WifiClient struct {
 }
 
 var (
+	up = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "", "up"), "Whether the gateway could be reached and its data retrieved.", []string{
+			"instance",
+		}, nil)
 	rxBytes = prometheus.NewDesc(
 		prometheus.BuildFQName(
 			"cpe", "", "receive_bytes"), "Received bytes per interface.", []string{
@@ -256,24 +272,144 @@ var (
 			"wlan_interface",
 			"client_mac",
 		}, nil)
+	wifiClientInfo = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			"cpe", "wifi", "client_info"), "Wifi client vendor, looked up from the OUI of the MAC address", []string{
+			"instance",
+			"wlan_interface",
+			"client_mac",
+			"vendor",
+			"randomized",
+		}, nil)
 )
 
 // ZhoneExporter contains the authentication parameters for the Zhone Web Interface
 type ZhoneExporter struct {
 	URL, username, password string
+	// Instance is the instance label of the metrics, the URL unless the gateway has an alias
+	Instance string
+	// OUI is used to resolve the vendor of wifi clients
+	OUI *OUIDatabase
+	// Transport retrieves the data from the gateway, the web interface unless configured otherwise
+	Transport Transport
+
+	mutex              sync.Mutex
+	subscribers        []func(*Snapshot)
+	failureSubscribers []func(error)
+	// inflight holds the start time of the scrapes in progress
+	inflight   map[int64]time.Time
+	lastScrape int64
 }
 
 // NewZhoneExporter builds a new ZhoneExporter with the credentials provided
 func NewZhoneExporter(url string, username string, password string) *ZhoneExporter {
-	return &ZhoneExporter{
+	e := &ZhoneExporter{
 		URL:      url,
+		Instance: url,
 		username: username,
 		password: password,
+		OUI:      NewOUIDatabase(),
+	}
+	e.Transport = &WebTransport{exporter: e}
+	return e
+}
+
+// Credentials returns the username and password used to log in on the gateway
+func (e *ZhoneExporter) Credentials() (string, string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.username, e.password
+}
+
+// SetCredentials changes the username and password, taking effect from the next page fetched or login
+func (e *ZhoneExporter) SetCredentials(username string, password string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.username, e.password = username, password
+}
+
+// Scrape retrieves a snapshot of the gateway's interfaces, GPON link and wifi clients through the configured transport
+func (e *ZhoneExporter) Scrape() (*Snapshot, error) {
+	start := time.Now()
+	e.mutex.Lock()
+	if e.inflight == nil {
+		e.inflight = make(map[int64]time.Time)
+	}
+	e.lastScrape++
+	id := e.lastScrape
+	e.inflight[id] = start
+	e.mutex.Unlock()
+	snapshot, err := e.Transport.Fetch()
+	scrapeDuration.Observe(time.Since(start).Seconds())
+	e.mutex.Lock()
+	delete(e.inflight, id)
+	e.mutex.Unlock()
+	if err != nil {
+		e.mutex.Lock()
+		failureSubscribers := e.failureSubscribers
+		e.mutex.Unlock()
+		for _, subscriber := range failureSubscribers {
+			subscriber(err)
+		}
+		return nil, err
+	}
+	snapshot.Time = time.Now()
+	// the GPON status page doesn't name the link, which is the eth0 interface
+	for _, Interface := range snapshot.Interfaces {
+		if Interface.ID == "eth0" && snapshot.GPON.ID == "" {
+			snapshot.GPON.ID = Interface.ID
+			snapshot.GPON.Name = Interface.Name
+		}
+	}
+	observeSnapshot(snapshot)
+	e.mutex.Lock()
+	subscribers := e.subscribers
+	e.mutex.Unlock()
+	for _, subscriber := range subscribers {
+		subscriber(snapshot)
+	}
+	return snapshot, nil
+}
+
+// Hung tells whether a scrape has been in progress for longer than limit
+func (e *ZhoneExporter) Hung(limit time.Duration) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, start := range e.inflight {
+		if time.Since(start) > limit {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribe registers a function to be called with every snapshot scraped
+func (e *ZhoneExporter) Subscribe(subscriber func(*Snapshot)) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.subscribers = append(e.subscribers, subscriber)
+}
+
+// SubscribeFailures registers a function to be called with the error of every failed scrape
+func (e *ZhoneExporter) SubscribeFailures(subscriber func(error)) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.failureSubscribers = append(e.failureSubscribers, subscriber)
+}
+
+// Poll scrapes the gateway every interval, so subscribers are served without a Prometheus scrape
+func (e *ZhoneExporter) Poll(interval time.Duration) {
+	for {
+		if _, err := e.Scrape(); err != nil {
+			log.Printf("Poll: %v", err)
+		}
+		time.Sleep(interval)
 	}
 }
 
 // Describe provides the superset of descriptors to the provided channel
 func (e *ZhoneExporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- up
 	ch <- rxBytes
 	ch <- txBytes
 	ch <- rxFrames
@@ -301,116 +437,146 @@ func (e *ZhoneExporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- wifiNoise
 	ch <- wifiSNR
 	ch <- wifiQuality
+	ch <- wifiClientInfo
+	ch <- lanHostInfo
+	ch <- lanHosts
+	ch <- wanInfo
+	ch <- wanUp
+	ch <- wanUptime
+	ch <- ethernetLinkState
+	ch <- ethernetSpeed
+	ch <- ethernetInfo
 
 }
 
 // Collect will gather, parse and present the available Prometheus metrics
 func (e *ZhoneExporter) Collect(ch chan<- prometheus.Metric) {
-	statsdata, status, gpondata := e.FetchData()
-	gpon := ParseGPONData(gpondata)
-	interfaces := ParseInterfaceData(statsdata, status)
-	wlanRE := regexp.MustCompile(`wl(\d+)$`)
-	var wlanIDs []string
-	for _, Interface := range interfaces {
-		wlanMatch := wlanRE.FindStringSubmatch(Interface.ID)
-		if wlanMatch != nil {
-			wlanIDs = append(wlanIDs, wlanMatch[1])
-		}
+	snapshot, err := e.Scrape()
+	if err != nil {
+		log.Printf("Unable to collect from %s: %v", e.URL, err)
+		ch <- prometheus.MustNewConstMetric(up, prometheus.GaugeValue, 0, e.Instance)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(up, prometheus.GaugeValue, 1, e.Instance)
+	gpon := snapshot.GPON
+	e.collectEthernet(ch, snapshot.Ports)
+	for _, Interface := range snapshot.Interfaces {
 		if Interface.ID == "eth0" {
 			Interface.Status = gpon.Status
-			gpon.ID = Interface.ID
-			gpon.Name = Interface.Name
 			ch <- prometheus.MustNewConstMetric(
-				gponRX, prometheus.GaugeValue, gpon.RXPower, e.URL, Interface.ID, Interface.Name,
+				gponRX, prometheus.GaugeValue, gpon.RXPower, e.Instance, Interface.ID, Interface.Name,
 			)
 			ch <- prometheus.MustNewConstMetric(
-				gponTX, prometheus.GaugeValue, gpon.TXPower, e.URL, Interface.ID, Interface.Name,
+				gponTX, prometheus.GaugeValue, gpon.TXPower, e.Instance, Interface.ID, Interface.Name,
 			)
 			ch <- prometheus.MustNewConstMetric(
-				gponTransitions, prometheus.GaugeValue, gpon.Transitions, e.URL, Interface.ID, Interface.Name,
+				gponTransitions, prometheus.GaugeValue, gpon.Transitions, e.Instance, Interface.ID, Interface.Name,
 			)
 		}
 		ch <- prometheus.MustNewConstMetric(
-			rxBytes, prometheus.GaugeValue, Interface.rxBytes, e.URL, Interface.ID, Interface.Name,
+			rxBytes, prometheus.GaugeValue, Interface.rxBytes, e.Instance, Interface.ID, Interface.Name,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			txBytes, prometheus.GaugeValue, Interface.txBytes, e.URL, Interface.ID, Interface.Name,
+			txBytes, prometheus.GaugeValue, Interface.txBytes, e.Instance, Interface.ID, Interface.Name,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			rxFrames, prometheus.GaugeValue, Interface.rxFrames, e.URL, Interface.ID, Interface.Name,
+			rxFrames, prometheus.GaugeValue, Interface.rxFrames, e.Instance, Interface.ID, Interface.Name,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			txFrames, prometheus.GaugeValue, Interface.txFrames, e.URL, Interface.ID, Interface.Name,
+			txFrames, prometheus.GaugeValue, Interface.txFrames, e.Instance, Interface.ID, Interface.Name,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			rxDrops, prometheus.GaugeValue, Interface.rxDrops, e.URL, Interface.ID, Interface.Name,
+			rxDrops, prometheus.GaugeValue, Interface.rxDrops, e.Instance, Interface.ID, Interface.Name,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			txDrops, prometheus.GaugeValue, Interface.txDrops, e.URL, Interface.ID, Interface.Name,
+			txDrops, prometheus.GaugeValue, Interface.txDrops, e.Instance, Interface.ID, Interface.Name,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			rxErrs, prometheus.GaugeValue, Interface.rxErrs, e.URL, Interface.ID, Interface.Name,
+			rxErrs, prometheus.GaugeValue, Interface.rxErrs, e.Instance, Interface.ID, Interface.Name,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			txErrs, prometheus.GaugeValue, Interface.txErrs, e.URL, Interface.ID, Interface.Name,
+			txErrs, prometheus.GaugeValue, Interface.txErrs, e.Instance, Interface.ID, Interface.Name,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			interfaceSpeed, prometheus.GaugeValue, Interface.IfSpeed, e.URL, Interface.ID, Interface.Name,
+			interfaceSpeed, prometheus.GaugeValue, Interface.IfSpeed, e.Instance, Interface.ID, Interface.Name,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			interfaceStatus, prometheus.GaugeValue, Interface.Status, e.URL, Interface.ID, Interface.Name,
+			interfaceStatus, prometheus.GaugeValue, Interface.Status, e.Instance, Interface.ID, Interface.Name,
 		)
 	}
-	wifi := e.FetchWirelessData(wlanIDs)
-	wlanClients := ParseWirelessData(wifi)
+	wlanClients := snapshot.WifiClients
 	for i := range wlanClients {
 		wlan := wlanClients[i]
 		ch <- prometheus.MustNewConstMetric(
-			wifiAssoc, prometheus.GaugeValue, wlan.AssociatedTime, e.URL, wlan.Interface, wlan.MAC,
+			wifiAssoc, prometheus.GaugeValue, wlan.AssociatedTime, e.Instance, wlan.Interface, wlan.MAC,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			wifiTX, prometheus.GaugeValue, wlan.txFrames, e.URL, wlan.Interface, wlan.MAC,
+			wifiTX, prometheus.GaugeValue, wlan.txFrames, e.Instance, wlan.Interface, wlan.MAC,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			wifiTXUnicast, prometheus.GaugeValue, wlan.TXUnicastFrames, e.URL, wlan.Interface, wlan.MAC,
+			wifiTXUnicast, prometheus.GaugeValue, wlan.TXUnicastFrames, e.Instance, wlan.Interface, wlan.MAC,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			wifiErrs, prometheus.GaugeValue, wlan.txErrs, e.URL, wlan.Interface, wlan.MAC,
+			wifiErrs, prometheus.GaugeValue, wlan.txErrs, e.Instance, wlan.Interface, wlan.MAC,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			wifiRetries, prometheus.GaugeValue, wlan.TXRetries, e.URL, wlan.Interface, wlan.MAC,
+			wifiRetries, prometheus.GaugeValue, wlan.TXRetries, e.Instance, wlan.Interface, wlan.MAC,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			wifiRetryRate, prometheus.GaugeValue, wlan.TxRetryRate, e.URL, wlan.Interface, wlan.MAC,
+			wifiRetryRate, prometheus.GaugeValue, wlan.TxRetryRate, e.Instance, wlan.Interface, wlan.MAC,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			wifiRXUnicast, prometheus.GaugeValue, wlan.RXUnicastFrames, e.URL, wlan.Interface, wlan.MAC,
+			wifiRXUnicast, prometheus.GaugeValue, wlan.RXUnicastFrames, e.Instance, wlan.Interface, wlan.MAC,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			wifiBcast, prometheus.GaugeValue, wlan.RXBcastFrames, e.URL, wlan.Interface, wlan.MAC,
+			wifiBcast, prometheus.GaugeValue, wlan.RXBcastFrames, e.Instance, wlan.Interface, wlan.MAC,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			wifiTXRate, prometheus.GaugeValue, wlan.TXRate, e.URL, wlan.Interface, wlan.MAC,
+			wifiTXRate, prometheus.GaugeValue, wlan.TXRate, e.Instance, wlan.Interface, wlan.MAC,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			wifiRXRate, prometheus.GaugeValue, wlan.RXRate, e.URL, wlan.Interface, wlan.MAC,
+			wifiRXRate, prometheus.GaugeValue, wlan.RXRate, e.Instance, wlan.Interface, wlan.MAC,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			wifiRSSI, prometheus.GaugeValue, wlan.RSSI, e.URL, wlan.Interface, wlan.MAC,
+			wifiRSSI, prometheus.GaugeValue, wlan.RSSI, e.Instance, wlan.Interface, wlan.MAC,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			wifiNoise, prometheus.GaugeValue, wlan.Noise, e.URL, wlan.Interface, wlan.MAC,
+			wifiNoise, prometheus.GaugeValue, wlan.Noise, e.Instance, wlan.Interface, wlan.MAC,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			wifiSNR, prometheus.GaugeValue, wlan.SNR, e.URL, wlan.Interface, wlan.MAC,
+			wifiSNR, prometheus.GaugeValue, wlan.SNR, e.Instance, wlan.Interface, wlan.MAC,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			wifiQuality, prometheus.GaugeValue, wlan.Quality, e.URL, wlan.Interface, wlan.MAC,
+			wifiQuality, prometheus.GaugeValue, wlan.Quality, e.Instance, wlan.Interface, wlan.MAC,
 		)
+		vendor, randomized := e.clientVendor(wlan.MAC)
+		ch <- prometheus.MustNewConstMetric(
+			wifiClientInfo, prometheus.GaugeValue, 1, e.Instance, wlan.Interface, wlan.MAC, vendor, strconv.FormatBool(randomized),
+		)
+	}
+	// the LAN and WAN tables are only available from the web interface
+	if _, ok := e.Transport.(*WebTransport); ok {
+		e.collectLAN(ch)
+		e.collectWAN(ch)
 	}
 
 }
 
+// clientVendor resolves the vendor of a client MAC address. Randomized addresses carry no vendor information
+func (e *ZhoneExporter) clientVendor(mac string) (string, bool) {
+	hwaddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", false
+	}
+	if IsRandomizedMAC(hwaddr) {
+		return "", true
+	}
+	if e.OUI == nil {
+		return "", false
+	}
+	return e.OUI.Lookup(hwaddr), false
+}
+
 // ParseWirelessData ingests an array with 2 maps, containing multiple goquery Documents. This is needed, as the WLAN client information is spread across 2 webpages
 func ParseWirelessData(data [2]map[string]*goquery.Document) []WifiClient {
 	//data[0] == zhnwlstatus
@@ -431,7 +597,7 @@ func ParseWirelessData(data [2]map[string]*goquery.Document) []WifiClient {
 		toFloat := func(s string) float64 {
 			var f float64
 			if err != nil {
-				log.Fatal(err)
+				log.Panic(err)
 			}
 			f, err = strconv.ParseFloat(s, 64)
 			return f
@@ -441,14 +607,14 @@ func ParseWirelessData(data [2]map[string]*goquery.Document) []WifiClient {
 			clientData := strings.Split(clientListSlice[i], "|")
 			clientMac, err = net.ParseMAC(clientData[1])
 			if err != nil {
-				log.Fatal(err)
+				log.Panic(err)
 			}
 			rssi := toFloat(clientData[2])
 			noise := toFloat(clientData[3])
 			snr := toFloat(clientData[4])
 			quality := toFloat(clientData[5])
 			if err != nil {
-				log.Fatal(err)
+				log.Panic(err)
 			}
 			clientMap[clientMac.String()] = WifiClient{Interface: "wl" + wlanID, MAC: clientMac.String(), RSSI: rssi, Noise: noise, SNR: snr, Quality: quality}
 		}
@@ -464,7 +630,7 @@ func ParseWirelessData(data [2]map[string]*goquery.Document) []WifiClient {
 		toFloat := func(s string) float64 {
 			var f float64
 			if err != nil {
-				log.Fatal(err)
+				log.Panic(err)
 			}
 			f, err = strconv.ParseFloat(s, 64)
 			return f
@@ -474,7 +640,7 @@ func ParseWirelessData(data [2]map[string]*goquery.Document) []WifiClient {
 			clientData := strings.Split(clientListSlice[i], "|")
 			clientMac, err := net.ParseMAC(clientData[0])
 			if err != nil {
-				log.Fatal(err)
+				log.Panic(err)
 			}
 			timeAssociated := toFloat(clientData[1])
 			txFrames := toFloat(clientData[2])
@@ -487,7 +653,7 @@ func ParseWirelessData(data [2]map[string]*goquery.Document) []WifiClient {
 			TXRate := toFloat(clientData[9])
 			RXRate := toFloat(clientData[10])
 			if err != nil {
-				log.Fatal(err)
+				log.Panic(err)
 			}
 			client := clientMap[clientMac.String()]
 			client.AssociatedTime = timeAssociated
@@ -509,9 +675,9 @@ func ParseWirelessData(data [2]map[string]*goquery.Document) []WifiClient {
 	return clients
 }
 
-// ParseinterfaceStatus will parse the status of interfaces, presented on the interfaces page
-func ParseinterfaceStatus(data *goquery.Document) map[string][2]float64 {
-	interfaceStatus := make(map[string][2]float64)
+// ParseEthernetStatus will parse the status of interfaces, presented on the interfaces page
+func ParseEthernetStatus(data *goquery.Document) map[string]EthernetPort {
+	ports := make(map[string]EthernetPort)
 	dump := data.Text()
 	// Same deal as with the Wifi bits. Encoded in a javascript var
 	portlistRE := regexp.MustCompile(`var\ portlistAll\ \=\ '(.+)'`)
@@ -519,37 +685,27 @@ func ParseinterfaceStatus(data *goquery.Document) map[string][2]float64 {
 	split := strings.Split(portList, "#")
 	IDs := strings.Split(strings.Split(split[0], "/")[0], "|")
 	IDs = IDs[0 : len(IDs)-1]
-	values := strings.Split(split[1], "/")
-	ifstate := strings.Split(values[0], "|")
-	ifstate = ifstate[1:]
-	ifspeed := strings.Split(values[1], "|")
-	ifspeed = ifspeed[1:]
-	var speeds []float64
-	var states []float64
-	for i := range ifspeed {
-		if ifspeed[i] == "-" {
-			speeds = append(speeds, float64(0))
-		} else {
-			speed, _ := strconv.ParseFloat(ifspeed[i], 64)
-			speeds = append(speeds, speed)
-		}
-		if ifstate[i] == "Up" {
-			states = append(states, float64(1))
-		} else {
-			states = append(states, float64(0))
-		}
-	}
+	// Every row holds a label, followed by the value for each port
+	rows := strings.Split(split[1], "/")
 	for i := range IDs {
-		interfaceStatus[IDs[i]] = [2]float64{states[i], speeds[i]}
+		port := EthernetPort{ID: IDs[i]}
+		for j := range rows {
+			values := strings.Split(rows[j], "|")
+			if len(values) <= i+1 {
+				continue
+			}
+			port.set(j, values[0], strings.TrimSpace(values[i+1]))
+		}
+		ports[IDs[i]] = port
 	}
-	return interfaceStatus
+	return ports
 
 }
 
 // ParseInterfaceData parses the interface metrics provided
 func ParseInterfaceData(data *goquery.Document, statusdata *goquery.Document) []InterfaceData {
 	var interfaces []InterfaceData
-	interfaceMap := ParseinterfaceStatus(statusdata)
+	interfaceMap := ParseEthernetStatus(statusdata)
 	tables := data.Find("#table")
 	table := tables.Eq(0)
 	tbodies := table.Find("tbody").Slice(1, 3)
@@ -567,7 +723,7 @@ func ParseInterfaceData(data *goquery.Document, statusdata *goquery.Document) []
 				}
 				value, err := strconv.ParseFloat(columns.Eq(k).Text(), 64)
 				if err != nil {
-					log.Fatal(err)
+					log.Panic(err)
 				}
 				values = append(values, value)
 			}
@@ -582,8 +738,8 @@ func ParseInterfaceData(data *goquery.Document, statusdata *goquery.Document) []
 				txFrames: values[5],
 				txErrs:   values[6],
 				txDrops:  values[7],
-				Status:   interfaceMap[NameID[2]][0],
-				IfSpeed:  interfaceMap[NameID[2]][1],
+				Status:   interfaceMap[NameID[2]].Status(),
+				IfSpeed:  interfaceMap[NameID[2]].Speed,
 			}
 			interfaces = append(interfaces, Interface)
 		}
@@ -622,14 +778,14 @@ func ParseGPONData(data *goquery.Document) GPONData {
 		if columns.Eq(0).Text() == "Receive Level" {
 			level, err := strconv.ParseFloat(strings.TrimSpace(strings.Trim(columns.Eq(1).Text(), "dBm")), 64)
 			if err != nil {
-				log.Fatal(err)
+				log.Panic(err)
 			}
 			gpon.RXPower = level
 		}
 		if columns.Eq(0).Text() == "Transmit Power" {
 			level, err := strconv.ParseFloat(strings.TrimSpace(strings.Trim(columns.Eq(1).Text(), "dBm")), 64)
 			if err != nil {
-				log.Fatal(err)
+				log.Panic(err)
 			}
 			gpon.TXPower = level
 		}
@@ -638,98 +794,477 @@ func ParseGPONData(data *goquery.Document) GPONData {
 	return gpon
 }
 
+// fetchPage retrieves a single page from the Zhone Web Interface and parses it into a goquery Document
+func (e *ZhoneExporter) fetchPage(path string, query url.Values) (*goquery.Document, error) {
+	username, password := e.Credentials()
+	u := url.URL{Scheme: "http",
+		Host:     e.URL,
+		Path:     path,
+		RawQuery: query.Encode(),
+		User:     url.UserPassword(username, password)}
+	start := time.Now()
+	res, err := http.Get(u.String())
+	if err != nil {
+		observePage(path, 0, time.Since(start).Seconds(), 0)
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	observePage(path, res.StatusCode, time.Since(start).Seconds(), len(body))
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Status code: %d %s: %s", res.StatusCode, res.Status, u.Redacted())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return goquery.NewDocumentFromReader(bytes.NewReader(body))
+}
+
 // FetchData executes the web scrapes required for Interface and GPON data, and returns the associated goquery Documents
-func (e *ZhoneExporter) FetchData() (*goquery.Document, *goquery.Document, *goquery.Document) {
-	urls := []url.URL{
-		{Scheme: "http", Host: e.URL, Path: "statsifc.html", User: url.UserPassword(e.username, e.password)},
-		{Scheme: "http", Host: e.URL, Path: "zhnethernetstatus.html", User: url.UserPassword(e.username, e.password)},
-		{Scheme: "http", Host: e.URL, Path: "zhngponstatus.html", User: url.UserPassword(e.username, e.password)}}
+func (e *ZhoneExporter) FetchData() (*goquery.Document, *goquery.Document, *goquery.Document, error) {
+	pages := []string{"statsifc.html", "zhnethernetstatus.html", "zhngponstatus.html"}
 	var results [3]*goquery.Document
-	for i := range urls {
-		res, err := http.Get(urls[i].String())
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer res.Body.Close()
-		if res.StatusCode != 200 {
-			log.Fatal("Status code: %d %s", res.StatusCode, res.Status)
-		}
-		doc, err := goquery.NewDocumentFromReader(res.Body)
+	for i := range pages {
+		doc, err := e.fetchPage(pages[i], nil)
 		if err != nil {
-			log.Fatal(err)
+			return nil, nil, nil, err
 		}
 		results[i] = doc
-
 	}
-	return results[0], results[1], results[2]
+	return results[0], results[1], results[2], nil
 }
 
 //FetchWirelessData performs the same functions as FetchData, but specifically for the WLAN clients
-func (e *ZhoneExporter) FetchWirelessData(radios []string) [2]map[string]*goquery.Document {
-	var (
-		urls    [2]map[string]url.URL
-		results [2]map[string]*goquery.Document
-	)
-	urls[0] = make(map[string]url.URL)
+func (e *ZhoneExporter) FetchWirelessData(radios []string) ([2]map[string]*goquery.Document, error) {
+	var results [2]map[string]*goquery.Document
 	results[0] = make(map[string]*goquery.Document)
-	urls[1] = make(map[string]url.URL)
 	results[1] = make(map[string]*goquery.Document)
 	for _, value := range radios {
 		query := url.Values{}
 		query.Set("curRadio", value)
-		urls[0][value] = url.URL{Scheme: "http",
-			Host:     e.URL,
-			Path:     "zhnwlstatus.cmd",
-			RawQuery: query.Encode(),
-			User:     url.UserPassword(e.username, e.password)}
+		doc, err := e.fetchPage("zhnwlstatus.cmd", query)
+		if err != nil {
+			return results, err
+		}
+		results[0][value] = doc
 		query.Set("action", "view")
-		urls[1][value] = url.URL{Scheme: "http",
-			Host:     e.URL,
-			Path:     "zhnwlinfo.cmd",
-			RawQuery: query.Encode(),
-			User:     url.UserPassword(e.username, e.password)}
-	}
-	for i := range urls {
-		for j := range urls[i] {
-			url := urls[i][j]
-			res, err := http.Get(url.String())
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer res.Body.Close()
-			if res.StatusCode != 200 {
-				log.Fatal(fmt.Sprintf("Status code: %d %s: %s", res.StatusCode, res.Status, url.String()))
-			}
-			doc, err := goquery.NewDocumentFromReader(res.Body)
+		doc, err = e.fetchPage("zhnwlinfo.cmd", query)
+		if err != nil {
+			return results, err
+		}
+		results[1][value] = doc
+	}
+	return results, nil
+}
+
+// SetTransport switches to the web, telnet or SSH transport, the CLI being reached at the configured address or the standard port of the gateway
+func (e *ZhoneExporter) SetTransport(config TransportConfig) error {
+	switch config.Transport {
+	case "web":
+		e.Transport = &WebTransport{exporter: e}
+	case "telnet":
+		e.Transport = NewTelnetTransport(cliHostPort(e.URL, config.CLIAddress, "23"), e.Credentials)
+	case "ssh":
+		var hostKeyCallback ssh.HostKeyCallback
+		switch {
+		case config.SSHKnownHosts != "":
+			var err error
+			hostKeyCallback, err = knownhosts.New(config.SSHKnownHosts)
 			if err != nil {
-				log.Fatal(err)
+				return err
 			}
-			results[i][j] = doc
+		case config.SSHInsecure:
+			hostKeyCallback = ssh.InsecureIgnoreHostKey()
+		default:
+			return fmt.Errorf("The ssh transport needs -ssh-known-hosts to verify the host key of %s, or -ssh-insecure to accept any key.", e.URL)
 		}
+		e.Transport = NewSSHTransport(cliHostPort(e.URL, config.CLIAddress, "22"), e.Credentials, hostKeyCallback)
+	default:
+		return fmt.Errorf("Unknown transport %q, see usage.", config.Transport)
+	}
+	return nil
+}
+
+// cliHostPort returns the address of the gateway's CLI, the gateway itself on the default port unless configured otherwise
+func cliHostPort(host string, address string, port string) string {
+	if address != "" {
+		return address
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
 	}
-	return results
+	return net.JoinHostPort(host, port)
+}
+
+// shutdownTimeout is how long the requests in progress are given to complete on shutdown
+const shutdownTimeout = 10 * time.Second
+
+// serveWeb serves the web endpoints on listener, with the TLS and basic auth of webConfigFile when it is set.
+// The certificates are read again for every new connection, so they can be renewed without a restart
+func serveWeb(listener net.Listener, server *http.Server, webConfigFile string) error {
+	return web.Serve(listener, server, webConfigFile, kitlog.NewLogfmtLogger(kitlog.NewSyncWriter(os.Stderr)))
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			os.Exit(runCheck(os.Args[2:]))
+		case "scrape":
+			os.Exit(runScrape(os.Args[2:]))
+		case "status":
+			os.Exit(runStatus(os.Args[2:]))
+		case "top":
+			os.Exit(runTop(os.Args[2:]))
+		case "doctor":
+			os.Exit(runDoctor(os.Args[2:]))
+		}
+	}
+
 	username := flag.String("u", "user", "Username")
 	password := flag.String("p", "user", "Password")
 	listenAddress := flag.String("l", ":2112", "Listen Address")
+	webConfigFile := flag.String("web-config-file", "", "Web configuration file of the Prometheus exporter toolkit, enabling TLS and basic auth on the listen address")
+	configFile := flag.String("config-file", "", "YAML file overriding the credentials, event and notification flags and listing more gateways to collect, reloaded on SIGHUP")
+	webEnableReload := flag.Bool("web-enable-reload", false, "Also reload the configuration file on a POST to /-/reload")
+	ouiFile := flag.String("oui-file", "", "IEEE OUI database (oui.csv or oui.txt) to use instead of the embedded copy")
+	syslogUDP := flag.String("syslog-udp", "", "Listen Address for syslog messages over UDP, disabled if empty")
+	syslogTCP := flag.String("syslog-tcp", "", "Listen Address for syslog messages over TCP, disabled if empty")
+	transport := flag.String("transport", "web", "How to retrieve data from the gateway: web, telnet or ssh")
+	cliAddress := flag.String("cli-address", "", "Address of the telnet or SSH server, defaults to the gateway on the standard port")
+	sshKnownHosts := flag.String("ssh-known-hosts", "", "known_hosts file to verify the gateway's SSH host key")
+	sshInsecure := flag.Bool("ssh-insecure", false, "Accept any SSH host key when there is no -ssh-known-hosts")
+	upnp := flag.Bool("upnp", false, "Also read the WAN counters from the UPnP IGD service of the gateway")
+	upnpLocation := flag.String("upnp-location", "", "URL of the UPnP IGD device description, discovered through SSDP if empty")
+	snmpListen := flag.String("snmp-listen", "", "Listen Address for the SNMP agent, disabled if empty")
+	snmpCommunity := flag.String("snmp-community", "public", "SNMPv2c community, only answered along with SNMPv3 when given explicitly")
+	snmpUser := flag.String("snmp-user", "", "SNMPv3 user name, SNMPv3 is disabled if empty")
+	snmpAuthProtocol := flag.String("snmp-auth-protocol", "SHA", "SNMPv3 authentication protocol: MD5, SHA, SHA224, SHA256, SHA384 or SHA512")
+	snmpAuthPassword := flag.String("snmp-auth-password", "", "SNMPv3 authentication password")
+	snmpPrivProtocol := flag.String("snmp-priv-protocol", "AES", "SNMPv3 privacy protocol: DES, AES, AES192, AES256, or empty for authNoPriv")
+	snmpPrivPassword := flag.String("snmp-priv-password", "", "SNMPv3 privacy password")
+	acsListen := flag.String("acs-listen", "", "Listen Address for the TR-069 ACS, disabled if empty")
+	acsUsername := flag.String("acs-username", "", "Username the gateway must use to connect to the ACS, required with -acs-listen")
+	acsPassword := flag.String("acs-password", "", "Password the gateway must use to connect to the ACS")
+	mqttBroker := flag.String("mqtt-broker", "", "MQTT broker to publish the gateway data to, such as tcp://localhost:1883, disabled if empty")
+	mqttUsername := flag.String("mqtt-username", "", "MQTT username")
+	mqttPassword := flag.String("mqtt-password", "", "MQTT password")
+	mqttTopicPrefix := flag.String("mqtt-topic-prefix", "zhone", "Prefix of the MQTT state topics")
+	mqttDiscoveryPrefix := flag.String("mqtt-discovery-prefix", "homeassistant", "Home Assistant MQTT discovery prefix")
+	influxURL := flag.String("influx-url", "", "InfluxDB v2 server to write the gateway data to, such as http://localhost:8086, disabled if empty")
+	influxOrg := flag.String("influx-org", "", "InfluxDB organisation")
+	influxBucket := flag.String("influx-bucket", "zhone", "InfluxDB bucket")
+	influxToken := flag.String("influx-token", "", "InfluxDB API token")
+	graphiteAddress := flag.String("graphite-address", "", "Carbon plaintext address to write the gateway data to, such as localhost:2003, disabled if empty")
+	graphitePrefix := flag.String("graphite-prefix", "zhone", "Prefix of the Graphite metric paths")
+	sinkBatchSize := flag.Int("sink-batch-size", 500, "Maximum number of points written to InfluxDB or Graphite at once")
+	sinkBufferSize := flag.Int("sink-buffer-size", 10000, "Number of points kept while InfluxDB or Graphite is unavailable")
+	sinkFlushInterval := flag.Duration("sink-flush-interval", 10*time.Second, "How often buffered points are written to InfluxDB or Graphite")
+	events := flag.Bool("events", false, "Diff consecutive scrapes into wifi client, interface and GPON events, served on /events and logged")
+	eventOpticalThreshold := flag.Float64("event-optical-threshold", 1, "Change in dB of the GPON receive or transmit power reported as an event")
+	notifyWebhookURL := flag.String("notify-webhook-url", "", "URL the notifications are posted to as JSON, disabled if empty")
+	notifySMTPServer := flag.String("notify-smtp-server", "", "SMTP server (host:port) the notifications are mailed through, disabled if empty")
+	notifySMTPFrom := flag.String("notify-smtp-from", "zhone-exporter@localhost", "Sender of the notification mails")
+	notifySMTPTo := flag.String("notify-smtp-to", "", "Recipients of the notification mails, separated by commas")
+	notifySMTPUsername := flag.String("notify-smtp-username", "", "SMTP username, no authentication if empty")
+	notifySMTPPassword := flag.String("notify-smtp-password", "", "SMTP password")
+	notifyGPONRXBelow := flag.Float64("notify-gpon-rx-below", 0, "Notify when the GPON receive power is below this level in dBm, disabled if 0")
+	notifyInterfacesDown := flag.String("notify-interfaces-down", "", "Interfaces to notify about when down, separated by commas")
+	notifyRSSIBelow := flag.Float64("notify-rssi-below", 0, "Notify when a wifi client's RSSI is below this level in dBm, disabled if 0")
+	notifyDownScrapes := flag.Int("notify-down-scrapes", 3, "Notify when this many scrapes of the gateway failed in a row, disabled if 0")
+	notifyRepeatInterval := flag.Duration("notify-repeat-interval", 4*time.Hour, "How long before an unresolved alert is notified again")
+	notifyMaxPerHour := flag.Int("notify-max-per-hour", 10, "Maximum number of notifications sent per hour through each channel")
+	pollInterval := flag.Duration("poll-interval", 30*time.Second, "How often the gateway is scraped for events, notifications, the MQTT publisher and the InfluxDB and Graphite sinks")
+	remoteWriteURL := flag.String("remote-write-url", "", "Prometheus remote_write endpoint to push the metrics to, disabled if empty")
+	pushgatewayURL := flag.String("pushgateway-url", "", "Pushgateway to push the metrics to, disabled if empty")
+	pushJob := flag.String("push-job", "zhone-exporter", "job label of the pushed metrics")
+	pushInterval := flag.Duration("push-interval", 30*time.Second, "How often the metrics are collected and pushed")
+	pushWALDir := flag.String("push-wal-dir", "", "Directory keeping the remote_write samples not sent yet across restarts, in memory only if empty")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OpenTelemetry Collector to export the metrics to over OTLP, such as http://localhost:4317, disabled if empty")
+	otlpProtocol := flag.String("otlp-protocol", "grpc", "OTLP protocol: grpc or http/protobuf")
+	otlpHeaders := flag.String("otlp-headers", "", "Headers sent with the OTLP requests, as key=value pairs separated by commas")
+	otlpInterval := flag.Duration("otlp-interval", 30*time.Second, "How often the metrics are exported over OTLP")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr,
 			"Usage: %s [FLAGS...] HOSTNAME_TO_QUERY\n", os.Args[0])
+		fmt.Fprintf(os.Stderr,
+			"       %s -config-file FILE [FLAGS...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr,
+			"       %s -acs-listen ADDRESS -acs-username USER -acs-password PASSWORD [FLAGS...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr,
+			"       %s check|scrape|status|top|doctor [FLAGS...] HOSTNAME_TO_QUERY\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.Parse()
-	if len(flag.Args()) == 0 || len(flag.Args()) > 1 {
+	if len(flag.Args()) > 1 || (len(flag.Args()) == 0 && *acsListen == "" && *configFile == "") {
 		log.Fatal("Incorrect arguments passed, see usage.")
 	}
-	host := flag.Args()[0]
-	exporter := NewZhoneExporter(host, *username, *password)
-	prometheus.MustRegister(exporter)
+	if err := web.Validate(*webConfigFile); err != nil {
+		log.Fatalf("Invalid web configuration file %s: %v", *webConfigFile, err)
+	}
+	defaults := Config{
+		Username:              *username,
+		Password:              *password,
+		EventOpticalThreshold: *eventOpticalThreshold,
+		Notify: NotifyConfig{
+			GPONRXBelow:    *notifyGPONRXBelow,
+			RSSIBelow:      *notifyRSSIBelow,
+			DownScrapes:    *notifyDownScrapes,
+			RepeatInterval: *notifyRepeatInterval,
+			MaxPerHour:     *notifyMaxPerHour,
+		},
+	}
+	if *notifyInterfacesDown != "" {
+		defaults.Notify.InterfacesDown = strings.Split(*notifyInterfacesDown, ",")
+	}
+	config, err := LoadConfig(*configFile, defaults)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(flag.Args()) == 0 && *acsListen == "" && len(config.Targets) == 0 {
+		log.Fatal("Incorrect arguments passed, see usage.")
+	}
+	observeReload(nil)
+	var acs *ACS
+	var acsServer *http.Server
+	if *acsListen != "" {
+		if *acsUsername == "" {
+			log.Fatal("-acs-listen requires -acs-username and -acs-password, for the gateway to authenticate to the ACS")
+		}
+		acs = NewACS(*acsUsername, *acsPassword)
+		prometheus.MustRegister(acs)
+		acsListener, err := net.Listen("tcp", *acsListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		acsServer = &http.Server{Handler: acs}
+		go func() {
+			if err := acsServer.Serve(acsListener); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	registerSelfMetrics(prometheus.DefaultRegisterer)
+
+	// without a gateway to query, the exporter only presents what the ACS receives
+	var target string
+	var fetchDevice func() (DeviceInfo, error)
+	var gateway *ZhoneExporter
+	var health *Health
+	var eventStream *EventStream
+	var notifier *Notifier
+	landing := &LandingPage{}
+	landing.Add("/metrics", "Prometheus metrics")
+	defaultTransport := TransportConfig{Transport: *transport, CLIAddress: *cliAddress, SSHKnownHosts: *sshKnownHosts, SSHInsecure: *sshInsecure}
+	oui := NewOUIDatabase()
+	if *ouiFile != "" {
+		if oui, err = LoadOUIDatabase(*ouiFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(flag.Args()) == 1 {
+		host := flag.Args()[0]
+		target = host
+		exporter := NewZhoneExporter(host, config.Username, config.Password)
+		if err := exporter.SetTransport(defaultTransport); err != nil {
+			log.Fatal(err)
+		}
+		exporter.OUI = oui
+		gateway = exporter
+		health = NewHealth(exporter)
+		landing.Target = host
+		if _, ok := exporter.Transport.(*WebTransport); ok {
+			fetchDevice = exporter.FetchDeviceInfo
+		}
+		http.Handle("/api/v1/", NewAPI(exporter))
+		landing.Add("/api/v1/interfaces", "Interfaces as JSON")
+		landing.Add("/api/v1/gpon", "GPON link as JSON")
+		landing.Add("/api/v1/wifi/clients", "Wifi clients as JSON")
+		landing.Add("/api/v1/device", "Gateway identity as JSON")
+		landing.Add("/api/v1/openapi.yaml", "OpenAPI specification of the JSON API")
+		if *upnp || *upnpLocation != "" {
+			igd := NewUPnPCollector(host, *upnpLocation)
+			igd.CrossCheck(exporter)
+			prometheus.MustRegister(igd)
+		}
+		if *snmpListen != "" {
+			community := *snmpCommunity
+			if *snmpUser != "" {
+				// the default community would leave the data readable without the SNMPv3 credentials
+				community = ""
+				flag.Visit(func(f *flag.Flag) {
+					if f.Name == "snmp-community" {
+						community = *snmpCommunity
+					}
+				})
+			}
+			agent := NewSNMPAgent(exporter, community)
+			if *snmpUser != "" {
+				if err := agent.EnableV3(*snmpUser, *snmpAuthProtocol, *snmpAuthPassword, *snmpPrivProtocol, *snmpPrivPassword); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if err := agent.ListenUDP(*snmpListen); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *syslogUDP != "" || *syslogTCP != "" {
+			receiver := NewSyslogReceiver(host)
+			if *syslogUDP != "" {
+				if err := receiver.ListenUDP(*syslogUDP); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if *syslogTCP != "" {
+				if err := receiver.ListenTCP(*syslogTCP); err != nil {
+					log.Fatal(err)
+				}
+			}
+			prometheus.MustRegister(receiver)
+		}
+		poll := false
+		if *events {
+			eventStream = NewEventStream(exporter, config.EventOpticalThreshold)
+			http.Handle("/events", eventStream)
+			landing.Add("/events", "Stream of changes as Server-Sent Events")
+			poll = true
+		}
+		if *mqttBroker != "" {
+			if _, err := NewMQTTPublisher(exporter, *mqttBroker, *mqttUsername, *mqttPassword, *mqttTopicPrefix, *mqttDiscoveryPrefix); err != nil {
+				log.Fatal(err)
+			}
+			poll = true
+		}
+		var channels []NotifyChannel
+		if *notifyWebhookURL != "" {
+			channels = append(channels, NewWebhookChannel(*notifyWebhookURL))
+		}
+		if *notifySMTPServer != "" {
+			if *notifySMTPTo == "" {
+				log.Fatal("-notify-smtp-to is required with -notify-smtp-server, see usage.")
+			}
+			channels = append(channels, NewSMTPChannel(*notifySMTPServer, *notifySMTPFrom, strings.Split(*notifySMTPTo, ","), *notifySMTPUsername, *notifySMTPPassword))
+		}
+		if len(channels) > 0 {
+			notifier = NewNotifier(exporter, config.Notify.rules(), channels...)
+			notifier.RepeatInterval = config.Notify.RepeatInterval
+			notifier.MaxPerHour = config.Notify.MaxPerHour
+			poll = true
+		}
+		var sinks []*SinkWriter
+		if *influxURL != "" {
+			sinks = append(sinks, NewSinkWriter("InfluxDB", NewInfluxSink(*influxURL, *influxOrg, *influxBucket, *influxToken), *sinkBatchSize, *sinkBufferSize, *sinkFlushInterval))
+		}
+		if *graphiteAddress != "" {
+			sinks = append(sinks, NewSinkWriter("Graphite", NewGraphiteSink(*graphiteAddress, *graphitePrefix), *sinkBatchSize, *sinkBufferSize, *sinkFlushInterval))
+		}
+		for _, sink := range sinks {
+			sink := sink
+			exporter.Subscribe(func(snapshot *Snapshot) {
+				sink.Add(SnapshotPoints(host, snapshot))
+			})
+			go sink.Run()
+			poll = true
+		}
+		if poll {
+			go exporter.Poll(*pollInterval)
+		}
+	}
+	targets := NewTargetSet(gateway, defaultTransport, oui)
+	targets.ACS = acs
+	if err := targets.Configure(config); err != nil {
+		log.Fatal(err)
+	}
+	prometheus.MustRegister(targets)
+	if *remoteWriteURL != "" || *pushgatewayURL != "" {
+		var remote *RemoteWriter
+		if *remoteWriteURL != "" {
+			var err error
+			remote, err = NewRemoteWriter(*remoteWriteURL, *pushWALDir)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		go NewPusher(prometheus.DefaultGatherer, *pushJob, remote, *pushgatewayURL).Run(*pushInterval)
+	}
+	if *otlpEndpoint != "" {
+		otlp, err := NewOTLPExporter(prometheus.DefaultGatherer, *otlpEndpoint, *otlpProtocol, *otlpHeaders, target, fetchDevice)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go otlp.Run(*otlpInterval)
+	}
 	http.Handle("/metrics", promhttp.Handler())
-	err := http.ListenAndServe(*listenAddress, nil)
+	if health == nil {
+		health = NewHealth(nil)
+	}
+	http.HandleFunc("/-/healthy", health.ServeHealthy)
+	http.HandleFunc("/-/ready", health.ServeReady)
+	landing.Add("/-/healthy", "Liveness, never queries the gateway")
+	landing.Add("/-/ready", "Readiness, whether the last collection from the gateway succeeded")
+	reloader := NewReloader(*configFile, defaults, gateway, targets, eventStream, notifier)
+	if *webEnableReload {
+		http.Handle("/-/reload", reloader)
+		landing.Add("/-/reload", "Reloads the configuration file on a POST")
+	}
+	http.Handle("/", landing)
+	go func() {
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		for range hangups {
+			if err := reloader.Reload(); err != nil {
+				log.Printf("Unable to reload the configuration: %v", err)
+			}
+		}
+	}()
+
+	// under systemd socket activation, the listen address is that of the socket unit
+	listener, err := activatedListener()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if listener == nil {
+		if listener, err = net.Listen("tcp", *listenAddress); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// request contexts are cancelled on shutdown, so the event streams end rather than hold it up
+	ctx, cancel := context.WithCancel(context.Background())
+	server := &http.Server{BaseContext: func(net.Listener) context.Context { return ctx }}
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		log.Printf("Received %s, shutting down", <-signals)
+		sdNotify("STOPPING=1")
+		cancel()
+		timeout, cancelTimeout := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancelTimeout()
+		if err := server.Shutdown(timeout); err != nil {
+			log.Printf("Unable to shut down gracefully: %v", err)
+		}
+		if acsServer != nil {
+			if err := acsServer.Shutdown(timeout); err != nil {
+				log.Printf("Unable to shut down the ACS gracefully: %v", err)
+			}
+		}
+		if notifier != nil {
+			if err := notifier.Flush(timeout); err != nil {
+				log.Printf("Unable to send the pending notifications: %v", err)
+			}
+		}
+		close(stopped)
+	}()
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("Unable to notify systemd: %v", err)
+	}
+	if interval := watchdogInterval(); interval > 0 {
+		go runWatchdog(interval, gateway)
+	}
+	err = serveWeb(listener, server, *webConfigFile)
 	if err != http.ErrServerClosed {
 		log.Fatal(err)
 		os.Exit(1)
 	}
+	<-stopped
 }
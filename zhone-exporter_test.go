@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+func TestScrapeGPONLink(t *testing.T) {
+	exporter := testGateway(t, scrapePages)
+	var published *Snapshot
+	exporter.Subscribe(func(snapshot *Snapshot) { published = snapshot })
+	if _, err := exporter.Scrape(); err != nil {
+		t.Fatal(err)
+	}
+	// subscribers see the GPON link named after its interface, as the metrics label it
+	if published == nil || published.GPON.ID != "eth0" || published.GPON.Name == "" {
+		t.Fatalf("published GPON link %+v, want it named after eth0", published)
+	}
+	for _, Interface := range published.Interfaces {
+		if Interface.ID == "eth0" && Interface.Name != published.GPON.Name {
+			t.Errorf("GPON name = %q, want %q", published.GPON.Name, Interface.Name)
+		}
+	}
+}
+
+func TestServeWebConfig(t *testing.T) {
+	const config = "testdata/web/web-config.yml"
+	if err := web.Validate(config); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "cpe_up 1") })
+	server := &http.Server{Handler: mux}
+	served := make(chan error, 1)
+	go func() { served <- serveWeb(listener, server, config) }()
+	defer func() {
+		server.Close()
+		if err := <-served; err != http.ErrServerClosed {
+			t.Errorf("serveWeb: %v", err)
+		}
+	}()
+
+	certificate, err := os.ReadFile("testdata/web/server.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certificate)
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		Timeout:   5 * time.Second,
+	}
+	get := func(url string, username string, password string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	address := listener.Addr().String()
+	if code, _ := get("http://"+address+"/metrics", "prometheus", "secret"); code == http.StatusOK {
+		t.Error("the metrics were served without TLS")
+	}
+	for _, test := range []struct {
+		name, username, password string
+		want                     int
+	}{
+		{"without credentials", "", "", http.StatusUnauthorized},
+		{"wrong password", "prometheus", "guess", http.StatusUnauthorized},
+		{"unknown user", "admin", "secret", http.StatusUnauthorized},
+		{"valid credentials", "prometheus", "secret", http.StatusOK},
+	} {
+		code, body := get("https://"+address+"/metrics", test.username, test.password)
+		if code != test.want {
+			t.Errorf("%s: HTTP %d, want %d", test.name, code, test.want)
+		}
+		if code == http.StatusOK && body != "cpe_up 1" {
+			t.Errorf("%s: body %q", test.name, body)
+		}
+	}
+}